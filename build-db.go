@@ -2,31 +2,1172 @@ package main
 
 import (
     "bufio"
+    "crypto/sha256"
     "database/sql"
+    "encoding/hex"
+    "encoding/xml"
+    "flag"
     "fmt"
+    "io"
     "log"
+    "net/http"
     "net/url"
     "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "time"
 
+    "github.com/lib/pq"
     _ "github.com/mattn/go-sqlite3"
+    "gopkg.in/yaml.v3"
+
+    "roms-bot/internal/romname"
 )
 
+// hashFile returns the hex SHA-256 of the file's contents
+func hashFile(f *os.File) (string, error) {
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseRule maps the path below a URL prefix to section, console and file.
+// fields names the field of each path segment in order: "section",
+// "console", "file" or "-" to skip it. A field named more than once joins
+// its segments with " - ", and the last field takes the rest of the path.
+type parseRule struct {
+    prefix string
+    fields []string
+    source string // label stored in the source column
+}
+
+// defaultRules covers the mirror's prefix/section/console/file layout
+var defaultRules = []parseRule{
+    {prefix: "https://myrient.erista.me/files/", fields: []string{"section", "console", "file"}, source: "myrient"},
+}
+
+// parse splits rawurl by the rule, reporting false if it doesn't apply
+func (r parseRule) parse(rawurl string) (section, console, file string, ok bool) {
+    if !strings.HasPrefix(rawurl, r.prefix) {
+        return "", "", "", false
+    }
+    parts := strings.SplitN(strings.TrimPrefix(rawurl, r.prefix), "/", len(r.fields))
+    if len(parts) != len(r.fields) {
+        return "", "", "", false // skip malformed lines
+    }
+    values := map[string][]string{}
+    for i, field := range r.fields {
+        if field == "-" {
+            continue
+        }
+        part, err := url.QueryUnescape(parts[i])
+        if err != nil || part == "" {
+            return "", "", "", false // skip lines with bad encoding
+        }
+        values[field] = append(values[field], part)
+    }
+    section = strings.Join(values["section"], " - ")
+    console = strings.Join(values["console"], " - ")
+    file = strings.Join(values["file"], " - ")
+    return section, console, file, file != ""
+}
+
+// newParseRule checks a layout such as "section/-/console/file" and makes a
+// rule of it. An empty source defaults to the prefix's host name.
+func newParseRule(prefix, layout, source string) (parseRule, error) {
+    fields := strings.Split(layout, "/")
+    hasFile := false
+    for _, field := range fields {
+        switch field {
+        case "section", "console", "-":
+        case "file":
+            hasFile = true
+        default:
+            return parseRule{}, fmt.Errorf("unknown field %q", field)
+        }
+    }
+    if !hasFile {
+        return parseRule{}, fmt.Errorf("layout has no file field")
+    }
+    if source == "" {
+        u, err := url.Parse(prefix)
+        if err != nil || u.Host == "" {
+            return parseRule{}, fmt.Errorf("prefix %q is not a URL", prefix)
+        }
+        source = u.Hostname()
+    }
+    return parseRule{prefix: prefix, fields: fields, source: source}, nil
+}
+
+// loadRules reads parse rules, one "<prefix> <field>/<field>/... [source]"
+// per line, e.g. "https://example.org/roms/ section/-/console/file
+// example". Rules from the file and from the sources in config come before
+// the default ones, longer prefixes first. Missing files leave just the
+// defaults.
+func loadRules(path, configPath string) ([]parseRule, error) {
+    rules, err := loadSources(configPath)
+    if err != nil {
+        return nil, err
+    }
+    f, err := os.Open(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        defer f.Close()
+        scanner := bufio.NewScanner(f)
+        for line := 1; scanner.Scan(); line++ {
+            text := strings.TrimSpace(scanner.Text())
+            if text == "" || strings.HasPrefix(text, "#") {
+                continue
+            }
+            parts := strings.Fields(text)
+            if len(parts) != 2 && len(parts) != 3 {
+                return nil, fmt.Errorf("%s:%d: want \"<prefix> <layout> [source]\"", path, line)
+            }
+            source := ""
+            if len(parts) == 3 {
+                source = parts[2]
+            }
+            rule, err := newParseRule(parts[0], parts[1], source)
+            if err != nil {
+                return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+            }
+            rules = append(rules, rule)
+        }
+        if err := scanner.Err(); err != nil {
+            return nil, err
+        }
+    }
+    sort.SliceStable(rules, func(i, j int) bool {
+        return len(rules[i].prefix) > len(rules[j].prefix)
+    })
+    return append(rules, defaultRules...), nil
+}
+
+// sourceConfig is an entry of the sources: list in the bot's config.yaml
+type sourceConfig struct {
+    Label  string `yaml:"label"`
+    Prefix string `yaml:"prefix"`
+    Layout string `yaml:"layout"`
+}
+
+// loadSources reads the sources: list from the bot's config as parse
+// rules. Layout defaults to section/console/file.
+func loadSources(configPath string) ([]parseRule, error) {
+    data, err := os.ReadFile(configPath)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var cfg struct {
+        Sources []sourceConfig `yaml:"sources"`
+    }
+    if err := yaml.Unmarshal(data, &cfg); err != nil {
+        return nil, fmt.Errorf("%s: %w", configPath, err)
+    }
+    var rules []parseRule
+    for i, src := range cfg.Sources {
+        layout := src.Layout
+        if layout == "" {
+            layout = "section/console/file"
+        }
+        rule, err := newParseRule(src.Prefix, layout, src.Label)
+        if err != nil {
+            return nil, fmt.Errorf("%s: sources[%d]: %w", configPath, i, err)
+        }
+        rules = append(rules, rule)
+    }
+    return rules, nil
+}
+
+// fillSources sets source on rows that don't have one yet, i.e. rows
+// imported before the column existed, from the rule matching their URL
+func fillSources(db *sql.DB, rules []parseRule) error {
+    for _, rule := range rules {
+        // Rules are longest prefix first, so a row keeps the first match
+        _, err := db.Exec("UPDATE files SET source = ? WHERE source IS NULL AND SUBSTR(rawurl, 1, ?) = ?",
+            rule.source, len(rule.prefix), rule.prefix)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// searchBlobExpr is the SQL for the search_blob column: the lowercased
+// fields joined by char(31), so one LIKE matches any field but no term
+// matches across two of them. The bot relies on this exact format.
+func searchBlobExpr(section, console, file string) string {
+    return "LOWER(" + section + " || char(31) || " + console + " || char(31) || " + file + ")"
+}
+
+// tagsOf returns the region and language tags of a file name as stored in
+// the region and languages columns, e.g. "USA,Europe" and "En,Fr" for
+// "Game (USA, Europe) (En,Fr).zip". Each is "" when the name has none.
+func tagsOf(file string) (region, languages string) {
+    for _, m := range romname.ParenPattern.FindAllStringSubmatch(file, -1) {
+        parts := strings.Split(m[1], ",")
+        var regions []string
+        langs := true
+        for i, part := range parts {
+            parts[i] = strings.TrimSpace(part)
+            if romname.KnownRegions[parts[i]] {
+                regions = append(regions, parts[i])
+            }
+            if !romname.LanguagePattern.MatchString(parts[i]) {
+                langs = false
+            }
+        }
+        // Only the first tag of each kind counts
+        if region == "" && len(regions) > 0 {
+            region = strings.Join(regions, ",")
+        }
+        if languages == "" && langs {
+            languages = strings.Join(parts, ",")
+        }
+    }
+    return region, languages
+}
+
+// defaultExtensions are the file types imported and crawled unless
+// -extensions says otherwise
+const defaultExtensions = ".zip,.7z,.chd,.rvz,.iso,.wbfs"
+
+// parseExtensions splits an -extensions list like "zip,.7z" into lowercase
+// extensions with their dots
+func parseExtensions(list string) []string {
+    var exts []string
+    for _, ext := range strings.Split(strings.ToLower(list), ",") {
+        ext = strings.TrimSpace(ext)
+        if ext == "" {
+            continue
+        }
+        if !strings.HasPrefix(ext, ".") {
+            ext = "." + ext
+        }
+        exts = append(exts, ext)
+    }
+    return exts
+}
+
+// extensionOf returns the ext column for a file name: its lowercase
+// extension, and whether that is one of exts
+func extensionOf(name string, exts []string) (string, bool) {
+    ext := strings.ToLower(path.Ext(name))
+    for _, e := range exts {
+        if ext == e {
+            return ext, true
+        }
+    }
+    return ext, false
+}
+
+// importCounts tallies what became of the link list's URLs
+type importCounts struct {
+    inserted int // new rows
+    existing int // already in links.db from an earlier build
+    repeated int // listed more than once in the link list itself
+}
+
+// record notes rawurl as listed with listStmt and, the first time the list
+// has it, inserts its row with insertStmt. It returns the new row's rowid,
+// 0 when nothing was inserted.
+func (c *importCounts) record(listStmt, insertStmt *sql.Stmt, rawurl string, row ...interface{}) (int64, error) {
+    res, err := listStmt.Exec(rawurl)
+    if err != nil {
+        return 0, err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        c.repeated++
+        return 0, nil
+    }
+    res, err = insertStmt.Exec(row...)
+    if err != nil {
+        return 0, err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        // INSERT OR IGNORE skipped a rawurl that is already in the table
+        c.existing++
+        return 0, nil
+    }
+    c.inserted++
+    return res.LastInsertId()
+}
+
+// fillTags sets region, languages, title and ext on rows that don't have
+// them yet, i.e. rows imported before the columns existed
+func fillTags(db *sql.DB) error {
+    rows, err := db.Query("SELECT rawurl, file FROM files WHERE region IS NULL OR title IS NULL OR ext IS NULL")
+    if err != nil {
+        return err
+    }
+    type row struct{ rawurl, file string }
+    var todo []row
+    for rows.Next() {
+        var r row
+        if err := rows.Scan(&r.rawurl, &r.file); err != nil {
+            rows.Close()
+            return err
+        }
+        todo = append(todo, r)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    if len(todo) == 0 {
+        return nil
+    }
+    fmt.Printf("Parsing titles, regions, languages and extensions for %d existing rows...\n", len(todo))
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    stmt, err := tx.Prepare("UPDATE files SET region = ?, languages = ?, title = ?, ext = ? WHERE rawurl = ?")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    for _, r := range todo {
+        region, languages := tagsOf(r.file)
+        ext, _ := extensionOf(r.file, nil)
+        if _, err := stmt.Exec(region, languages, romname.NormalizeTitle(r.file), ext, r.rawurl); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// addColumn adds a column to table unless it's already there, reporting
+// whether it did
+func addColumn(db *sql.DB, table, column, decl string) (bool, error) {
+    rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+    if err != nil {
+        return false, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return false, err
+        }
+        if name == column {
+            return false, nil
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return false, err
+    }
+    rows.Close()
+    _, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+    return err == nil, err
+}
+
+// tableExists reports whether the database has a table (or virtual table)
+// called name
+func tableExists(db *sql.DB, name string) bool {
+    var exists bool
+    err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", name).Scan(&exists)
+    return err == nil && exists
+}
+
+// createFTS creates files_fts, the full-text index the bot searches with
+// MATCH, if it isn't there yet. The trigram tokenizer makes MATCH find any
+// substring of three or more characters, like the LIKE '%term%' it
+// replaces. FTS5 is only there when built with -tags sqlite_fts5; without
+// it ok is false and the bot keeps using LIKE.
+func createFTS(db *sql.DB) (ok bool, err error) {
+    _, err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5(section, console, file, content='files', tokenize='trigram')")
+    if err != nil {
+        if strings.Contains(err.Error(), "no such module") {
+            fmt.Println("FTS5 isn't compiled in (build with -tags sqlite_fts5), skipping the full-text index.")
+            return false, nil
+        }
+        return false, err
+    }
+    return true, nil
+}
+
+// ftsComplete reports whether files_fts holds every row of files: its
+// fts_complete meta key is only set once buildFTS has filled it. An index
+// created by a run that was interrupted before then is missing rows, and
+// only a full rebuild brings them back.
+func ftsComplete(db *sql.DB) bool {
+    var value string
+    err := db.QueryRow("SELECT value FROM meta WHERE key = 'fts_complete'").Scan(&value)
+    return err == nil && value == "1" && tableExists(db, "files_fts")
+}
+
+// buildFTS creates files_fts if needed, fills it from every row of files
+// and marks it complete
+func buildFTS(db *sql.DB) error {
+    ok, err := createFTS(db)
+    if err != nil || !ok {
+        return err
+    }
+    fmt.Println("Rebuilding the full-text index...")
+    if _, err := db.Exec("INSERT INTO files_fts(files_fts) VALUES('rebuild')"); err != nil {
+        return err
+    }
+    _, err = db.Exec("INSERT OR REPLACE INTO meta(key, value) VALUES ('fts_complete', '1')")
+    return err
+}
+
+// hrefPattern pulls link targets out of a directory listing page
+var hrefPattern = regexp.MustCompile(`href="([^"]+)"`)
+
+// crawl walks the mirror's directory listings from root and writes every
+// link below it ending in one of exts to out, one per line and sorted, so
+// an unchanged mirror gives an unchanged file. Requests are spaced delay
+// apart across all workers, or not spaced at all when delay isn't positive.
+// out is only replaced once the whole crawl has succeeded.
+func crawl(root, out string, delay time.Duration, workers int, exts []string) error {
+    if !strings.HasSuffix(root, "/") {
+        root += "/"
+    }
+    if workers < 1 {
+        workers = 1
+    }
+    client := &http.Client{Timeout: time.Minute}
+    tick, stop := throttle(delay)
+    defer stop()
+    sem := make(chan struct{}, workers)
+
+    var mu sync.Mutex
+    var links []string
+    var crawlErr error
+    dirs := 0
+    var wg sync.WaitGroup
+    var visit func(dir string)
+    visit = func(dir string) {
+        defer wg.Done()
+        sem <- struct{}{}
+        page, err := fetchListing(client, tick, dir)
+        <-sem
+
+        mu.Lock()
+        defer mu.Unlock()
+        if crawlErr != nil {
+            return
+        }
+        if err != nil {
+            crawlErr = err
+            return
+        }
+        dirs++
+        if dirs%100 == 0 {
+            fmt.Printf("Crawled %d directories, %d files so far...\n", dirs, len(links))
+        }
+        for _, m := range hrefPattern.FindAllStringSubmatch(page, -1) {
+            href := m[1]
+            // Only relative links go further down; this skips the parent
+            // directory, sort links and anything on other sites
+            if strings.HasPrefix(href, "/") || strings.HasPrefix(href, ".") || strings.HasPrefix(href, "?") || strings.Contains(href, "://") {
+                continue
+            }
+            switch {
+            case strings.HasSuffix(href, "/"):
+                wg.Add(1)
+                go visit(dir + href)
+            default:
+                if _, ok := extensionOf(href, exts); ok {
+                    links = append(links, dir+href)
+                }
+            }
+        }
+    }
+    wg.Add(1)
+    visit(root)
+    wg.Wait()
+    if crawlErr != nil {
+        return crawlErr
+    }
+
+    sort.Strings(links)
+    tmp := out + ".tmp"
+    if err := os.WriteFile(tmp, []byte(strings.Join(links, "\n")+"\n"), 0644); err != nil {
+        return err
+    }
+    fmt.Printf("Crawled %d directories, found %d files.\n", dirs, len(links))
+    return os.Rename(tmp, out)
+}
+
+// throttle returns a channel that ticks every delay, and a func to stop it.
+// A delay of zero or less means no throttling, so the channel is closed and
+// never blocks.
+func throttle(delay time.Duration) (<-chan time.Time, func()) {
+    if delay <= 0 {
+        c := make(chan time.Time)
+        close(c)
+        return c, func() {}
+    }
+    t := time.NewTicker(delay)
+    return t.C, t.Stop
+}
+
+// fetchListing downloads one directory listing, waiting for a tick before
+// each request and retrying a few times
+func fetchListing(client *http.Client, tick <-chan time.Time, dir string) (string, error) {
+    var lastErr error
+    for attempt := 1; attempt <= 3; attempt++ {
+        <-tick
+        req, err := http.NewRequest(http.MethodGet, dir, nil)
+        if err != nil {
+            return "", err
+        }
+        req.Header.Set("User-Agent", "roms-bot build-db crawler")
+        resp, err := client.Do(req)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        body, err := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        if resp.StatusCode != http.StatusOK {
+            lastErr = fmt.Errorf("%s returned %s", dir, resp.Status)
+            continue
+        }
+        return string(body), nil
+    }
+    return "", fmt.Errorf("giving up on %s: %w", dir, lastErr)
+}
+
+// datFile is the part of a Logiqx XML DAT, the format No-Intro and Redump
+// publish, that the import uses
+type datFile struct {
+    Name  string    `xml:"header>name"`
+    Games []datGame `xml:"game"`
+}
+
+type datGame struct {
+    Name string   `xml:"name,attr"`
+    Roms []datRom `xml:"rom"`
+}
+
+type datRom struct {
+    Name string `xml:"name,attr"`
+    Size int64  `xml:"size,attr"`
+    CRC  string `xml:"crc,attr"`
+    MD5  string `xml:"md5,attr"`
+    SHA1 string `xml:"sha1,attr"`
+}
+
+// runDats imports each DAT into dat_roms, replacing what an earlier import
+// of the same DAT left there. Games are matched to catalog files by name:
+// "Game (USA).zip" for the set "Game (USA)", or a file named like one of
+// its roms. Mirrors name console folders after the DAT, so when there is a
+// console called like the DAT only its files are matched; otherwise a
+// match counts for every console with that file name.
+func runDats(dbfile string, paths []string) error {
+    db, err := sql.Open("sqlite3", dbfile)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+    if !tableExists(db, "files") {
+        return fmt.Errorf("%s has no files table, build it first", dbfile)
+    }
+    _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS dat_roms (
+            file TEXT,
+            console TEXT,
+            game TEXT,
+            rom TEXT,
+            size INTEGER,
+            crc32 TEXT,
+            md5 TEXT,
+            sha1 TEXT,
+            dat TEXT
+        )`)
+    if err != nil {
+        return err
+    }
+    if _, err := db.Exec("CREATE INDEX IF NOT EXISTS dat_roms_file ON dat_roms(file)"); err != nil {
+        return err
+    }
+
+    // Catalog file names, by themselves and without their extension, per
+    // console and across all of them ("")
+    byName := map[string]map[string]string{"": {}}
+    rows, err := db.Query("SELECT DISTINCT console, file FROM files")
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var console, file string
+        if err := rows.Scan(&console, &file); err != nil {
+            rows.Close()
+            return err
+        }
+        if byName[console] == nil {
+            byName[console] = map[string]string{}
+        }
+        for _, names := range []map[string]string{byName[console], byName[""]} {
+            names[file] = file
+            names[strings.TrimSuffix(file, path.Ext(file))] = file
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for _, p := range paths {
+        dat, err := readDat(p)
+        if err != nil {
+            return fmt.Errorf("%s: %w", p, err)
+        }
+        if dat.Name == "" {
+            dat.Name = filepath.Base(p)
+        }
+        console := dat.Name
+        if byName[console] == nil {
+            console = ""
+        }
+        matched, err := importDat(db, dat, console, byName[console])
+        if err != nil {
+            return fmt.Errorf("%s: %w", p, err)
+        }
+        fmt.Printf("%s: matched %d of %d games\n", dat.Name, matched, len(dat.Games))
+    }
+    return nil
+}
+
+func readDat(p string) (*datFile, error) {
+    f, err := os.Open(p)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    var dat datFile
+    if err := xml.NewDecoder(f).Decode(&dat); err != nil {
+        return nil, err
+    }
+    return &dat, nil
+}
+
+// importDat replaces dat's rows in dat_roms in one transaction and returns
+// how many of its games matched a file in byName, the files of console or
+// of the whole catalog when console is ""
+func importDat(db *sql.DB, dat *datFile, console string, byName map[string]string) (int, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DELETE FROM dat_roms WHERE dat = ?", dat.Name); err != nil {
+        return 0, err
+    }
+    stmt, err := tx.Prepare("INSERT INTO dat_roms(file, console, game, rom, size, crc32, md5, sha1, dat) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+    if err != nil {
+        return 0, err
+    }
+    defer stmt.Close()
+
+    matched := 0
+    for _, g := range dat.Games {
+        file, ok := byName[g.Name]
+        for i := 0; !ok && i < len(g.Roms); i++ {
+            file, ok = byName[g.Roms[i].Name]
+        }
+        if !ok {
+            continue
+        }
+        matched++
+        for _, r := range g.Roms {
+            _, err := stmt.Exec(file, console, g.Name, r.Name, r.Size,
+                strings.ToLower(r.CRC), strings.ToLower(r.MD5), strings.ToLower(r.SHA1), dat.Name)
+            if err != nil {
+                return 0, err
+            }
+        }
+    }
+    return matched, tx.Commit()
+}
+
+// postgresSchema is the catalog for bots with db_driver: postgres, the same
+// tables as links.db. The bot creates its own tables itself.
+const postgresSchema = `
+    CREATE TABLE IF NOT EXISTS files (
+        section TEXT,
+        console TEXT,
+        file TEXT,
+        rawurl TEXT PRIMARY KEY,
+        search_blob TEXT,
+        added_at BIGINT,
+        deleted_at BIGINT,
+        size BIGINT,
+        region TEXT,
+        languages TEXT,
+        title TEXT,
+        ext TEXT,
+        source TEXT,
+        status TEXT,
+        checked_at BIGINT
+    );
+    CREATE INDEX IF NOT EXISTS files_checked_at ON files(checked_at);
+    CREATE TABLE IF NOT EXISTS meta (
+        key TEXT PRIMARY KEY,
+        value TEXT
+    );
+    CREATE TABLE IF NOT EXISTS alt_titles (
+        title TEXT,
+        file TEXT
+    );
+    CREATE INDEX IF NOT EXISTS alt_titles_file ON alt_titles(file);
+    CREATE TABLE IF NOT EXISTS dat_roms (
+        file TEXT,
+        console TEXT,
+        game TEXT,
+        rom TEXT,
+        size BIGINT,
+        crc32 TEXT,
+        md5 TEXT,
+        sha1 TEXT,
+        dat TEXT
+    );
+    CREATE INDEX IF NOT EXISTS dat_roms_file ON dat_roms(file)`
+
+// fileColumns are the files columns build-db owns. status and checked_at
+// belong to the bot's link checker and are kept as they are in PostgreSQL.
+var fileColumns = []string{"section", "console", "file", "rawurl", "search_blob", "added_at", "deleted_at",
+    "size", "region", "languages", "title", "ext", "source"}
+
+// runPostgres copies the catalog in dbfile to the PostgreSQL database at
+// dsn, in one transaction so the bot never sees half of it
+func runPostgres(dbfile, dsn string) error {
+    src, err := sql.Open("sqlite3", dbfile)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    if !tableExists(src, "files") {
+        return fmt.Errorf("%s has no files table, build it first", dbfile)
+    }
+    dst, err := sql.Open("postgres", dsn)
+    if err != nil {
+        return err
+    }
+    defer dst.Close()
+    if _, err := dst.Exec(postgresSchema); err != nil {
+        return err
+    }
+
+    tx, err := dst.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // files goes through a staging table, so rows that are still there
+    // keep their link status
+    if _, err := tx.Exec("CREATE TEMP TABLE files_import (LIKE files) ON COMMIT DROP"); err != nil {
+        return err
+    }
+    n, err := copyTable(src, tx, "files", "files_import", fileColumns)
+    if err != nil {
+        return err
+    }
+    var updates []string
+    for _, c := range fileColumns {
+        if c != "rawurl" {
+            updates = append(updates, c+" = excluded."+c)
+        }
+    }
+    columns := strings.Join(fileColumns, ", ")
+    if _, err := tx.Exec("INSERT INTO files (" + columns + ") SELECT " + columns + " FROM files_import ON CONFLICT (rawurl) DO UPDATE SET " + strings.Join(updates, ", ")); err != nil {
+        return err
+    }
+    if _, err := tx.Exec("DELETE FROM files WHERE NOT EXISTS (SELECT 1 FROM files_import WHERE files_import.rawurl = files.rawurl)"); err != nil {
+        return err
+    }
+    fmt.Printf("Copied %d files.\n", n)
+
+    // The other tables are replaced whole
+    for _, t := range []struct {
+        name    string
+        columns []string
+    }{
+        {"meta", []string{"key", "value"}},
+        {"alt_titles", []string{"title", "file"}},
+        {"dat_roms", []string{"file", "console", "game", "rom", "size", "crc32", "md5", "sha1", "dat"}},
+    } {
+        if _, err := tx.Exec("DELETE FROM " + t.name); err != nil {
+            return err
+        }
+        if !tableExists(src, t.name) {
+            continue
+        }
+        n, err := copyTable(src, tx, t.name, t.name, t.columns)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Copied %d rows of %s.\n", n, t.name)
+    }
+    return tx.Commit()
+}
+
+// copyTable streams columns of table in src into table to with COPY.
+// Values go over as text, which PostgreSQL parses into the column's type.
+func copyTable(src *sql.DB, tx *sql.Tx, table, to string, columns []string) (int, error) {
+    rows, err := src.Query("SELECT " + strings.Join(columns, ", ") + " FROM " + table)
+    if err != nil {
+        return 0, err
+    }
+    defer rows.Close()
+    stmt, err := tx.Prepare(pq.CopyIn(to, columns...))
+    if err != nil {
+        return 0, err
+    }
+    values := make([]sql.NullString, len(columns))
+    dest := make([]interface{}, len(columns))
+    for i := range values {
+        dest[i] = &values[i]
+    }
+    args := make([]interface{}, len(columns))
+    n := 0
+    for rows.Next() {
+        if err := rows.Scan(dest...); err != nil {
+            stmt.Close()
+            return 0, err
+        }
+        for i, v := range values {
+            args[i] = nil
+            if v.Valid {
+                args[i] = v.String
+            }
+        }
+        if _, err := stmt.Exec(args...); err != nil {
+            stmt.Close()
+            return 0, err
+        }
+        n++
+    }
+    if err := rows.Err(); err != nil {
+        stmt.Close()
+        return 0, err
+    }
+    // An Exec without arguments sends the buffered rows
+    if _, err := stmt.Exec(); err != nil {
+        stmt.Close()
+        return 0, err
+    }
+    return n, stmt.Close()
+}
+
+// runSizes opens dbfile and fills in the sizes it doesn't have yet
+func runSizes(dbfile string, delay time.Duration, workers int) error {
+    db, err := sql.Open("sqlite3", dbfile)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+    if !tableExists(db, "files") {
+        return fmt.Errorf("%s has no files table, build it first", dbfile)
+    }
+    // deleted_at may be missing from a database built before it existed,
+    // and fetchSizes skips the rows it marks
+    for _, column := range []string{"size", "deleted_at"} {
+        if _, err := addColumn(db, "files", column, "INTEGER"); err != nil {
+            return err
+        }
+    }
+    return fetchSizes(db, delay, workers)
+}
+
+// fetchSizes looks up the size of every listed file that has none yet with
+// a HEAD request, spaced delay apart across all workers (not at all when
+// delay isn't positive). Sizes are committed as they come in, so an
+// interrupted run carries on where it stopped, and files that failed are
+// tried again next time.
+func fetchSizes(db *sql.DB, delay time.Duration, workers int) error {
+    const commitEvery = 500
+
+    rows, err := db.Query("SELECT rawurl FROM files WHERE size IS NULL AND deleted_at IS NULL")
+    if err != nil {
+        return err
+    }
+    var urls []string
+    for rows.Next() {
+        var rawurl string
+        if err := rows.Scan(&rawurl); err != nil {
+            rows.Close()
+            return err
+        }
+        urls = append(urls, rawurl)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    if len(urls) == 0 {
+        fmt.Println("Every file already has a size.")
+        return nil
+    }
+    fmt.Printf("Fetching sizes for %d files...\n", len(urls))
+
+    if workers < 1 {
+        workers = 1
+    }
+    client := &http.Client{Timeout: time.Minute}
+    tick, stop := throttle(delay)
+    defer stop()
+
+    type sizeResult struct {
+        rawurl string
+        size   int64
+        err    error
+    }
+    todo := make(chan string)
+    results := make(chan sizeResult)
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for rawurl := range todo {
+                size, err := headSize(client, tick, rawurl)
+                results <- sizeResult{rawurl, size, err}
+            }
+        }()
+    }
+    go func() {
+        for _, rawurl := range urls {
+            todo <- rawurl
+        }
+        close(todo)
+        wg.Wait()
+        close(results)
+    }()
+
+    var tx *sql.Tx
+    var stmt *sql.Stmt
+    begin := func() error {
+        var err error
+        if tx, err = db.Begin(); err != nil {
+            return err
+        }
+        stmt, err = tx.Prepare("UPDATE files SET size = ? WHERE rawurl = ?")
+        return err
+    }
+    if err := begin(); err != nil {
+        return err
+    }
+    done, failed := 0, 0
+    for r := range results {
+        done++
+        if r.err != nil {
+            failed++
+            // Don't flood the output when the mirror is down
+            if failed <= 10 {
+                log.Printf("No size for %s: %v", r.rawurl, r.err)
+            }
+        } else if _, err := stmt.Exec(r.size, r.rawurl); err != nil {
+            return err
+        }
+        if done%commitEvery == 0 {
+            stmt.Close()
+            if err := tx.Commit(); err != nil {
+                return err
+            }
+            fmt.Printf("Fetched %d of %d sizes...\n", done, len(urls))
+            if err := begin(); err != nil {
+                return err
+            }
+        }
+    }
+    stmt.Close()
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    fmt.Printf("Done! Fetched %d sizes, %d failed (run again to retry them).\n", done-failed, failed)
+    return nil
+}
+
+// headSize returns the Content-Length of rawurl from a HEAD request, waiting
+// for a tick before each request and retrying a few times
+func headSize(client *http.Client, tick <-chan time.Time, rawurl string) (int64, error) {
+    var lastErr error
+    for attempt := 1; attempt <= 3; attempt++ {
+        <-tick
+        req, err := http.NewRequest(http.MethodHead, rawurl, nil)
+        if err != nil {
+            return 0, err
+        }
+        req.Header.Set("User-Agent", "roms-bot build-db crawler")
+        resp, err := client.Do(req)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            lastErr = fmt.Errorf("%s returned %s", rawurl, resp.Status)
+            continue
+        }
+        if resp.ContentLength < 0 {
+            return 0, fmt.Errorf("%s has no Content-Length", rawurl)
+        }
+        return resp.ContentLength, nil
+    }
+    return 0, lastErr
+}
+
+// importAltTitles replaces the alt_titles table with the mappings in path,
+// one "alternate title<TAB>file name" per line. A missing file is skipped.
+func importAltTitles(db *sql.DB, path string) error {
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DELETE FROM alt_titles"); err != nil {
+        return err
+    }
+    stmt, err := tx.Prepare("INSERT INTO alt_titles(title, file) VALUES (?, ?)")
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+
+    count := 0
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        title, file, ok := strings.Cut(line, "\t")
+        if !ok {
+            continue // skip lines without a tab
+        }
+        if _, err := stmt.Exec(strings.TrimSpace(title), strings.TrimSpace(file)); err != nil {
+            return err
+        }
+        count++
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    fmt.Printf("Imported %d alternate titles from %s.\n", count, path)
+    return nil
+}
+
 func main() {
+    force := flag.Bool("force", false, "import even if the link list hasn't changed since the last build, and rebuild the full-text index")
+    commitEvery := flag.Int("commit-every", 50000, "commit after this many rows so an interrupted import keeps its progress and the next run resumes after it")
+    rulesPath := flag.String("rules", "parse-rules.txt", "optional file of per-prefix URL layouts, one \"<prefix> <field>/<field>/... [source]\" per line")
+    configPath := flag.String("config", "config.yaml", "the bot's config, whose sources: list adds mirrors")
+    altTitles := flag.String("alt-titles", "alttitles.txt", "optional file of alternate titles, one \"title<TAB>file name\" per line")
+    extensions := flag.String("extensions", defaultExtensions, "comma-separated file types to crawl and import (an unchanged link list needs -force to pick up new ones)")
+    markRemoved := flag.Bool("mark-removed", true, "mark rows whose URL is no longer in the link list as removed")
+    flag.Parse()
+
     infile := "linklist.txt"
     dbfile := "links.db"
 
+    exts := parseExtensions(*extensions)
+    if len(exts) == 0 {
+        log.Fatalf("-extensions lists no file types")
+    }
+
+    // "crawl" rebuilds linklist.txt from the mirror first, then imports it
+    if flag.Arg(0) == "crawl" {
+        crawlFlags := flag.NewFlagSet("crawl", flag.ExitOnError)
+        root := crawlFlags.String("root", "https://myrient.erista.me/files/", "directory listing to start from")
+        delay := crawlFlags.Duration("delay", time.Second, "time between requests, across all workers")
+        workers := crawlFlags.Int("concurrency", 2, "listings fetched at the same time")
+        crawlFlags.Parse(flag.Args()[1:])
+        fmt.Printf("Crawling %s...\n", *root)
+        if err := crawl(*root, infile, *delay, *workers, exts); err != nil {
+            log.Fatalf("Crawl failed, keeping the old %s: %v", infile, err)
+        }
+    } else if flag.Arg(0) == "sizes" {
+        // "sizes" only fills in file sizes of an existing database
+        sizeFlags := flag.NewFlagSet("sizes", flag.ExitOnError)
+        delay := sizeFlags.Duration("delay", 100*time.Millisecond, "time between requests, across all workers")
+        workers := sizeFlags.Int("concurrency", 4, "HEAD requests running at the same time")
+        sizeFlags.Parse(flag.Args()[1:])
+        if err := runSizes(dbfile, *delay, *workers); err != nil {
+            log.Fatalf("Fetching sizes failed: %v", err)
+        }
+        return
+    } else if flag.Arg(0) == "dat" {
+        // "dat" adds checksums and canonical names from No-Intro/Redump DATs
+        if flag.NArg() < 2 {
+            log.Fatalf("Usage: build-db dat <file.dat>...")
+        }
+        if err := runDats(dbfile, flag.Args()[1:]); err != nil {
+            log.Fatalf("DAT import failed: %v", err)
+        }
+        return
+    } else if flag.Arg(0) == "pg" {
+        // "pg" copies links.db to PostgreSQL, for bots with db_driver: postgres
+        if flag.NArg() != 2 {
+            log.Fatalf("Usage: build-db pg <dsn>")
+        }
+        if err := runPostgres(dbfile, flag.Arg(1)); err != nil {
+            log.Fatalf("Copy to PostgreSQL failed: %v", err)
+        }
+        return
+    } else if flag.NArg() > 0 {
+        log.Fatalf("Unknown command %q, use crawl, sizes, dat or pg", flag.Arg(0))
+    }
+
+    rules, err := loadRules(*rulesPath, *configPath)
+    if err != nil {
+        log.Fatalf("Could not load parse rules: %v", err)
+    }
+
     file, err := os.Open(infile)
     if err != nil {
         log.Fatalf("Could not open %s: %v", infile, err)
     }
     defer file.Close()
 
+    inputHash, err := hashFile(file)
+    if err != nil {
+        log.Fatalf("Could not hash %s: %v", infile, err)
+    }
+
     db, err := sql.Open("sqlite3", dbfile)
     if err != nil {
         log.Fatalf("Could not open SQLite db: %v", err)
     }
     defer db.Close()
+    // The list of imported URLs is a TEMP table, which only exists on the
+    // connection that created it
+    db.SetMaxOpenConns(1)
 
     // Create table if not exists
     _, err = db.Exec(`
@@ -34,61 +1175,274 @@ func main() {
             section TEXT,
             console TEXT,
             file TEXT,
-            rawurl TEXT PRIMARY KEY
+            rawurl TEXT PRIMARY KEY,
+            search_blob TEXT,
+            added_at INTEGER,
+            deleted_at INTEGER,
+            size INTEGER,
+            region TEXT,
+            languages TEXT,
+            title TEXT,
+            ext TEXT,
+            source TEXT,
+            status TEXT,
+            checked_at INTEGER
         )
     `)
     if err != nil {
         log.Fatalf("Could not create table: %v", err)
     }
-
-    scanner := bufio.NewScanner(file)
-    tx, err := db.Begin()
+    // Databases built before search_blob existed get it added and filled
+    added, err := addColumn(db, "files", "search_blob", "TEXT")
     if err != nil {
-        log.Fatalf("Could not begin transaction: %v", err)
+        log.Fatalf("Could not add search_blob: %v", err)
+    }
+    if added {
+        fmt.Println("Filling search_blob for existing rows...")
+        if _, err := db.Exec("UPDATE files SET search_blob = " + searchBlobExpr("section", "console", "file")); err != nil {
+            log.Fatalf("Could not fill search_blob: %v", err)
+        }
     }
-    stmt, err := tx.Prepare("INSERT OR IGNORE INTO files(section, console, file, rawurl) VALUES (?, ?, ?, ?)")
+    // added_at stays NULL for rows imported before it existed; deleted_at
+    // is set when a URL drops out of the link list (see -mark-removed);
+    // size is filled in separately by "build-db sizes"; checked_at is set
+    // by the bot's link checker
+    for _, column := range []string{"added_at", "deleted_at", "size", "checked_at"} {
+        if _, err := addColumn(db, "files", column, "INTEGER"); err != nil {
+            log.Fatalf("Could not add %s: %v", column, err)
+        }
+    }
+    // region and languages come from the file name's tags, "" when it has
+    // none, and title is the name without them; NULL means the row
+    // predates the columns. ext is the lowercase extension, e.g. ".chd".
+    // status is "ok" or "dead" once the bot's link checker has been by.
+    // source is the label of the mirror the URL is on.
+    for _, column := range []string{"region", "languages", "title", "ext", "source", "status"} {
+        if _, err := addColumn(db, "files", column, "TEXT"); err != nil {
+            log.Fatalf("Could not add %s: %v", column, err)
+        }
+    }
+    if err := fillTags(db); err != nil {
+        log.Fatalf("Could not fill titles, regions, languages and extensions: %v", err)
+    }
+    if err := fillSources(db, rules); err != nil {
+        log.Fatalf("Could not fill sources: %v", err)
+    }
+    _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS meta (
+            key TEXT PRIMARY KEY,
+            value TEXT
+        )
+    `)
     if err != nil {
-        log.Fatalf("Could not prepare insert: %v", err)
+        log.Fatalf("Could not create meta table: %v", err)
     }
-    defer stmt.Close()
+    _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS alt_titles (
+            title TEXT,
+            file TEXT
+        );
+        CREATE INDEX IF NOT EXISTS alt_titles_file ON alt_titles(file)
+    `)
+    if err != nil {
+        log.Fatalf("Could not create alt_titles table: %v", err)
+    }
+
+    // Alternate titles are small, so they're reloaded on every run
+    if err := importAltTitles(db, *altTitles); err != nil {
+        log.Fatalf("Could not import %s: %v", *altTitles, err)
+    }
+
+    // Skip the whole import when the link list is byte-for-byte unchanged
+    var lastHash string
+    err = db.QueryRow("SELECT value FROM meta WHERE key = 'linklist_sha256'").Scan(&lastHash)
+    if err != nil && err != sql.ErrNoRows {
+        log.Fatalf("Could not read meta: %v", err)
+    }
+    if lastHash == inputHash && !*force {
+        // Databases from before the full-text index still get one, and
+        // one an interrupted import left half filled is rebuilt
+        if !ftsComplete(db) {
+            if err := buildFTS(db); err != nil {
+                log.Fatalf("Could not build the full-text index: %v", err)
+            }
+        }
+        fmt.Printf("%s is unchanged since the last build, nothing to do (use -force to import anyway).\n", infile)
+        return
+    }
+
+    // Rows committed by an earlier, interrupted run are skipped by INSERT OR IGNORE
+    var existing int
+    if err := db.QueryRow("SELECT COUNT(*) FROM files").Scan(&existing); err != nil {
+        log.Fatalf("Could not count existing rows: %v", err)
+    }
+    if existing > 0 {
+        fmt.Printf("%d rows already in %s, only new URLs are added.\n", existing, dbfile)
+    }
+    // Each commit records how far into the link list it got. A run that
+    // stopped part way through the same list picks up after that line;
+    // the lines before it are only noted as listed.
+    resumeAt := 0
+    var resumeHash string
+    err = db.QueryRow("SELECT value FROM meta WHERE key = 'import_sha256'").Scan(&resumeHash)
+    if err != nil && err != sql.ErrNoRows {
+        log.Fatalf("Could not read meta: %v", err)
+    }
+    if resumeHash == inputHash {
+        var value string
+        if err := db.QueryRow("SELECT value FROM meta WHERE key = 'import_line'").Scan(&value); err == nil {
+            resumeAt, _ = strconv.Atoi(value)
+        }
+    }
+    if resumeAt > 0 {
+        fmt.Printf("Resuming the interrupted import of %s after line %d.\n", infile, resumeAt)
+    }
+    if _, err := db.Exec("CREATE TEMP TABLE listed (rawurl TEXT PRIMARY KEY)"); err != nil {
+        log.Fatalf("Could not create temp table: %v", err)
+    }
+    now := time.Now().Unix()
+
+    // Only inserted rows go into a complete full-text index, in the same
+    // transaction as the rows themselves. Removed rows stay in files with
+    // deleted_at set, so they keep their entries. A new or incomplete
+    // index, or any index with -force, is filled in one go after the import.
+    fts, err := createFTS(db)
+    if err != nil {
+        log.Fatalf("Could not create the full-text index: %v", err)
+    }
+    indexRows := fts && ftsComplete(db) && !*force
+
+    // Commit every commitEvery rows so progress survives an interruption
+    var tx *sql.Tx
+    var stmt, listStmt, ftsStmt *sql.Stmt
+    begin := func() {
+        tx, err = db.Begin()
+        if err != nil {
+            log.Fatalf("Could not begin transaction: %v", err)
+        }
+        stmt, err = tx.Prepare("INSERT OR IGNORE INTO files(section, console, file, rawurl, search_blob, added_at, region, languages, title, source, ext) VALUES (?, ?, ?, ?, " + searchBlobExpr("?", "?", "?") + ", ?, ?, ?, ?, ?, ?)")
+        if err != nil {
+            log.Fatalf("Could not prepare insert: %v", err)
+        }
+        listStmt, err = tx.Prepare("INSERT OR IGNORE INTO listed(rawurl) VALUES (?)")
+        if err != nil {
+            log.Fatalf("Could not prepare insert: %v", err)
+        }
+        if indexRows {
+            ftsStmt, err = tx.Prepare("INSERT INTO files_fts(rowid, section, console, file) VALUES (?, ?, ?, ?)")
+            if err != nil {
+                log.Fatalf("Could not prepare insert: %v", err)
+            }
+        }
+    }
+    commit := func() {
+        stmt.Close()
+        listStmt.Close()
+        if ftsStmt != nil {
+            ftsStmt.Close()
+        }
+        if err := tx.Commit(); err != nil {
+            log.Fatalf("Could not commit transaction: %v", err)
+        }
+    }
+
+    scanner := bufio.NewScanner(file)
+    begin()
 
-    const prefix = "https://myrient.erista.me/files/"
+    lineNo := 0
     count := 0
+    var counts importCounts
     for scanner.Scan() {
         rawurl := scanner.Text()
-        if !strings.HasPrefix(rawurl, prefix) {
-            continue // skip lines not matching the expected format
+        lineNo++
+        if lineNo <= resumeAt {
+            if _, err := listStmt.Exec(rawurl); err != nil {
+                log.Fatalf("Could not record %s: %v", rawurl, err)
+            }
+            continue
         }
-        if !strings.HasSuffix(rawurl, ".zip") {
-            continue // skip non-zip files
+        ext, ok := extensionOf(rawurl, exts)
+        if !ok {
+            continue // skip other file types
         }
-        rel := strings.TrimPrefix(rawurl, prefix)
-        parts := strings.SplitN(rel, "/", 3)
-        if len(parts) != 3 {
-            continue // skip malformed lines
+        // The first rule whose prefix matches decides the layout
+        var section, console, filepart, source string
+        matched := false
+        for _, rule := range rules {
+            if strings.HasPrefix(rawurl, rule.prefix) {
+                section, console, filepart, matched = rule.parse(rawurl)
+                source = rule.source
+                break
+            }
         }
-        section, err1 := url.QueryUnescape(parts[0])
-        console, err2 := url.QueryUnescape(parts[1])
-        filepart, err3 := url.QueryUnescape(parts[2])
-        if err1 != nil || err2 != nil || err3 != nil {
-            continue // skip lines with bad encoding
+        if !matched {
+            continue // skip lines not matching the expected format
         }
-        _, err = stmt.Exec(section, console, filepart, rawurl)
+        region, languages := tagsOf(filepart)
+        rowid, err := counts.record(listStmt, stmt, rawurl, section, console, filepart, rawurl, section, console, filepart, now, region, languages, romname.NormalizeTitle(filepart), source, ext)
         if err != nil {
-            log.Printf("Failed to insert: %v", err)
+            log.Fatalf("Could not import %s: %v", rawurl, err)
+        }
+        if rowid != 0 && indexRows {
+            if _, err := ftsStmt.Exec(rowid, section, console, filepart); err != nil {
+                log.Fatalf("Could not index %s: %v", rawurl, err)
+            }
         }
         count++
         if count%10000 == 0 {
-            fmt.Printf("Inserted %d rows...\n", count)
+            fmt.Printf("Processed %d rows...\n", count)
+        }
+        if *commitEvery > 0 && count%*commitEvery == 0 {
+            for key, value := range map[string]string{
+                "import_sha256": inputHash,
+                "import_line":   strconv.Itoa(lineNo),
+            } {
+                if _, err := tx.Exec("INSERT OR REPLACE INTO meta(key, value) VALUES (?, ?)", key, value); err != nil {
+                    log.Fatalf("Could not update meta: %v", err)
+                }
+            }
+            commit()
+            fmt.Printf("Committed %d rows.\n", count)
+            begin()
         }
     }
     if err := scanner.Err(); err != nil {
         log.Fatalf("Scanner error: %v", err)
     }
-    err = tx.Commit()
-    if err != nil {
-        log.Fatalf("Could not commit transaction: %v", err)
+    for key, value := range map[string]string{
+        "linklist_sha256": inputHash,
+        "built_at":        time.Now().UTC().Format(time.RFC3339),
+    } {
+        if _, err := tx.Exec("INSERT OR REPLACE INTO meta(key, value) VALUES (?, ?)", key, value); err != nil {
+            log.Fatalf("Could not update meta: %v", err)
+        }
+    }
+    if _, err := tx.Exec("DELETE FROM meta WHERE key IN ('import_sha256', 'import_line')"); err != nil {
+        log.Fatalf("Could not update meta: %v", err)
+    }
+    commit()
+
+    // URLs that left the list are only marked, so the bot can stop showing
+    // them while they stay around; ones that come back are restored
+    if *markRemoved {
+        res, err := db.Exec("UPDATE files SET deleted_at = ? WHERE deleted_at IS NULL AND rawurl NOT IN (SELECT rawurl FROM listed)", now)
+        if err != nil {
+            log.Fatalf("Could not mark removed rows: %v", err)
+        }
+        removed, _ := res.RowsAffected()
+        res, err = db.Exec("UPDATE files SET deleted_at = NULL WHERE deleted_at IS NOT NULL AND rawurl IN (SELECT rawurl FROM listed)")
+        if err != nil {
+            log.Fatalf("Could not restore rows: %v", err)
+        }
+        restored, _ := res.RowsAffected()
+        fmt.Printf("Marked %d rows as removed, restored %d.\n", removed, restored)
+    }
+    if fts && !indexRows {
+        if err := buildFTS(db); err != nil {
+            log.Fatalf("Could not build the full-text index: %v", err)
+        }
     }
-    fmt.Printf("Done! Inserted %d rows.\n", count)
+    fmt.Printf("Done! Inserted %d rows, %d were already in %s, skipped %d URLs listed more than once (of %d processed).\n",
+        counts.inserted, counts.existing, dbfile, counts.repeated, count)
 }
 
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "database/sql"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// Run with its program: go test build-db.go build-db_test.go
+
+func TestParseRuleDefault(t *testing.T) {
+    rule := defaultRules[0]
+    tests := []struct {
+        rawurl                 string
+        section, console, file string
+        ok                     bool
+    }{
+        {"https://myrient.erista.me/files/No-Intro/Nintendo%20-%20Game%20Boy/Tetris%20%28World%29%20%28Rev%201%29.zip",
+            "No-Intro", "Nintendo - Game Boy", "Tetris (World) (Rev 1).zip", true},
+        // The file takes the rest of the path, slashes and all
+        {"https://myrient.erista.me/files/Redump/Sony%20-%20PlayStation/Extras/Game%20(USA).chd",
+            "Redump", "Sony - PlayStation", "Extras/Game (USA).chd", true},
+        {"https://myrient.erista.me/files/No-Intro/Nintendo%20-%20Game%20Boy/", "", "", "", false},
+        {"https://myrient.erista.me/files/No-Intro/Tetris.zip", "", "", "", false},
+        {"https://myrient.erista.me/files/No-Intro/Game%20Boy/Bad%zzEncoding.zip", "", "", "", false},
+        {"https://example.org/files/No-Intro/Game%20Boy/Tetris.zip", "", "", "", false},
+    }
+    for _, tt := range tests {
+        section, console, file, ok := rule.parse(tt.rawurl)
+        if section != tt.section || console != tt.console || file != tt.file || ok != tt.ok {
+            t.Errorf("parse(%q) = %q, %q, %q, %v; want %q, %q, %q, %v",
+                tt.rawurl, section, console, file, ok, tt.section, tt.console, tt.file, tt.ok)
+        }
+    }
+}
+
+func TestParseRuleLayouts(t *testing.T) {
+    tests := []struct {
+        layout                 string
+        rawurl                 string
+        section, console, file string
+    }{
+        // - skips a segment
+        {"section/-/console/file", "https://example.org/roms/Redump/2024/Sega%20Saturn/Game%20(Japan).chd",
+            "Redump", "Sega Saturn", "Game (Japan).chd"},
+        {"-/console/file", "https://example.org/roms/misc/SNES/Game.sfc",
+            "", "SNES", "Game.sfc"},
+        // A field named twice joins its segments
+        {"console/console/file", "https://example.org/roms/Nintendo/Game%20Boy/Game.gb",
+            "", "Nintendo - Game Boy", "Game.gb"},
+        {"file", "https://example.org/roms/Game%20(USA).zip",
+            "", "", "Game (USA).zip"},
+    }
+    for _, tt := range tests {
+        rule, err := newParseRule("https://example.org/roms/", tt.layout, "")
+        if err != nil {
+            t.Errorf("newParseRule(%q): %v", tt.layout, err)
+            continue
+        }
+        if rule.source != "example.org" {
+            t.Errorf("newParseRule(%q) source = %q, want the host name", tt.layout, rule.source)
+        }
+        section, console, file, ok := rule.parse(tt.rawurl)
+        if !ok || section != tt.section || console != tt.console || file != tt.file {
+            t.Errorf("%s: parse(%q) = %q, %q, %q, %v; want %q, %q, %q",
+                tt.layout, tt.rawurl, section, console, file, ok, tt.section, tt.console, tt.file)
+        }
+    }
+
+    rule, err := newParseRule("https://example.org/roms/", "section/console/file", "mirror")
+    if err != nil || rule.source != "mirror" {
+        t.Errorf("newParseRule with a source = %+v, %v; want source mirror", rule, err)
+    }
+}
+
+func TestNewParseRuleMalformed(t *testing.T) {
+    for _, tt := range []struct{ prefix, layout string }{
+        {"https://example.org/", "section/console"},
+        {"https://example.org/", "section/platform/file"},
+        {"https://example.org/", "section//file"},
+        {"not a url", "section/console/file"},
+    } {
+        if _, err := newParseRule(tt.prefix, tt.layout, ""); err == nil {
+            t.Errorf("newParseRule(%q, %q): want an error", tt.prefix, tt.layout)
+        }
+    }
+}
+
+func TestLoadRules(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "parse-rules.txt")
+    write := func(text string) {
+        if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    write("# comment\n\nhttps://example.org/ section/file\nhttps://example.org/roms/ -/console/file roms\n")
+    rules, err := loadRules(path, filepath.Join(dir, "missing.yaml"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(rules) != 3 || rules[0].prefix != "https://example.org/roms/" || rules[0].source != "roms" || rules[2].prefix != defaultRules[0].prefix {
+        t.Errorf("loadRules = %+v; want the longer prefix first and the default last", rules)
+    }
+
+    for _, text := range []string{
+        "https://example.org/\n",
+        "https://example.org/ section/file source extra\n",
+        "https://example.org/ section/size/file\n",
+    } {
+        write(text)
+        if _, err := loadRules(path, filepath.Join(dir, "missing.yaml")); err == nil {
+            t.Errorf("loadRules(%q): want an error", text)
+        }
+    }
+}
+
+func TestImportCounts(t *testing.T) {
+    db, err := sql.Open("sqlite3", ":memory:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    db.SetMaxOpenConns(1) // every connection would get its own :memory: database
+    for _, stmt := range []string{
+        "CREATE TABLE files (file TEXT, rawurl TEXT PRIMARY KEY)",
+        "CREATE TEMP TABLE listed (rawurl TEXT PRIMARY KEY)",
+        "INSERT INTO files VALUES ('old.zip', 'https://example.org/old.zip')",
+    } {
+        if _, err := db.Exec(stmt); err != nil {
+            t.Fatal(err)
+        }
+    }
+    listStmt, err := db.Prepare("INSERT OR IGNORE INTO listed(rawurl) VALUES (?)")
+    if err != nil {
+        t.Fatal(err)
+    }
+    insertStmt, err := db.Prepare("INSERT OR IGNORE INTO files(file, rawurl) VALUES (?, ?)")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var counts importCounts
+    for _, line := range []struct {
+        file     string
+        inserted bool
+    }{
+        {"a.zip", true},
+        {"b.zip", true},
+        {"a.zip", false},   // repeated in the list
+        {"old.zip", false}, // from an earlier build
+        {"c.zip", true},
+        {"a.zip", false},
+        {"old.zip", false},
+    } {
+        rawurl := "https://example.org/" + line.file
+        rowid, err := counts.record(listStmt, insertStmt, rawurl, line.file, rawurl)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if (rowid != 0) != line.inserted {
+            t.Errorf("record(%s) = rowid %d, want inserted %v", line.file, rowid, line.inserted)
+        }
+    }
+    if want := (importCounts{inserted: 3, existing: 1, repeated: 3}); counts != want {
+        t.Errorf("counts = %+v, want %+v", counts, want)
+    }
+    var rows int
+    if err := db.QueryRow("SELECT COUNT(*) FROM files").Scan(&rows); err != nil || rows != 4 {
+        t.Errorf("files has %d rows (%v), want 4", rows, err)
+    }
+}
@@ -4,6 +4,7 @@ go 1.23.2
 
 require (
 	github.com/blevesearch/bleve v1.0.14
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.28
 	gopkg.in/yaml.v3 v3.0.1
 	maunium.net/go/mautrix v0.24.0
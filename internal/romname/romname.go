@@ -0,0 +1,45 @@
+// Package romname reads No-Intro/Redump style file names such as
+// "Game (USA, Europe) (En,Fr) (Rev 1).zip". The bot and build-db both use
+// it, so the title and region columns build-db stores match what the bot
+// works out from a name itself.
+package romname
+
+import (
+    "regexp"
+    "strings"
+)
+
+// KnownRegions are the region names used in No-Intro/Redump style tags
+var KnownRegions = map[string]bool{
+    "USA": true, "Europe": true, "Japan": true, "World": true, "Asia": true,
+    "Australia": true, "Brazil": true, "Canada": true, "China": true,
+    "France": true, "Germany": true, "Hong Kong": true, "Italy": true,
+    "Korea": true, "Netherlands": true, "Russia": true, "Scandinavia": true,
+    "Spain": true, "Sweden": true, "Taiwan": true, "UK": true,
+}
+
+// ParenPattern matches a (...) tag, with its contents as the submatch
+var ParenPattern = regexp.MustCompile(`\(([^)]*)\)`)
+
+// LanguagePattern matches one entry of a language tag like (En,Fr,De) or
+// (Zh-Hant)
+var LanguagePattern = regexp.MustCompile(`^[A-Z][a-z](-[A-Z][A-Za-z]+)?$`)
+
+// TagPattern matches a (Region) or [tag] group with the space before it
+var TagPattern = regexp.MustCompile(`\s*[(\[][^)\]]*[)\]]`)
+
+// BaseTitle strips the extension and any (Region)/[tag] groups from a file
+// name
+func BaseTitle(file string) string {
+    if dot := strings.LastIndex(file, "."); dot > 0 {
+        file = file[:dot]
+    }
+    return strings.TrimSpace(TagPattern.ReplaceAllString(file, ""))
+}
+
+// NormalizeTitle is a file's title for grouping variants: BaseTitle
+// lowercased with its spaces collapsed. build-db stores it in the title
+// column and the bot's 1g1r:on groups by it.
+func NormalizeTitle(file string) string {
+    return strings.ToLower(strings.Join(strings.Fields(BaseTitle(file)), " "))
+}
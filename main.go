@@ -1,21 +1,41 @@
 package main
 
 import (
+    "compress/gzip"
     "context"
     "database/sql"
+    "encoding/csv"
     "encoding/json"
+    "errors"
     "fmt"
+    "html/template"
+    "io"
     "io/ioutil"
-    "log"
+    "log/slog"
+    "mime"
+    "net/http"
+    "net/url"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path"
+    "reflect"
+    "regexp"
     "sort"
+    "strconv"
     "strings"
+    "sync"
+    "syscall"
     "time"
 
     "gopkg.in/yaml.v3"
     "maunium.net/go/mautrix"
     "maunium.net/go/mautrix/event"
     "maunium.net/go/mautrix/id"
+    _ "github.com/lib/pq"
     _ "github.com/mattn/go-sqlite3"
+
+    "roms-bot/internal/romname"
 )
 
 type MatrixConfig struct {
@@ -23,12 +43,428 @@ type MatrixConfig struct {
     Username string `yaml:"username"`
     Password string `yaml:"password"`
     Room     string `yaml:"room"`
+    Proxy    string `yaml:"proxy"`
+}
+
+type BotConfig struct {
+    Admins             []string      `yaml:"admins"`
+    UpstreamCheck      bool          `yaml:"upstream_check"`
+    PresenceStatus     bool          `yaml:"presence_status"`
+    AlertRoom          string        `yaml:"alert_room"`
+    AlertInterval      time.Duration `yaml:"alert_interval"`
+    AllowDMs           bool          `yaml:"allow_dms"`
+    Quiet              bool          `yaml:"quiet"`
+    MaxResults         int           `yaml:"max_results"`
+    ResultCap          int           `yaml:"result_cap"`
+    BIOSPatterns       []string      `yaml:"bios_patterns"`
+    DailyQuota         int           `yaml:"daily_quota"`
+    ThreadThreshold    int           `yaml:"thread_threshold"`
+    Language           string        `yaml:"language"`
+    AdminPowerLevel    int           `yaml:"admin_power_level"`
+    SendRate           float64       `yaml:"send_rate"`
+    SendBurst          int           `yaml:"send_burst"`
+    RoomCooldown       time.Duration `yaml:"room_cooldown"`
+    RegionPriority     []string      `yaml:"region_priority"`
+    ResultStats        bool          `yaml:"result_stats"`
+    BuildCommand       string        `yaml:"build_command"`
+    DBMaxOpenConns     int           `yaml:"db_max_open_conns"`
+    DBMaxIdleConns     int           `yaml:"db_max_idle_conns"`
+    HideExtensions     []string      `yaml:"hide_extensions"`
+    InitialSyncTimeout time.Duration `yaml:"initial_sync_timeout"`
+    MoreAfter          int           `yaml:"more_after"`
+    UserBurst          int           `yaml:"user_burst"`
+    UserRefill         time.Duration `yaml:"user_refill"`
+    ShutdownTimeout    time.Duration `yaml:"shutdown_timeout"`
+    GetMaxSize         int64         `yaml:"get_max_size"`
+    CommandPrefix      string        `yaml:"command_prefix"`
+    MentionCommands    bool          `yaml:"mention_commands"`
+    LinkCheckInterval  time.Duration `yaml:"link_check_interval"`
+    LinkCheckBatch     int           `yaml:"link_check_batch"`
+    LinkCheckWorkers   int           `yaml:"link_check_workers"`
+    LogLevel           string        `yaml:"log_level"`
+    LogFormat          string        `yaml:"log_format"`
+    DBDriver           string        `yaml:"db_driver"`
+    DBDSN              string        `yaml:"db_dsn"`
+    QueryTimeout       time.Duration `yaml:"query_timeout"`
+    Workers            int           `yaml:"workers"`
+}
+
+type APIConfig struct {
+    Listen string `yaml:"listen"`
+    // Web serves a search and browse page at / next to the JSON API
+    Web bool `yaml:"web"`
+}
+
+type MetricsConfig struct {
+    Listen string `yaml:"listen"`
+}
+
+// RoomConfig holds per-room settings, keyed by room ID in Config.Rooms
+type RoomConfig struct {
+    // Section and Console are implicit scoped terms for every search in the
+    // room. Users can replace them with their own section:/console:/@
+    // unless Locked is set.
+    Section string `yaml:"section"`
+    Console string `yaml:"console"`
+    Locked  bool   `yaml:"locked"`
+    // Language overrides bot.language for replies in this room
+    Language string `yaml:"language"`
+    // OutputRoom gets the result listings for searches made here, under a
+    // link back to the search. The bot has to be joined to it.
+    OutputRoom string `yaml:"output_room"`
+    // CommandPrefix replaces bot.command_prefix here, e.g. "~" where
+    // another bot already answers to "!"
+    CommandPrefix string `yaml:"command_prefix"`
+}
+
+// SourceConfig is a mirror build-db imports links from, besides myrient.
+// The bot only uses Label; build-db reads the rest from the same file.
+type SourceConfig struct {
+    // Label is stored with each row and matched by source:, e.g.
+    // "archive.org". Defaults to the prefix's host name.
+    Label string `yaml:"label"`
+    // Prefix is the start of the mirror's URLs, and Layout how the rest of
+    // the path maps to section/console/file ("-" skips a part)
+    Prefix string `yaml:"prefix"`
+    Layout string `yaml:"layout"`
+}
+
+// PasteConfig points at a pastebin-style service for big result lists
+type PasteConfig struct {
+    // URL receives the listing as a text/plain POST and must answer with the
+    // paste's URL as the response body. Pasting is off when empty.
+    URL   string `yaml:"url"`
+    Token string `yaml:"token"` // sent as a Bearer token when set
+    // MinResults is the smallest result count that is pasted instead of
+    // posted, 0 for anything that doesn't fit in one message
+    MinResults int `yaml:"min_results"`
 }
 
 type Config struct {
-    Matrix MatrixConfig `yaml:"matrix"`
+    Matrix  MatrixConfig          `yaml:"matrix"`
+    Bot     BotConfig             `yaml:"bot"`
+    API     APIConfig             `yaml:"api"`
+    Metrics MetricsConfig         `yaml:"metrics"`
+    Paste   PasteConfig           `yaml:"paste"`
+    Sources []SourceConfig        `yaml:"sources"`
+    Rooms   map[string]RoomConfig `yaml:"rooms"`
+}
+
+// live is the SQL condition for rows still on the mirror. build-db marks
+// the ones that left the link list instead of deleting them.
+func (b *Bot) live() string {
+    if b.softDelete {
+        return "deleted_at IS NULL"
+    }
+    return "1 = 1"
+}
+
+// servesRoom reports whether commands from roomID should be handled: the
+// main room, rooms with their own settings, and DMs when allowed
+func (b *Bot) servesRoom(ctx context.Context, roomID id.RoomID) bool {
+    cfg := b.config()
+    if cfg.listsRoom(roomID) {
+        return true
+    }
+    return cfg.Bot.AllowDMs && b.isDM(ctx, roomID)
+}
+
+// listsRoom reports whether roomID is matrix.room or one of rooms
+func (c *Config) listsRoom(roomID id.RoomID) bool {
+    if roomID.String() == c.Matrix.Room {
+        return true
+    }
+    _, ok := c.Rooms[roomID.String()]
+    return ok
+}
+
+// room returns the settings for roomID, or the zero RoomConfig
+func (c *Config) room(roomID id.RoomID) RoomConfig {
+    return c.Rooms[roomID.String()]
+}
+
+// prefix returns the command prefix for roomID, "!" unless configured
+func (c *Config) prefix(roomID id.RoomID) string {
+    if p := c.room(roomID).CommandPrefix; p != "" {
+        return p
+    }
+    if c.Bot.CommandPrefix != "" {
+        return c.Bot.CommandPrefix
+    }
+    return "!"
+}
+
+// language returns the reply language for roomID
+func (c *Config) language(roomID id.RoomID) string {
+    if lang := c.room(roomID).Language; lang != "" {
+        return lang
+    }
+    return c.Bot.Language
+}
+
+type Bot struct {
+    client      *mautrix.Client
+    db          Store
+    cfgMu       sync.RWMutex
+    cfg         *Config // swapped on SIGHUP, read through config()
+    upstream    *upstreamCache
+    jobs        *jobRegistry
+    alerts      *alerter
+    dms         *dmCache
+    rejected    *rejectedQueries
+    pages       *pager
+    powerLevels *powerLevelCache
+    sendLimit   *sendLimiter
+    cooldown    *roomCooldown
+    userLimit   *userLimiter
+    http        *http.Client // for outgoing requests other than Matrix
+    altTitles   bool         // links.db has alternate titles, checked at startup
+    searchBlob  bool         // links.db has a filled search_blob column, checked at startup
+    fts         bool         // links.db has a usable full-text index, checked at startup
+    softDelete  bool         // links.db marks removed rows with deleted_at, checked at startup
+    sizes       bool         // links.db has a size column, checked at startup
+    regions     bool         // links.db has region and languages columns, checked at startup
+    titles      bool         // links.db has a normalized title column, checked at startup
+    linkStatus  bool         // links.db has the link checker's status column, checked at startup
+    dats        bool         // links.db has checksums from "build-db dat", checked at startup
+    sources     bool         // links.db has a source column, checked at startup
+    exts        bool         // links.db has an ext column, checked at startup
+    more        *moreCursors
+    listed      *listings
+    batches     *batchIndex
+    pool        *workerPool
+    work        context.Context // handlers run under it, cancelled if shutdown gives up on them
+    running     sync.WaitGroup  // handlers still running, for shutdown
+}
+
+func (b *Bot) config() *Config {
+    b.cfgMu.RLock()
+    defer b.cfgMu.RUnlock()
+    return b.cfg
+}
+
+// reloadConfig re-reads path and applies the settings that can change at
+// runtime. Matrix, API and metrics settings only take effect after a restart.
+func (b *Bot) reloadConfig(path string) error {
+    next, err := loadConfig(path)
+    if err != nil {
+        return err
+    }
+    cur := b.config()
+    if !reflect.DeepEqual(next.Matrix, cur.Matrix) {
+        slog.Warn("Config reload: matrix settings changed, restart to apply them")
+        next.Matrix = cur.Matrix
+    }
+    if !reflect.DeepEqual(next.API, cur.API) {
+        slog.Warn("Config reload: api settings changed, restart to apply them")
+        next.API = cur.API
+    }
+    if !reflect.DeepEqual(next.Metrics, cur.Metrics) {
+        slog.Warn("Config reload: metrics settings changed, restart to apply them")
+        next.Metrics = cur.Metrics
+    }
+
+    curBot := reflect.ValueOf(cur.Bot)
+    nextBot := reflect.ValueOf(next.Bot)
+    changed := []string{}
+    for i := 0; i < curBot.NumField(); i++ {
+        if !reflect.DeepEqual(curBot.Field(i).Interface(), nextBot.Field(i).Interface()) {
+            changed = append(changed, curBot.Type().Field(i).Tag.Get("yaml"))
+        }
+    }
+    if !reflect.DeepEqual(cur.Paste, next.Paste) {
+        changed = append(changed, "paste")
+    }
+    if !reflect.DeepEqual(cur.Rooms, next.Rooms) {
+        changed = append(changed, "rooms")
+    }
+    if len(changed) == 0 {
+        slog.Info("Config reload: no bot settings changed")
+    } else {
+        slog.Info("Config reload: settings changed", "changed", strings.Join(changed, ", "))
+    }
+
+    if next.Bot.LogFormat != cur.Bot.LogFormat {
+        slog.Warn("Config reload: log_format changed, restart to apply it")
+    }
+    if next.Bot.LogLevel != cur.Bot.LogLevel {
+        if level, err := parseLogLevel(next.Bot.LogLevel); err != nil {
+            slog.Warn("Config reload: keeping the old log_level", "err", err)
+        } else {
+            logLevel.Set(level)
+        }
+    }
+    if next.Bot.SendRate != cur.Bot.SendRate || next.Bot.SendBurst != cur.Bot.SendBurst {
+        b.sendLimit.setLimits(next.Bot.SendRate, next.Bot.SendBurst)
+    }
+    if next.Bot.Workers != cur.Bot.Workers {
+        slog.Warn("Config reload: workers changed, restart to apply it")
+    }
+    if next.Bot.DBDriver != cur.Bot.DBDriver || next.Bot.DBDSN != cur.Bot.DBDSN {
+        slog.Warn("Config reload: db_driver or db_dsn changed, restart to apply it")
+    }
+    if next.Bot.DBMaxOpenConns != cur.Bot.DBMaxOpenConns || next.Bot.DBMaxIdleConns != cur.Bot.DBMaxIdleConns {
+        maxOpen, maxIdle := next.Bot.dbPool()
+        b.db.SetMaxOpenConns(maxOpen)
+        b.db.SetMaxIdleConns(maxIdle)
+    }
+
+    b.cfgMu.Lock()
+    b.cfg = next
+    b.cfgMu.Unlock()
+    return nil
+}
+
+// defaultBIOSPatterns match the usual BIOS and system file names
+var defaultBIOSPatterns = []string{"[BIOS]", "(BIOS)", " BIOS (", "bios.", "System Card", "Firmware"}
+
+func (c *BotConfig) biosPatterns() []string {
+    if len(c.BIOSPatterns) > 0 {
+        return c.BIOSPatterns
+    }
+    return defaultBIOSPatterns
 }
 
+// defaultRegionPriority is the sort:region-priority order when none is set
+var defaultRegionPriority = []string{"USA", "World", "Europe", "Japan"}
+
+func (c *BotConfig) regionPriority() []string {
+    if len(c.RegionPriority) > 0 {
+        return c.RegionPriority
+    }
+    return defaultRegionPriority
+}
+
+// initialSyncTimeout is how long the first /sync may take before the bot
+// gives up
+func (c *BotConfig) initialSyncTimeout() time.Duration {
+    if c.InitialSyncTimeout > 0 {
+        return c.InitialSyncTimeout
+    }
+    return 5 * time.Minute
+}
+
+// getMaxSize is the largest file !get will upload, in bytes
+func (c *BotConfig) getMaxSize() int64 {
+    if c.GetMaxSize <= 0 {
+        return 20 << 20
+    }
+    return c.GetMaxSize
+}
+
+// linkCheckBatch is how many links the link checker HEADs per round
+func (c *BotConfig) linkCheckBatch() int {
+    if c.LinkCheckBatch <= 0 {
+        return 200
+    }
+    return c.LinkCheckBatch
+}
+
+// linkCheckWorkers is how many link checks run at once
+func (c *BotConfig) linkCheckWorkers() int {
+    if c.LinkCheckWorkers <= 0 {
+        return 4
+    }
+    return c.LinkCheckWorkers
+}
+
+// dbDriver is "sqlite3" for links.db, the default, or "postgres" for the
+// database at db_dsn
+func (c *BotConfig) dbDriver() string {
+    switch driver := strings.ToLower(c.DBDriver); driver {
+    case "", "sqlite", "sqlite3":
+        return "sqlite3"
+    case "postgresql":
+        return "postgres"
+    default:
+        return driver
+    }
+}
+
+// queryTimeout bounds each search query, so a pathological one can't hold
+// up the handler
+func (c *BotConfig) queryTimeout() time.Duration {
+    if c.QueryTimeout > 0 {
+        return c.QueryTimeout
+    }
+    return 30 * time.Second
+}
+
+// workers is how many commands run at once
+func (c *BotConfig) workers() int {
+    if c.Workers <= 0 {
+        return 8
+    }
+    return c.Workers
+}
+
+// moreAfter is how many rows of a listing are posted before the rest waits
+// for !more, 200 unless set. A negative more_after gives 0, listings are
+// then posted whole.
+func (c *BotConfig) moreAfter() int {
+    if c.MoreAfter < 0 {
+        return 0
+    }
+    if c.MoreAfter == 0 {
+        return 200
+    }
+    return c.MoreAfter
+}
+
+// shutdownTimeout is how long running commands get to finish on shutdown
+func (c *BotConfig) shutdownTimeout() time.Duration {
+    if c.ShutdownTimeout > 0 {
+        return c.ShutdownTimeout
+    }
+    return 30 * time.Second
+}
+
+// maxResults is the flood threshold: larger result sets are rejected
+func (c *BotConfig) maxResults() int {
+    if c.MaxResults > 0 {
+        return c.MaxResults
+    }
+    return 1000
+}
+
+// dbPool returns the links.db connection limits. Searches are read-only and
+// run in parallel fine; the few writes (quota, seen, history) wait on
+// SQLite's lock either way, so a small pool is enough.
+func (c *BotConfig) dbPool() (maxOpen, maxIdle int) {
+    maxOpen = c.DBMaxOpenConns
+    if maxOpen <= 0 {
+        maxOpen = 4
+    }
+    maxIdle = c.DBMaxIdleConns
+    if maxIdle <= 0 || maxIdle > maxOpen {
+        maxIdle = maxOpen
+    }
+    return maxOpen, maxIdle
+}
+
+func (b *Bot) isAdmin(ctx context.Context, roomID id.RoomID, userID id.UserID) bool {
+    cfg := b.config()
+    for _, admin := range cfg.Bot.Admins {
+        if strings.TrimSpace(admin) == userID.String() {
+            return true
+        }
+    }
+    // Optionally also anyone with a high enough power level in the room, if
+    // it's one of the configured rooms: in a DM, or any room the bot gets
+    // invited to, its creator has the top power level
+    if cfg.Bot.AdminPowerLevel > 0 && cfg.listsRoom(roomID) && !b.isDM(ctx, roomID) {
+        if pl := b.powerLevels.get(ctx, b.client, roomID); pl != nil {
+            return pl.GetUserLevel(userID) >= cfg.Bot.AdminPowerLevel
+        }
+    }
+    return false
+}
+
+const (
+    configPath = "config.yaml"
+    dbPath     = "./links.db"
+)
+
 type TokenStore struct {
     AccessToken string `json:"access_token"`
     UserID      string `json:"user_id"`
@@ -67,75 +503,324 @@ func saveToken(path string, ts *TokenStore) error {
     return ioutil.WriteFile(path, data, 0600)
 }
 
+// logLevel is the minimum level logged, changed on config reloads
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes the default logger write text or JSON to stderr at the
+// configured level
+func setupLogging(cfg BotConfig) error {
+    level, err := parseLogLevel(cfg.LogLevel)
+    if err != nil {
+        return err
+    }
+    logLevel.Set(level)
+    opts := &slog.HandlerOptions{Level: logLevel}
+    var handler slog.Handler
+    switch strings.ToLower(cfg.LogFormat) {
+    case "", "text":
+        handler = slog.NewTextHandler(os.Stderr, opts)
+    case "json":
+        handler = slog.NewJSONHandler(os.Stderr, opts)
+    default:
+        return fmt.Errorf("unknown log_format %q, use text or json", cfg.LogFormat)
+    }
+    slog.SetDefault(slog.New(handler))
+    return nil
+}
+
+// parseLogLevel reads debug, info, warn or error, info when empty
+func parseLogLevel(name string) (slog.Level, error) {
+    var level slog.Level
+    if name == "" {
+        return slog.LevelInfo, nil
+    }
+    if err := level.UnmarshalText([]byte(name)); err != nil {
+        return 0, fmt.Errorf("unknown log_level %q, use debug, info, warn or error", name)
+    }
+    return level, nil
+}
+
+// fatal logs at error level and exits
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
+
+type logKey struct{}
+
+// withLog returns a context whose logFor logger adds args to every entry,
+// so a command's logs carry its room, sender and command
+func withLog(ctx context.Context, args ...any) context.Context {
+    return context.WithValue(ctx, logKey{}, logFor(ctx).With(args...))
+}
+
+// logFor returns the logger set by withLog, or the default one
+func logFor(ctx context.Context) *slog.Logger {
+    if l, ok := ctx.Value(logKey{}).(*slog.Logger); ok {
+        return l
+    }
+    return slog.Default()
+}
+
+// newHTTPTransport builds the transport shared by the Matrix client and any
+// other outgoing HTTP requests. An empty proxy honors the standard
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables.
+func newHTTPTransport(proxy string) (*http.Transport, error) {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    if proxy == "" {
+        transport.Proxy = http.ProxyFromEnvironment
+        return transport, nil
+    }
+    proxyURL, err := url.Parse(proxy)
+    if err != nil {
+        return nil, err
+    }
+    switch proxyURL.Scheme {
+    case "http", "https", "socks5", "socks5h":
+    default:
+        return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+    }
+    if proxyURL.Host == "" {
+        return nil, fmt.Errorf("proxy URL %q has no host", proxy)
+    }
+    transport.Proxy = http.ProxyURL(proxyURL)
+    return transport, nil
+}
+
+// sendLimiter is a token bucket shared by every message the bot sends, so it
+// stays under send_rate messages per second across all rooms
+type sendLimiter struct {
+    mu     sync.Mutex
+    rate   float64 // tokens per second, 0 for no limit
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+func newSendLimiter(rate float64, burst int) *sendLimiter {
+    l := &sendLimiter{}
+    l.setLimits(rate, burst)
+    return l
+}
+
+// setLimits changes the rate, e.g. after a config reload
+func (l *sendLimiter) setLimits(rate float64, burst int) {
+    if burst < 1 {
+        burst = 1
+    }
+    l.mu.Lock()
+    l.rate = rate
+    l.burst = float64(burst)
+    l.tokens = l.burst
+    l.last = time.Now()
+    l.mu.Unlock()
+}
+
+// wait blocks until a message may be sent or ctx is done
+func (l *sendLimiter) wait(ctx context.Context) error {
+    for {
+        l.mu.Lock()
+        if l.rate <= 0 {
+            l.mu.Unlock()
+            return nil
+        }
+        now := time.Now()
+        l.tokens += now.Sub(l.last).Seconds() * l.rate
+        if l.tokens > l.burst {
+            l.tokens = l.burst
+        }
+        l.last = now
+        if l.tokens >= 1 {
+            l.tokens--
+            l.mu.Unlock()
+            return nil
+        }
+        delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+        l.mu.Unlock()
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(delay):
+        }
+    }
+}
+
+// sendLimitTransport holds back Matrix event sends (messages, notices,
+// reactions, edits) until the limiter allows them. Other requests such as
+// sync pass straight through.
+type sendLimitTransport struct {
+    next    http.RoundTripper
+    limiter *sendLimiter
+}
+
+func (t *sendLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if req.Method != http.MethodPut || !strings.Contains(req.URL.Path, "/send/") {
+        return t.next.RoundTrip(req)
+    }
+    if err := t.limiter.wait(req.Context()); err != nil {
+        return nil, err
+    }
+    resp, err := t.next.RoundTrip(req)
+    if err != nil || resp.StatusCode >= 400 {
+        metrics.sendError()
+    }
+    return resp, err
+}
+
+func newMatrixClient(server string, userID id.UserID, accessToken string, transport http.RoundTripper) (*mautrix.Client, error) {
+    client, err := mautrix.NewClient(server, userID, accessToken)
+    if err != nil {
+        return nil, err
+    }
+    client.Client.Transport = transport
+    return client, nil
+}
+
 func main() {
-    startTime := time.Now()
-    cfg, err := loadConfig("config.yaml")
+    cfg, err := loadConfig(configPath)
+    if err != nil {
+        fatal("Failed to load config", "err", err)
+    }
+    if err := setupLogging(cfg.Bot); err != nil {
+        fatal("Invalid logging setting", "err", err)
+    }
+
+    // Check the catalog before logging in, so a bad setup fails fast
+    ensureCatalog(cfg.Bot)
+
+    transport, err := newHTTPTransport(cfg.Matrix.Proxy)
     if err != nil {
-        log.Fatalf("Failed to load config: %v", err)
+        fatal("Invalid proxy setting", "err", err)
     }
+    sendLimit := newSendLimiter(cfg.Bot.SendRate, cfg.Bot.SendBurst)
+    matrixTransport := &sendLimitTransport{next: transport, limiter: sendLimit}
 
     tokenPath := "token.json"
     var client *mautrix.Client
-    var tokenStore *TokenStore
 
     // Try to load token.json for re-use
     if ts, err := loadToken(tokenPath); err == nil && ts.AccessToken != "" {
         userID := strings.TrimSpace(ts.UserID)
         if !strings.HasPrefix(userID, "@") {
-            log.Fatalf("UserID does not start with '@': %q", userID)
+            fatal("UserID does not start with '@'", "user", userID)
         }
-        log.Printf("Creating client with UserID: %q", userID)
-        client, err = mautrix.NewClient(cfg.Matrix.Server, id.UserID(userID), ts.AccessToken)
+        slog.Info("Creating client", "user", userID)
+        client, err = newMatrixClient(cfg.Matrix.Server, id.UserID(userID), ts.AccessToken, matrixTransport)
         if err != nil {
-            log.Fatalf("Failed to create Matrix client with stored token: %v", err)
+            fatal("Failed to create Matrix client with stored token", "err", err)
         }
         client.DeviceID = id.DeviceID(ts.DeviceID)
-        log.Println("Loaded access token from file.")
+        slog.Info("Loaded access token from file")
     } else {
         // First-time login
-        client, err = mautrix.NewClient(cfg.Matrix.Server, "", "")
+        client, err = newMatrixClient(cfg.Matrix.Server, "", "", matrixTransport)
         if err != nil {
-            log.Fatalf("Failed to create Matrix client: %v", err)
+            fatal("Failed to create Matrix client", "err", err)
         }
-        resp, err := client.Login(context.Background(), &mautrix.ReqLogin{
-            Type: "m.login.password",
-            Identifier: mautrix.UserIdentifier{
-                Type: mautrix.IdentifierTypeUser,
-                User: cfg.Matrix.Username,
-            },
-            Password: cfg.Matrix.Password,
-        })
-        if err != nil {
-            log.Fatalf("Failed to login: %v", err)
+        if err := passwordLogin(context.Background(), client, cfg.Matrix, tokenPath); err != nil {
+            fatal("Failed to login", "err", err)
         }
-        tokenStore = &TokenStore{
-            AccessToken: resp.AccessToken,
-            UserID:      resp.UserID.String(),
-            DeviceID:    resp.DeviceID.String(),
+    }
+
+    // open the db once and reuse it for all queries
+    db, err := openStore(cfg.Bot)
+    if err != nil {
+        fatal("Failed to open the database", "err", err)
+    }
+    defer db.Close()
+    maxOpen, maxIdle := cfg.Bot.dbPool()
+    db.SetMaxOpenConns(maxOpen)
+    db.SetMaxIdleConns(maxIdle)
+    if err := db.Migrate(context.Background()); err != nil {
+        fatal("Failed to prepare the database", "err", err)
+    }
+    // Keep the sync token in the db, so a restart picks up where the last
+    // run stopped and answers commands sent while the bot was down
+    client.Store = &syncStore{db: db}
+    var hasAltTitles bool
+    if err := db.QueryRowContext(context.Background(), "SELECT EXISTS (SELECT 1 FROM alt_titles)").Scan(&hasAltTitles); err != nil {
+        slog.Warn("Could not check for alternate titles", "err", err)
+    }
+    // hasColumn reports whether files has column, for the parts of the
+    // catalog that newer build-db runs add
+    hasColumn := func(column, what string) bool {
+        ok, err := db.HasColumn(context.Background(), "files", column)
+        if err != nil {
+            slog.Warn("Could not check for "+what, "err", err)
         }
-        if !strings.HasPrefix(tokenStore.UserID, "@") {
-            log.Fatalf("UserID after login does not start with '@': %q", tokenStore.UserID)
+        return ok
+    }
+    // search_blob is only used once build-db has filled it for every row
+    hasSearchBlob := hasColumn("search_blob", "search_blob")
+    if hasSearchBlob {
+        if err := db.QueryRowContext(context.Background(), "SELECT NOT EXISTS (SELECT 1 FROM files WHERE search_blob IS NULL)").Scan(&hasSearchBlob); err != nil {
+            slog.Warn("Could not check search_blob", "err", err)
+            hasSearchBlob = false
         }
-        if err := saveToken(tokenPath, tokenStore); err != nil {
-            log.Printf("Warning: Could not save access token: %v", err)
-        } else {
-            log.Println("Saved access token to file.")
+    }
+    hasSoftDelete := hasColumn("deleted_at", "deleted_at")
+    hasTitles := hasColumn("title", "titles")
+    hasRegions := hasColumn("region", "regions")
+    // Sizes come from "build-db sizes"; rows it hasn't reached are NULL
+    hasSizes := hasColumn("size", "sizes")
+    // status is written by the link checker, which adds it when turned on
+    if cfg.Bot.LinkCheckInterval > 0 {
+        if err := ensureLinkStatus(context.Background(), db); err != nil {
+            fatal("Could not add the link checker's columns", "err", err)
         }
-
-        // Re-create client with correct credentials after login
-        client, err = mautrix.NewClient(cfg.Matrix.Server, resp.UserID, resp.AccessToken)
-        if err != nil {
-            log.Fatalf("Failed to create Matrix client after login: %v", err)
+    }
+    hasLinkStatus := hasColumn("status", "link status")
+    hasSources := hasColumn("source", "sources")
+    hasExts := hasColumn("ext", "extensions")
+    // dat_roms holds No-Intro/Redump checksums, from "build-db dat"
+    hasDats, err := db.HasTable(context.Background(), "dat_roms")
+    if err != nil {
+        slog.Warn("Could not check for DAT checksums", "err", err)
+    }
+    // files_fts needs both an index from build-db and a bot built with
+    // -tags sqlite_fts5. PostgreSQL doesn't have one, so it isn't probed.
+    hasFTS := cfg.Bot.dbDriver() == "sqlite3"
+    if hasFTS {
+        if _, err := db.ExecContext(context.Background(), "SELECT rowid FROM files_fts WHERE files_fts MATCH '\"roms\"' LIMIT 1"); err != nil {
+            slog.Warn("Full-text index not available, searching with LIKE (build-db and the bot both need -tags sqlite_fts5)", "err", err)
+            hasFTS = false
         }
-        client.DeviceID = resp.DeviceID
     }
 
-    // open sqlite db once and reuse for all queries
-    db, err := sql.Open("sqlite3", "./links.db")
-    if err != nil {
-        log.Fatalf("Failed to open links.db: %v", err)
+    bot := &Bot{
+        client:      client,
+        db:          db,
+        cfg:         cfg,
+        upstream:    newUpstreamCache(transport),
+        jobs:        newJobRegistry(),
+        alerts:      newAlerter(),
+        dms:         newDMCache(),
+        rejected:    newRejectedQueries(),
+        pages:       newPager(),
+        powerLevels: newPowerLevelCache(),
+        sendLimit:   sendLimit,
+        cooldown:    newRoomCooldown(),
+        userLimit:   newUserLimiter(),
+        http:        &http.Client{Timeout: time.Minute, Transport: transport},
+        altTitles:   hasAltTitles,
+        searchBlob:  hasSearchBlob,
+        fts:         hasFTS,
+        softDelete:  hasSoftDelete,
+        sizes:       hasSizes,
+        regions:     hasRegions,
+        titles:      hasTitles,
+        linkStatus:  hasLinkStatus,
+        dats:        hasDats,
+        sources:     hasSources,
+        exts:        hasExts,
+        more:        newMoreCursors(),
+        listed:      newListings(),
+        batches:     newBatchIndex(),
+        pool:        newWorkerPool(cfg.Bot.workers()),
     }
-    defer db.Close()
+    work, stopWork := context.WithCancel(context.Background())
+    bot.work = work
 
     syncer := client.Syncer.(*mautrix.DefaultSyncer)
     syncer.OnEventType(event.EventMessage, mautrix.EventHandler(
@@ -143,336 +828,7256 @@ func main() {
             if ev.Sender == client.UserID {
                 return // Ignore bot's own messages
             }
-            if ev.RoomID.String() != cfg.Matrix.Room {
+            if !bot.servesRoom(ctx, ev.RoomID) {
                 return // Ignore other rooms
             }
-            // Ignore events from before the bot started
-            if ev.Timestamp < startTime.UnixMilli() {
-                return
-            }
             content, ok := ev.Content.Parsed.(*event.MessageEventContent)
             if !ok || content.MsgType != event.MsgText {
                 return
             }
-            if strings.HasPrefix(content.Body, "!") {
-                handleCommand(ctx, client, db, ev.RoomID, content.Body, ev.ID)
+            // An edited command is run again as if it were the original message
+            if origID := content.GetRelatesTo().GetReplaceID(); origID != "" {
+                if content.NewContent == nil {
+                    return
+                }
+                if body, ok := bot.commandBody(ev.RoomID, content.NewContent); ok {
+                    bot.dispatch(ev, func(ctx context.Context) { bot.handleEdit(ctx, ev, origID, body) })
+                }
+                return
+            }
+            if body, ok := bot.commandBody(ev.RoomID, content); ok {
+                // !jobs and !cancel deal with stuck searches, so they
+                // don't wait behind them
+                if name, _, _ := strings.Cut(body, " "); name == "!jobs" || name == "!cancel" {
+                    bot.spawn(func(ctx context.Context) { bot.handleCommand(ctx, ev, body) })
+                    return
+                }
+                bot.dispatch(ev, func(ctx context.Context) { bot.handleCommand(ctx, ev, body) })
+                return
+            }
+            // A number replied to a listing picks that result
+            if batchID := content.GetRelatesTo().GetNonFallbackReplyTo(); batchID != "" {
+                content.RemoveReplyFallback()
+                if n, ok := resultNumber(content.Body); ok {
+                    bot.dispatch(ev, func(ctx context.Context) {
+                        if !bot.throttled(ctx, ev.RoomID, ev.Sender, ev.ID) {
+                            bot.showCard(ctx, ev.RoomID, batchID, n, ev.ID)
+                        }
+                    })
+                }
             }
         },
     ))
 
-    log.Println("Bot is running!")
-    err = client.Sync()
-    if err != nil {
-        log.Fatalf("Sync() returned error: %v", err)
-    }
-}
-
-// parseArgs parses quoted, unquoted, and -negated terms
-func parseArgs(query string) (positives []string, negatives []string, atArg *string, err error) {
-    tokens := []string{}
-    curr := strings.Builder{}
-    inQuote := false
-    quoteChar := byte(0)
-    for i := 0; i < len(query); i++ {
-        c := query[i]
-        if c == '"' || c == '\'' {
-            if inQuote && c == quoteChar {
-                if curr.Len() > 0 {
-                    tokens = append(tokens, curr.String())
-                    curr.Reset()
-                }
-                inQuote = false
-            } else if !inQuote {
-                inQuote = true
-                quoteChar = c
-            } else {
-                curr.WriteByte(c)
+    // Page through single-message results with ◀️/▶️ reactions, or react
+    // with a number for the details of that result
+    syncer.OnEventType(event.EventReaction, mautrix.EventHandler(
+        func(ctx context.Context, ev *event.Event) {
+            if ev.Sender == client.UserID {
+                return
             }
-        } else if c == ' ' && !inQuote {
-            if curr.Len() > 0 {
-                tokens = append(tokens, curr.String())
-                curr.Reset()
+            if !bot.servesRoom(ctx, ev.RoomID) {
+                return
             }
-        } else {
-            curr.WriteByte(c)
-        }
-    }
-    if curr.Len() > 0 {
-        tokens = append(tokens, curr.String())
-    }
-
-    atFound := ""
-    for _, t := range tokens {
-        if len(t) == 0 {
-            continue
-        }
-        if t[0] == '@' {
-            if atFound != "" {
-                err = fmt.Errorf("you can only use the @ argument once")
+            reaction, ok := ev.Content.Parsed.(*event.ReactionEventContent)
+            if !ok {
                 return
             }
-            atFound = t[1:]
-        } else if t[0] == '-' {
-            negatives = append(negatives, t[1:])
-        } else {
-            positives = append(positives, t)
-        }
-    }
-    if atFound != "" {
-        atArg = &atFound
-    }
-    return
-}
+            rel := reaction.GetRelatesTo()
+            // A number reacted to a listing picks that result. A reaction
+            // can't be replied to, so a throttled one gets ⏳ on the listing.
+            if n, ok := resultNumber(rel.GetAnnotationKey()); ok {
+                listing := rel.GetAnnotationID()
+                bot.dispatch(ev, func(ctx context.Context) {
+                    if !bot.throttled(ctx, ev.RoomID, ev.Sender, listing) {
+                        bot.showCard(ctx, ev.RoomID, listing, n, listing)
+                    }
+                })
+                return
+            }
+            bot.dispatch(ev, func(ctx context.Context) { bot.turnPage(ctx, ev.Sender, rel.GetAnnotationID(), rel.GetAnnotationKey()) })
+        },
+    ))
 
+    // Keep cached power levels current for admin_power_level
+    syncer.OnEventType(event.StatePowerLevels, mautrix.EventHandler(
+        func(ctx context.Context, ev *event.Event) {
+            if pl, ok := ev.Content.Parsed.(*event.PowerLevelsEventContent); ok {
+                bot.powerLevels.set(ev.RoomID, pl)
+            }
+        },
+    ))
 
-func buildSQLQuery(positives, negatives []string, atArg *string, maxResults int) (string, []interface{}) {
-    where := []string{}
-    args := []interface{}{}
+    // Accept DM invites so users can search privately
+    syncer.OnEventType(event.StateMember, mautrix.EventHandler(
+        func(ctx context.Context, ev *event.Event) {
+            if !bot.config().Bot.AllowDMs || ev.GetStateKey() != client.UserID.String() {
+                return
+            }
+            member, ok := ev.Content.Parsed.(*event.MemberEventContent)
+            if !ok || member.Membership != event.MembershipInvite || !member.IsDirect {
+                return
+            }
+            if _, err := client.JoinRoomByID(ctx, ev.RoomID); err != nil {
+                slog.Error("Failed to join DM", "room", ev.RoomID, "sender", ev.Sender, "err", err)
+                return
+            }
+            slog.Info("Joined DM", "room", ev.RoomID, "sender", ev.Sender)
+        },
+    ))
 
-    // @ argument: restrict to console only
-    if atArg != nil {
-        w := "LOWER(console) LIKE ?"
-        val := "%" + strings.ToLower(*atArg) + "%"
-        where = append(where, w)
-        args = append(args, val)
+    // Stop syncing on SIGINT/SIGTERM and shut down once running commands
+    // are done
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    if cfg.API.Listen != "" {
+        go bot.serveAPI(ctx, cfg.API.Listen)
+    }
+    if cfg.Metrics.Listen != "" {
+        go serveMetrics(ctx, cfg.Metrics.Listen)
+    }
+    if cfg.Bot.LinkCheckInterval > 0 {
+        go bot.checkLinks(ctx)
     }
 
-    // Each positive: must appear in at least one of the fields
-    for _, p := range positives {
-        w := "(LOWER(section) LIKE ? OR LOWER(console) LIKE ? OR LOWER(file) LIKE ?)"
-        val := "%" + strings.ToLower(p) + "%"
-        where = append(where, w)
-        args = append(args, val, val, val)
+    if cfg.Bot.PresenceStatus {
+        bot.updatePresence(context.Background())
     }
 
-    // Each negative: must NOT appear in any of the fields
-    for _, n := range negatives {
-        w := "(LOWER(section) NOT LIKE ? AND LOWER(console) NOT LIKE ? AND LOWER(file) NOT LIKE ?)"
-        val := "%" + strings.ToLower(n) + "%"
-        where = append(where, w)
-        args = append(args, val, val, val)
+    // Reload the config on SIGHUP
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            slog.Info("SIGHUP received, reloading config.yaml")
+            if err := bot.reloadConfig(configPath); err != nil {
+                slog.Error("Config reload failed, keeping the old config", "err", err)
+                continue
+            }
+            if bot.config().Bot.PresenceStatus {
+                bot.updatePresence(context.Background())
+            }
+        }
+    }()
+
+    // The first /sync on a busy account can take a while. Without a saved
+    // token it is all history and skipHistory drops its messages; with one it
+    // holds whatever was sent while the bot was down, which is answered.
+    syncStart := time.Now()
+    initialSync := make(chan struct{})
+    var initialSyncOnce sync.Once
+    syncer.OnSync(func(ctx context.Context, resp *mautrix.RespSync, since string) bool {
+        skipHistory(client.UserID, resp, since == "")
+        initialSyncOnce.Do(func() {
+            slog.Info("Initial sync done", "duration", time.Since(syncStart).Round(time.Millisecond),
+                "rooms", len(resp.Rooms.Join), "invites", len(resp.Rooms.Invite))
+            slog.Info("Bot is running!")
+            close(initialSync)
+        })
+        return true
+    })
+    go bot.awaitInitialSync(initialSync, syncStart, cfg.Bot.initialSyncTimeout())
+
+    if since, err := client.Store.LoadNextBatch(context.Background(), client.UserID); err != nil {
+        fatal("Failed to load the sync token", "err", err)
+    } else if since != "" {
+        slog.Info("Resuming sync from the saved token...")
+    } else {
+        slog.Info("Starting initial sync...")
+    }
+    // A revoked or expired token ends the sync with M_UNKNOWN_TOKEN: log in
+    // with the password again and carry on. Failing again right away means
+    // the new token is no good either.
+    var lastLogin time.Time
+    for {
+        err = client.SyncWithContext(ctx)
+        if err == nil || ctx.Err() != nil {
+            break
+        }
+        if errors.Is(err, mautrix.MUnknownToken) && time.Since(lastLogin) > time.Minute {
+            slog.Warn("Access token rejected, logging in again", "err", err)
+            lastLogin = time.Now()
+            if err = passwordLogin(ctx, client, cfg.Matrix, tokenPath); err == nil {
+                metrics.syncRestart()
+                continue
+            }
+            err = fmt.Errorf("login after the access token was rejected: %w", err)
+        }
+        bot.alert(context.Background(), "sync", "Sync failed, bot is exiting: "+err.Error())
+        fatal("Sync() returned error", "err", err)
     }
+    // The sync token was saved before its events were handed out, so the
+    // next start resumes right after them
+    stop()
+    slog.Info("Shutting down, waiting for running commands...")
+    bot.drain(stopWork, bot.config().Bot.shutdownTimeout())
+    slog.Info("Bye!")
+}
 
-    sql := "SELECT section, console, file, rawurl FROM files"
-    if len(where) > 0 {
-        sql += " WHERE " + strings.Join(where, " AND ")
+// passwordLogin logs client in with the configured username and password and
+// saves the new access token to tokenPath
+func passwordLogin(ctx context.Context, client *mautrix.Client, cfg MatrixConfig, tokenPath string) error {
+    resp, err := client.Login(ctx, &mautrix.ReqLogin{
+        Type: "m.login.password",
+        Identifier: mautrix.UserIdentifier{
+            Type: mautrix.IdentifierTypeUser,
+            User: cfg.Username,
+        },
+        Password:         cfg.Password,
+        StoreCredentials: true,
+    })
+    if err != nil {
+        return err
     }
-    sql += " ORDER BY section, console, file LIMIT ?"
-    args = append(args, maxResults+1) // +1 for over-limit check
-    return sql, args
+    if !strings.HasPrefix(resp.UserID.String(), "@") {
+        return fmt.Errorf("UserID after login does not start with '@': %q", resp.UserID)
+    }
+    tokenStore := &TokenStore{
+        AccessToken: resp.AccessToken,
+        UserID:      resp.UserID.String(),
+        DeviceID:    resp.DeviceID.String(),
+    }
+    if err := saveToken(tokenPath, tokenStore); err != nil {
+        slog.Warn("Could not save access token", "err", err)
+    } else {
+        slog.Info("Saved access token to file")
+    }
+    return nil
 }
 
+// spawn runs a handler off the sync loop, so a slow search doesn't hold up
+// everything else, including !cancel. Shutdown waits for it with drain.
+func (b *Bot) spawn(handle func(ctx context.Context)) {
+    b.running.Add(1)
+    go func() {
+        defer b.running.Done()
+        handle(b.work)
+    }()
+}
 
-func htmlEscape(s string) string {
-    replacer := strings.NewReplacer(
-        "&", "&amp;",
-        "<", "&lt;",
-        ">", "&gt;",
-        "\"", "&quot;",
-        "'", "&#39;",
-    )
-    return replacer.Replace(s)
+// dispatch runs a handler for ev on the worker pool once the ones queued
+// before it for the same sender in the same room are done, so each user's
+// replies come in the order of their commands while one user's slow search
+// doesn't hold up everyone else in the room. Shutdown waits for it with
+// drain.
+func (b *Bot) dispatch(ev *event.Event, handle func(ctx context.Context)) {
+    b.running.Add(1)
+    b.pool.submit(ev.RoomID.String()+" "+ev.Sender.String(), func() {
+        defer b.running.Done()
+        handle(b.work)
+    })
 }
 
+// workerPool runs handlers on at most size goroutines at a time. Handlers
+// submitted under the same key run one after another, in order.
+type workerPool struct {
+    slots  chan struct{}
+    mu     sync.Mutex
+    queues map[string][]func() // waiting handlers per key, present while one runs
+}
 
-func handleCommand(ctx context.Context, client *mautrix.Client, db *sql.DB, roomID id.RoomID, body string, eventID id.EventID) {
-    const maxResults = 1000
-    const batchSize = 100
+func newWorkerPool(size int) *workerPool {
+    return &workerPool{slots: make(chan struct{}, size), queues: map[string][]func(){}}
+}
 
-    cmd := strings.Fields(body)
-    if len(cmd) == 0 {
+// submit queues fn behind the handlers already waiting for key, or starts
+// running it if there are none
+func (p *workerPool) submit(key string, fn func()) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if queue, ok := p.queues[key]; ok {
+        p.queues[key] = append(queue, fn)
         return
     }
-    switch cmd[0] {
-
-    //Help Message
-    case "!help":
-	reactHelp := map[string]interface{}{
-		"m.relates_to": map[string]interface{}{
-			"rel_type": "m.annotation",
-			"event_id": eventID,
-			"key":      "ℹ️",
-		},
-	}
-	_, _ = client.SendMessageEvent(ctx, roomID, event.EventReaction, reactHelp)
-
-	helpText := `Usage:
-!roms [what to search] [@console] [-exclude]
-You can search whole strings with " "
-
-Examples:
-!roms mario @nintendo  -sports
-!roms zelda @"Nintendo 3DS" -digital`
-
-	notice := map[string]interface{}{
-		"msgtype": "m.notice",
-		"body":    helpText,
-		"m.relates_to": map[string]interface{}{
-			"m.in_reply_to": map[string]interface{}{
-				"event_id": eventID,
-			},
-		},
-	}
-	_, _ = client.SendMessageEvent(ctx, roomID, event.EventMessage, notice)
-	return
-
-    //Search roms
-    case "!roms":
-        query := strings.TrimSpace(body[len("!roms"):])
-        log.Printf("!roms command: %q", query)
+    p.queues[key] = nil
+    go p.run(key, fn)
+}
 
-        positives, negatives, atArg, parseErr := parseArgs(query)
-        if parseErr != nil {
-            // reply to Matrix and return
-           client.SendText(ctx, roomID, parseErr.Error())
-           return
+// run works through key's queue, starting with fn. Each handler takes a slot
+// of its own, so a busy key doesn't keep the others out.
+func (p *workerPool) run(key string, fn func()) {
+    for {
+        p.slots <- struct{}{}
+        fn()
+        <-p.slots
+        p.mu.Lock()
+        queue := p.queues[key]
+        if len(queue) == 0 {
+            delete(p.queues, key)
+            p.mu.Unlock()
+            return
         }
-        sqlQuery, args := buildSQLQuery(positives, negatives, atArg, maxResults)
+        fn, p.queues[key] = queue[0], queue[1:]
+        p.mu.Unlock()
+    }
+}
 
+// drain waits for spawned handlers to send their replies. After timeout it
+// cancels them and gives them a moment to notice.
+func (b *Bot) drain(cancel context.CancelFunc, timeout time.Duration) {
+    done := make(chan struct{})
+    go func() {
+        b.running.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return
+    case <-time.After(timeout):
+    }
+    slog.Warn("Commands still running, cancelling them", "timeout", timeout)
+    cancel()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        slog.Warn("Some commands did not stop, exiting anyway")
+    }
+}
 
-        rows, err := db.Query(sqlQuery, args...)
-        if err != nil {
-            client.SendText(ctx, roomID, "Search error: "+err.Error())
+// awaitInitialSync logs while the first /sync is running and exits the bot
+// if it takes longer than timeout
+func (b *Bot) awaitInitialSync(done <-chan struct{}, started time.Time, timeout time.Duration) {
+    ticker := time.NewTicker(30 * time.Second)
+    defer ticker.Stop()
+    deadline := time.NewTimer(timeout)
+    defer deadline.Stop()
+    for {
+        select {
+        case <-done:
             return
+        case <-ticker.C:
+            slog.Info("Still waiting for the initial sync", "elapsed", time.Since(started).Round(time.Second))
+        case <-deadline.C:
+            ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+            b.alert(ctx, "sync", fmt.Sprintf("Initial sync didn't finish within %s, bot is exiting", timeout))
+            cancel()
+            fatal("Initial sync didn't finish in time (bot.initial_sync_timeout)", "timeout", timeout)
+        }
+    }
+}
+
+// catalogRows returns the number of rows in the files table, without
+// creating links.db if it doesn't exist
+func catalogRows(cfg BotConfig) (int, error) {
+    var db *sql.DB
+    var err error
+    if cfg.dbDriver() == "postgres" {
+        db, err = sql.Open("postgres", cfg.DBDSN)
+    } else {
+        if _, err := os.Stat(dbPath); err != nil {
+            return 0, err
         }
-        defer rows.Close()
+        db, err = sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+    }
+    if err != nil {
+        return 0, err
+    }
+    defer db.Close()
+    var n int
+    err = db.QueryRow("SELECT COUNT(*) FROM files").Scan(&n)
+    return n, err
+}
+
+// ensureCatalog stops the bot from starting with nothing to search. A
+// missing or empty catalog is built with build_command when one is set,
+// otherwise startup fails.
+func ensureCatalog(cfg BotConfig) {
+    n, err := catalogRows(cfg)
+    if err == nil && n > 0 {
+        return
+    }
+    name, build := dbPath, "`go run build-db.go`"
+    if cfg.dbDriver() == "postgres" {
+        name, build = "The PostgreSQL catalog", "`go run build-db.go` and `go run build-db.go pg <dsn>`"
+    }
+    problem := "has no rows"
+    if err != nil {
+        problem = "can't be read: " + err.Error()
+    }
+    if cfg.BuildCommand == "" {
+        fatal(fmt.Sprintf("%s %s. Build it with %s, or set bot.build_command to build it at startup.", name, problem, build))
+    }
+
+    slog.Info(fmt.Sprintf("%s %s, building it", name, problem), "command", cfg.BuildCommand)
+    cmd := exec.Command("sh", "-c", cfg.BuildCommand)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        fatal("build_command failed", "err", err)
+    }
+    if n, err := catalogRows(cfg); err != nil || n == 0 {
+        fatal(name+" is still missing or empty after build_command", "rows", n, "err", err)
+    }
+}
+
+// syncStore is a mautrix.SyncStore that keeps the filter ID and the sync
+// token in the sync_state table
+type syncStore struct {
+    db Store
+}
+
+func (s *syncStore) SaveFilterID(ctx context.Context, userID id.UserID, filterID string) error {
+    _, err := s.db.ExecContext(ctx,
+        "INSERT INTO sync_state (user_id, filter_id) VALUES (?, ?) ON CONFLICT(user_id) DO UPDATE SET filter_id = excluded.filter_id",
+        userID.String(), filterID)
+    return err
+}
+
+func (s *syncStore) LoadFilterID(ctx context.Context, userID id.UserID) (string, error) {
+    return s.load(ctx, userID, "filter_id")
+}
+
+func (s *syncStore) SaveNextBatch(ctx context.Context, userID id.UserID, nextBatchToken string) error {
+    _, err := s.db.ExecContext(ctx,
+        "INSERT INTO sync_state (user_id, next_batch) VALUES (?, ?) ON CONFLICT(user_id) DO UPDATE SET next_batch = excluded.next_batch",
+        userID.String(), nextBatchToken)
+    return err
+}
+
+func (s *syncStore) LoadNextBatch(ctx context.Context, userID id.UserID) (string, error) {
+    return s.load(ctx, userID, "next_batch")
+}
 
-        type resultRow struct {
-            Section string
-            Console string
-            File    string
-            Rawurl  string
+// load reads one column of userID's row, "" if there is none yet
+func (s *syncStore) load(ctx context.Context, userID id.UserID, column string) (string, error) {
+    var value sql.NullString
+    err := s.db.QueryRowContext(ctx, "SELECT "+column+" FROM sync_state WHERE user_id = ?", userID.String()).Scan(&value)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    return value.String, err
+}
+
+// skipHistory drops the messages /sync hands over as room history, so old
+// commands aren't answered: every message on a fresh start without a saved
+// token, and otherwise those from before the bot joined a room. State events
+// are kept so the caches built from them stay current.
+func skipHistory(userID id.UserID, resp *mautrix.RespSync, fresh bool) {
+    for _, room := range resp.Rooms.Join {
+        events := room.Timeline.Events
+        cut := 0
+        if fresh {
+            cut = len(events)
         }
-        var results []resultRow
-        for rows.Next() {
-            var section, console, file, rawurl string
-            if err := rows.Scan(&section, &console, &file, &rawurl); err != nil {
+        for i := len(events) - 1; i >= cut; i-- {
+            ev := events[i]
+            if ev.Type != event.StateMember || ev.GetStateKey() != userID.String() {
                 continue
             }
-            results = append(results, resultRow{
-                Section: section, Console: console, File: file, Rawurl: rawurl,
-            })
+            membership, _ := ev.Content.Raw["membership"].(string)
+            var prev string
+            if ev.Unsigned.PrevContent != nil {
+                prev, _ = ev.Unsigned.PrevContent.Raw["membership"].(string)
+            }
+            // A profile change is also a join, but not a new one
+            if membership == "join" && prev != "join" {
+                cut = i + 1
+                break
+            }
         }
-        if err := rows.Err(); err != nil {
-            client.SendText(ctx, roomID, "Search error: "+err.Error())
-            return
+        if cut == 0 {
+            continue
         }
-
-        // Sort by Section, then Console, then File
-        sort.Slice(results, func(i, j int) bool {
-            if results[i].Section != results[j].Section {
-                return results[i].Section < results[j].Section
+        kept := make([]*event.Event, 0, len(events))
+        for i, ev := range events {
+            if i >= cut || ev.StateKey != nil {
+                kept = append(kept, ev)
             }
-            if results[i].Console != results[j].Console {
-                return results[i].Console < results[j].Console
-            }
-            return results[i].File < results[j].File
-        })
+        }
+        room.Timeline.Events = kept
+    }
+}
 
-        // No results: react with ❌️ and notify, including the number of results
-        if len(results) < 1 {
-            reactTooMany := map[string]interface{}{
-                "m.relates_to": map[string]interface{}{
-                    "rel_type": "m.annotation",
-                    "event_id": eventID,
-                    "key":      "❌️",
-                },
-            }
-            _, _ = client.SendMessageEvent(ctx, roomID, event.EventReaction, reactTooMany)
-            tooManyMsg := map[string]interface{}{
-                "msgtype": "m.text",
-                "body":    fmt.Sprintf("No results"),
-                "m.relates_to": map[string]interface{}{
-                    "m.in_reply_to": map[string]interface{}{
-                        "event_id": eventID,
-                    },
-                },
-            }
-            _, _ = client.SendMessageEvent(ctx, roomID, event.EventMessage, tooManyMsg)
-            return
+// Store is the database the bot searches and keeps its own state in:
+// links.db, or PostgreSQL for catalogs too busy for one SQLite file.
+// Queries are written in SQLite's dialect with ? placeholders, which each
+// backend adapts.
+type Store interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+    BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+    // Rebind adapts a query for statements run on a transaction
+    Rebind(query string) string
+    // HasColumn and HasTable look for the optional parts of the catalog
+    HasColumn(ctx context.Context, table, column string) (bool, error)
+    HasTable(ctx context.Context, name string) (bool, error)
+    // Migrate creates or updates the tables the bot itself writes to
+    Migrate(ctx context.Context) error
+    SetMaxOpenConns(n int)
+    SetMaxIdleConns(n int)
+    Close() error
+}
+
+// openStore opens the database bot.db_driver names
+func openStore(cfg BotConfig) (Store, error) {
+    switch cfg.dbDriver() {
+    case "sqlite3":
+        db, err := sql.Open("sqlite3", dbPath)
+        if err != nil {
+            return nil, err
+        }
+        return sqliteStore{db}, nil
+    case "postgres":
+        if cfg.DBDSN == "" {
+            return nil, fmt.Errorf("db_driver postgres needs db_dsn")
+        }
+        db, err := sql.Open("postgres", cfg.DBDSN)
+        if err != nil {
+            return nil, err
         }
+        return postgresStore{db}, nil
+    default:
+        return nil, fmt.Errorf("unknown db_driver %q, use sqlite3 or postgres", cfg.DBDriver)
+    }
+}
 
-        // Too many results: react with ❌️ and notify, including the number of results
-        if len(results) > maxResults {
-            reactTooMany := map[string]interface{}{
-                "m.relates_to": map[string]interface{}{
-                    "rel_type": "m.annotation",
-                    "event_id": eventID,
-                    "key":      "❌️",
-                },
-            }
-            _, _ = client.SendMessageEvent(ctx, roomID, event.EventReaction, reactTooMany)
-            tooManyMsg := map[string]interface{}{
-                "msgtype": "m.text",
-                "body":    fmt.Sprintf("Too many results: %d", len(results)),
-                "m.relates_to": map[string]interface{}{
-                    "m.in_reply_to": map[string]interface{}{
-                        "event_id": eventID,
-                    },
-                },
-            }
-            _, _ = client.SendMessageEvent(ctx, roomID, event.EventMessage, tooManyMsg)
-            return
+// sqliteStore is links.db, which build-db writes
+type sqliteStore struct {
+    *sql.DB
+}
+
+func (s sqliteStore) Rebind(query string) string {
+    return query
+}
+
+func (s sqliteStore) HasColumn(ctx context.Context, table, column string) (bool, error) {
+    var ok bool
+    err := s.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&ok)
+    return ok, err
+}
+
+func (s sqliteStore) HasTable(ctx context.Context, name string) (bool, error) {
+    var ok bool
+    err := s.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = ?)", name).Scan(&ok)
+    return ok, err
+}
+
+func (s sqliteStore) Migrate(ctx context.Context) error {
+    return migrate(ctx, s, sqliteMigrations)
+}
+
+// postgresStore is a PostgreSQL database, filled by "build-db pg"
+type postgresStore struct {
+    *sql.DB
+}
+
+func (s postgresStore) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+    return s.DB.ExecContext(ctx, s.Rebind(query), args...)
+}
+
+func (s postgresStore) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    return s.DB.QueryContext(ctx, s.Rebind(query), args...)
+}
+
+func (s postgresStore) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+    return s.DB.QueryRowContext(ctx, s.Rebind(query), args...)
+}
+
+// Rebind numbers the ? placeholders as $1, $2, ... and swaps SQLite's
+// char() for chr(). Quoted strings are left alone.
+func (s postgresStore) Rebind(query string) string {
+    var out strings.Builder
+    n := 0
+    quoted := false
+    for i := 0; i < len(query); i++ {
+        c := query[i]
+        switch {
+        case c == '\'':
+            quoted = !quoted
+        case quoted:
+        case c == '?':
+            n++
+            out.WriteString("$" + strconv.Itoa(n))
+            continue
+        case strings.HasPrefix(query[i:], "char(") && (i == 0 || !isWordByte(query[i-1])):
+            out.WriteString("chr(")
+            i += len("char(") - 1
+            continue
         }
+        out.WriteByte(c)
+    }
+    return out.String()
+}
 
-        // React with ✅️ to confirm
-        reactOk := map[string]interface{}{
-            "m.relates_to": map[string]interface{}{
-                "rel_type": "m.annotation",
-                "event_id": eventID,
-                "key":      "✅️",
-            },
+// isWordByte reports whether c can be part of an SQL identifier
+func isWordByte(c byte) bool {
+    return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (s postgresStore) HasColumn(ctx context.Context, table, column string) (bool, error) {
+    var ok bool
+    err := s.QueryRowContext(ctx,
+        "SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?)",
+        table, column).Scan(&ok)
+    return ok, err
+}
+
+func (s postgresStore) HasTable(ctx context.Context, name string) (bool, error) {
+    var ok bool
+    err := s.QueryRowContext(ctx, "SELECT to_regclass(?) IS NOT NULL", name).Scan(&ok)
+    return ok, err
+}
+
+func (s postgresStore) Migrate(ctx context.Context) error {
+    return migrate(ctx, s, postgresMigrations)
+}
+
+// sqliteMigrations create the tables the bot itself writes to. The files
+// table is owned by build-db. Only ever append: schema_migrations records
+// how many have run.
+var sqliteMigrations = []string{`
+    CREATE TABLE IF NOT EXISTS prefs (
+        user_id TEXT,
+        key TEXT,
+        value TEXT,
+        PRIMARY KEY (user_id, key)
+    );
+    CREATE TABLE IF NOT EXISTS quota (
+        user_id TEXT,
+        day TEXT,
+        rows INTEGER,
+        PRIMARY KEY (user_id, day)
+    );
+    CREATE TABLE IF NOT EXISTS seen (
+        user_id TEXT,
+        rawurl TEXT,
+        seen_at INTEGER,
+        PRIMARY KEY (user_id, rawurl)
+    );
+    CREATE TABLE IF NOT EXISTS alt_titles (
+        title TEXT,
+        file TEXT
+    );
+    CREATE INDEX IF NOT EXISTS alt_titles_file ON alt_titles(file);
+    CREATE TABLE IF NOT EXISTS query_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT,
+        room_id TEXT,
+        query TEXT,
+        results INTEGER,
+        at INTEGER
+    );
+    CREATE INDEX IF NOT EXISTS query_log_user ON query_log(user_id, id);
+    CREATE TABLE IF NOT EXISTS sync_state (
+        user_id TEXT PRIMARY KEY,
+        filter_id TEXT,
+        next_batch TEXT
+    )`,
+}
+
+// postgresMigrations are sqliteMigrations for PostgreSQL. The catalog
+// tables come from "build-db pg".
+var postgresMigrations = []string{`
+    CREATE TABLE IF NOT EXISTS prefs (
+        user_id TEXT,
+        key TEXT,
+        value TEXT,
+        PRIMARY KEY (user_id, key)
+    );
+    CREATE TABLE IF NOT EXISTS quota (
+        user_id TEXT,
+        day TEXT,
+        rows BIGINT,
+        PRIMARY KEY (user_id, day)
+    );
+    CREATE TABLE IF NOT EXISTS seen (
+        user_id TEXT,
+        rawurl TEXT,
+        seen_at BIGINT,
+        PRIMARY KEY (user_id, rawurl)
+    );
+    CREATE TABLE IF NOT EXISTS alt_titles (
+        title TEXT,
+        file TEXT
+    );
+    CREATE INDEX IF NOT EXISTS alt_titles_file ON alt_titles(file);
+    CREATE TABLE IF NOT EXISTS query_log (
+        id BIGSERIAL PRIMARY KEY,
+        user_id TEXT,
+        room_id TEXT,
+        query TEXT,
+        results BIGINT,
+        at BIGINT
+    );
+    CREATE INDEX IF NOT EXISTS query_log_user ON query_log(user_id, id);
+    CREATE TABLE IF NOT EXISTS sync_state (
+        user_id TEXT PRIMARY KEY,
+        filter_id TEXT,
+        next_batch TEXT
+    )`,
+}
+
+// migrate runs the migrations db hasn't had yet, each in a transaction
+// with its row in schema_migrations. The first ones only create missing
+// tables, so databases from before schema_migrations take them fine.
+func migrate(ctx context.Context, db Store, migrations []string) error {
+    if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+        return err
+    }
+    var done int
+    if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&done); err != nil {
+        return err
+    }
+    for version := done + 1; version <= len(migrations); version++ {
+        tx, err := db.BeginTx(ctx, nil)
+        if err != nil {
+            return err
+        }
+        if _, err := tx.ExecContext(ctx, migrations[version-1]); err != nil {
+            tx.Rollback()
+            return fmt.Errorf("migration %d: %w", version, err)
+        }
+        if _, err := tx.ExecContext(ctx, db.Rebind("INSERT INTO schema_migrations (version) VALUES (?)"), version); err != nil {
+            tx.Rollback()
+            return err
+        }
+        if err := tx.Commit(); err != nil {
+            return err
         }
-        _, _ = client.SendMessageEvent(ctx, roomID, event.EventReaction, reactOk)
-
-        // Threading logic
-        previousMsgID := eventID // Start with the user's message as the thread root
-
-	resultIndex := 1
-	for batchStart := 0; batchStart < len(results); batchStart += batchSize {
-		batchEnd := batchStart + batchSize
-		if batchEnd > len(results) {
-			batchEnd = len(results)
-		}
-		batch := results[batchStart:batchEnd]
-
-		var html strings.Builder
-		var plain strings.Builder
-		for _, row := range batch {
-			html.WriteString(fmt.Sprintf(
-				"<h4>%d. %s | %s</h4>&nbsp;&nbsp;&nbsp;&nbsp;<a href=\"%s\">%s</a><br><br>",
-				resultIndex, htmlEscape(row.Section), htmlEscape(row.Console), row.Rawurl, htmlEscape(row.File),
-			))
-			plain.WriteString(fmt.Sprintf(
-				"%d. %s | %s\n\t%s\n",
-				resultIndex, row.Section, row.Console, row.File,
-			))
-			resultIndex++
-		}
-
-		messageContent := map[string]interface{}{
-			"msgtype":        "m.text",
-			"body":           plain.String(),
-			"format":         "org.matrix.custom.html",
-			"formatted_body": html.String(),
-			"m.relates_to": map[string]interface{}{
-				"event_id":        eventID, // always the thread root (user message)
-				"is_falling_back": true,
-				"m.in_reply_to": map[string]interface{}{
-					"event_id": previousMsgID, // previous message or thread root
-				},
-				"rel_type": "m.thread",
-			},
-		}
-		resp, err := client.SendMessageEvent(ctx, roomID, event.EventMessage, messageContent)
-		if err != nil {
-			log.Printf("Failed to send HTML message: %v", err)
-			break
-		}
-		previousMsgID = resp.EventID // For next batch, reply to our last message
-                previousMsgID = eventID // no we dont.
-	}
+    }
+    return nil
+}
+
+// isCommand reports whether a message should be handled as a command. Only
+// prefix at the very start counts, and "\!roms" or "!!roms" can be used to
+// talk about a command without running it.
+func isCommand(body, prefix string) bool {
+    if !strings.HasPrefix(body, prefix) {
+        return false // also covers "\!roms" and commands mentioned mid-sentence
+    }
+    rest := body[len(prefix):]
+    return rest != "" && !strings.HasPrefix(rest, prefix)
+}
+
+// commandBody returns a message as a command in the "!roms ..." form the
+// handlers expect: with the room's prefix swapped for "!", or with a leading
+// mention of the bot dropped when mention_commands is on, so
+// "romsbot: search zelda" runs !roms zelda. ok is false for anything else.
+func (b *Bot) commandBody(roomID id.RoomID, content *event.MessageEventContent) (string, bool) {
+    cfg := b.config()
+    body := content.Body
+    prefix := cfg.prefix(roomID)
+    if isCommand(body, prefix) {
+        return "!" + body[len(prefix):], true
+    }
+    if !cfg.Bot.MentionCommands {
+        return "", false
+    }
+    rest, ok := b.stripMention(content)
+    if !ok {
+        return "", false
+    }
+    rest = strings.TrimPrefix(rest, prefix)
+    name, args, _ := strings.Cut(rest, " ")
+    if name == "search" {
+        name = "roms"
+    }
+    if _, ok := commands["!"+name]; !ok {
+        return "", false
+    }
+    return strings.TrimSpace("!" + name + " " + args), true
+}
+
+// stripMention returns the message without the mention of the bot it starts
+// with, "romsbot: ..." or "@romsbot:example.org ...". Clients put the
+// display name in the body, so a leading "name:" counts when the event
+// mentions the bot.
+func (b *Bot) stripMention(content *event.MessageEventContent) (string, bool) {
+    body := strings.TrimSpace(content.Body)
+    userID := b.client.UserID.String()
+    leading := func(name string) (string, bool) {
+        if len(body) > len(name) && strings.EqualFold(body[:len(name)], name) {
+            rest := strings.TrimLeft(body[len(name):], ":, ")
+            return rest, len(rest) < len(body)-len(name)
+        }
+        return "", false
+    }
+    if rest, ok := leading(userID); ok {
+        return rest, true
+    }
+    if content.Mentions != nil && content.Mentions.Has(b.client.UserID) {
+        if name, rest, ok := strings.Cut(body, ":"); ok && !strings.Contains(name, "!") && len(name) <= 64 {
+            return strings.TrimSpace(rest), true
+        }
+    }
+    return leading(userID[1:strings.IndexByte(userID, ':')])
+}
+
+// handleEdit re-runs a command after the user edited it. Replies attach to
+// the original message, and only the original sender's edits count.
+func (b *Bot) handleEdit(ctx context.Context, ev *event.Event, origID id.EventID, body string) {
+    orig, err := b.client.GetEvent(ctx, ev.RoomID, origID)
+    if err != nil {
+        logFor(ctx).Warn("Could not fetch edited event", "event", origID, "err", err)
+        return
+    }
+    if orig.Sender != ev.Sender {
+        return
+    }
+    logFor(ctx).Info("Re-running edited command", "room", ev.RoomID, "sender", ev.Sender, "body", body)
+    rerun := *ev
+    rerun.ID = origID
+    b.handleCommand(ctx, &rerun, body)
+}
+
+// parseQuery turns a search string into terms and options, applying the
+// sender's saved preferences (if any), the room's default filters and the
+// configured BIOS patterns. sender and roomID are empty outside Matrix.
+func (b *Bot) parseQuery(ctx context.Context, query string, sender id.UserID, roomID id.RoomID) (positives, negatives []string, atArg *string, opts searchOptions, err error) {
+    positives, negatives, atArg, groups, phrases, err := parseArgs(query)
+    if err != nil {
+        return
+    }
+    if sender != "" {
+        prefs, prefErr := b.loadPrefs(ctx, sender)
+        if prefErr != nil {
+            logFor(ctx).Warn("Could not load prefs", "err", prefErr)
+        }
+        positives = applyPrefs(positives, prefs)
+    }
+    positives, opts, err = parseOptions(positives)
+    if err != nil {
+        return
+    }
+    opts.Groups = groups
+    if err = scopeGroups(groups); err != nil {
+        return
+    }
+    negatives, opts.Excluded, err = parseExcludedScopes(negatives)
+    if err != nil {
+        return
+    }
+    positives, negatives = applyPhrases(positives, negatives, phrases, &opts)
+    if opts.Regex != nil {
+        if sender == "" || !b.isAdmin(ctx, roomID, sender) {
+            err = userErrorf("regex_admin_only")
+            return
+        }
+        // Regexes can't use the database, so something else has to bound
+        // the candidate rows
+        if len(positives) == 0 && len(opts.Scoped) == 0 && atArg == nil {
+            err = userErrorf("regex_needs_term")
+            return
+        }
+    }
+    if opts.BIOS != "" {
+        opts.BIOSPatterns = b.config().Bot.biosPatterns()
+    }
+    if opts.Verbose {
+        opts.MatchTerms = positives
+    }
+    opts.HideExtensions = b.config().Bot.HideExtensions
+    opts.AltTitles = b.altTitles
+    opts.SearchBlob = b.searchBlob
+    opts.FTS = b.fts
+    opts.LiveOnly = b.softDelete
+    opts.LinkStatus = b.linkStatus
+    opts.Dats = b.dats
+    opts.Sizes = b.sizes
+    opts.Titles = b.titles
+    opts.HasSources = b.sources
+    // Labels are only worth showing once there is more than one mirror
+    opts.ShowSource = b.sources && len(b.config().Sources) > 0
+    // added_at came with deleted_at
+    if opts.AddedDays > 0 && !b.softDelete {
+        err = userErrorf("added_unknown")
+        return
+    }
+    if (len(opts.Regions) > 0 || len(opts.Languages) > 0) && !b.regions {
+        err = userErrorf("region_unknown")
+        return
+    }
+    if len(opts.Sources) > 0 && !b.sources {
+        err = userErrorf("source_unknown")
+        return
+    }
+    if len(opts.Exts) > 0 && !b.exts {
+        err = userErrorf("ext_unknown")
+        return
+    }
+    if opts.NewOnly {
+        if sender == "" {
+            err = userErrorf("new_needs_user")
+            return
+        }
+        opts.SeenBy = sender.String()
+    }
 
+    room := b.config().room(roomID)
+    if room.Section != "" && (room.Locked || !opts.hasScope("section")) {
+        opts.Scoped = append(opts.Scoped, scopedTerm{Field: "section", Value: room.Section})
     }
+    if room.Console != "" && (room.Locked || (atArg == nil && !opts.hasScope("console"))) {
+        opts.Scoped = append(opts.Scoped, scopedTerm{Field: "console", Value: room.Console})
+    }
+    return
 }
 
+// parseArgs parses quoted, unquoted, and -negated terms. An unquoted | pipes
+// the results into further filters, "zelda | file:usa"; since every stage
+// narrows the one before, the stages are simply ANDed. Terms can be grouped
+// with parentheses and OR, "(mario OR zelda) -europe": plain terms and
+// negations at the top level come back as before, everything else as
+// groups. phrases lists the top-level terms that were quoted as a whole,
+// "link to the past" or -"the past", which should match whole words.
+func parseArgs(query string) (positives []string, negatives []string, atArg *string, groups []*queryExpr, phrases []string, err error) {
+    tokens := []string{}
+    ops := map[int]bool{}          // tokens that are (, -(, ) or OR rather than terms
+    quotedTokens := map[int]bool{} // phrases, true when a - before the quote negates them
+    curr := strings.Builder{}
+    inQuote := false
+    quoted := false                 // the current token has a quoted part, so it's never OR
+    phrase, negated := false, false // the quote opened the token, after a - if negated
+    quoteChar := byte(0)
+    stageStart := 0
+    flush := func() {
+        if curr.Len() > 0 {
+            if !quoted && curr.String() == "OR" {
+                ops[len(tokens)] = true
+            }
+            if phrase {
+                quotedTokens[len(tokens)] = negated
+            }
+            tokens = append(tokens, curr.String())
+            curr.Reset()
+        }
+        quoted = false
+        phrase, negated = false, false
+    }
+    for i := 0; i < len(query); i++ {
+        c := query[i]
+        if c == '"' || c == '\'' {
+            if inQuote && c == quoteChar {
+                flush()
+                inQuote = false
+            } else if !inQuote {
+                // A quote opened mid-token keeps its prefix, so console:"Nintendo 64"
+                // and @"Nintendo 3DS" come out as a single token. One opening
+                // the token, or right after its -, starts a phrase.
+                if curr.Len() == 0 || (curr.String() == "-" && !quoted) {
+                    phrase, negated = true, curr.Len() > 0
+                    curr.Reset()
+                }
+                inQuote = true
+                quoted = true
+                quoteChar = c
+            } else {
+                curr.WriteByte(c)
+            }
+        } else if c == ' ' && !inQuote {
+            flush()
+        } else if (c == '(' || c == ')') && !inQuote {
+            // A - right before ( negates the whole group
+            op := string(c)
+            if c == '(' && curr.String() == "-" && !quoted {
+                op = "-("
+                curr.Reset()
+            }
+            flush()
+            ops[len(tokens)] = true
+            tokens = append(tokens, op)
+        } else if c == '|' && !inQuote {
+            flush()
+            if len(tokens) == stageStart {
+                err = userErrorf("empty_stage")
+                return
+            }
+            stageStart = len(tokens)
+        } else {
+            curr.WriteByte(c)
+        }
+    }
+    flush()
+    if stageStart > 0 && len(tokens) == stageStart {
+        err = userErrorf("empty_stage")
+        return
+    }
+    if len(tokens) == 0 {
+        return
+    }
+
+    p := &exprParser{tokens: tokens, ops: ops, phrases: quotedTokens}
+    root, err := p.parseOr()
+    if err != nil {
+        return
+    }
+    if p.pos < len(tokens) {
+        err = userErrorf("unbalanced_parens") // a ) without its (
+        return
+    }
+
+    atFound := ""
+    var flatten func(e *queryExpr) error
+    flatten = func(e *queryExpr) error {
+        switch {
+        case e.Op == "and":
+            for _, item := range e.Items {
+                if err := flatten(item); err != nil {
+                    return err
+                }
+            }
+        case e.Op == "not" && e.Items[0].Op == "term":
+            negatives = append(negatives, e.Items[0].Term)
+            if e.Items[0].Phrase {
+                phrases = append(phrases, e.Items[0].Term)
+            }
+        case e.Op == "term" && strings.HasPrefix(e.Term, "@"):
+            if atFound != "" {
+                return userErrorf("at_once")
+            }
+            atFound = e.Term[1:]
+        case e.Op == "term":
+            if e.Term != "" {
+                positives = append(positives, e.Term)
+            }
+            if e.Phrase {
+                phrases = append(phrases, e.Term)
+            }
+        default:
+            groups = append(groups, e)
+        }
+        return nil
+    }
+    if err = flatten(root); err != nil {
+        return
+    }
+    if atFound != "" {
+        atArg = &atFound
+    }
+    return
+}
+
+// queryExpr is a parsed search: a term, a negation of its one item, or an
+// AND or OR of its items
+type queryExpr struct {
+    Op     string // "term", "not", "and" or "or"
+    Term   string
+    Phrase bool   // Term was quoted, so it matches whole words only
+    Field  string // the one column Term is matched against, set by scopeGroups
+    Items  []*queryExpr
+}
+
+// String writes e back the way it would be typed
+func (e *queryExpr) String() string {
+    switch e.Op {
+    case "term":
+        prefix := ""
+        if e.Field != "" {
+            prefix = e.Field + ":"
+        }
+        if e.Phrase || strings.ContainsAny(e.Term, " ()") || e.Term == "OR" {
+            return prefix + strconv.Quote(e.Term)
+        }
+        return prefix + e.Term
+    case "not":
+        return "-" + e.Items[0].String()
+    }
+    parts := make([]string, len(e.Items))
+    for i, item := range e.Items {
+        parts[i] = item.String()
+    }
+    if e.Op == "or" {
+        return "(" + strings.Join(parts, " OR ") + ")"
+    }
+    return "(" + strings.Join(parts, " ") + ")"
+}
+
+// terms counts the terms in e, for the SQL variable budget
+func (e *queryExpr) terms() int {
+    if e.Op == "term" {
+        return 1
+    }
+    n := 0
+    for _, item := range e.Items {
+        n += item.terms()
+    }
+    return n
+}
+
+// exprParser reads parseArgs' tokens with OR binding looser than the
+// implicit AND between terms:
+//
+//    or    = and { "OR" and }
+//    and   = unary { unary }
+//    unary = "(" or ")" | "-(" or ")" | term
+type exprParser struct {
+    tokens  []string
+    ops     map[int]bool
+    phrases map[int]bool // quoted tokens, true when negated
+    pos     int
+}
+
+func (p *exprParser) peekOp(op string) bool {
+    return p.pos < len(p.tokens) && p.ops[p.pos] && p.tokens[p.pos] == op
+}
+
+func (p *exprParser) parseOr() (*queryExpr, error) {
+    first, err := p.parseAnd()
+    if err != nil {
+        return nil, err
+    }
+    items := []*queryExpr{first}
+    for p.peekOp("OR") {
+        p.pos++
+        next, err := p.parseAnd()
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, next)
+    }
+    if len(items) == 1 {
+        return first, nil
+    }
+    return &queryExpr{Op: "or", Items: items}, nil
+}
+
+func (p *exprParser) parseAnd() (*queryExpr, error) {
+    var items []*queryExpr
+    for p.pos < len(p.tokens) && !p.peekOp("OR") && !p.peekOp(")") {
+        item, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, item)
+    }
+    switch len(items) {
+    case 0:
+        // "OR" at either end, two in a row, or "()"
+        return nil, userErrorf("empty_group")
+    case 1:
+        return items[0], nil
+    }
+    return &queryExpr{Op: "and", Items: items}, nil
+}
+
+func (p *exprParser) parseUnary() (*queryExpr, error) {
+    if p.peekOp("(") || p.peekOp("-(") {
+        negated := p.tokens[p.pos] == "-("
+        p.pos++
+        inner, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+        if !p.peekOp(")") {
+            return nil, userErrorf("unbalanced_parens")
+        }
+        p.pos++
+        if negated {
+            return &queryExpr{Op: "not", Items: []*queryExpr{inner}}, nil
+        }
+        return inner, nil
+    }
+    t := p.tokens[p.pos]
+    negated, phrase := p.phrases[p.pos]
+    p.pos++
+    // A phrase's - is outside its quotes, so "-x" is a term of its own
+    if phrase {
+        term := &queryExpr{Op: "term", Term: t, Phrase: true}
+        if negated {
+            return &queryExpr{Op: "not", Items: []*queryExpr{term}}, nil
+        }
+        return term, nil
+    }
+    if strings.HasPrefix(t, "-") {
+        return &queryExpr{Op: "not", Items: []*queryExpr{{Op: "term", Term: t[1:]}}}, nil
+    }
+    return &queryExpr{Op: "term", Term: t}, nil
+}
+
+// ftsGroup translates a group into one FTS5 query. It can't when a term is
+// below the trigram size or negated, as FTS5 has no standalone NOT, or a
+// phrase, as the trigrams also match inside words.
+func ftsGroup(e *queryExpr) (string, bool) {
+    switch e.Op {
+    case "term":
+        if len([]rune(e.Term)) < 3 || e.Phrase {
+            return "", false
+        }
+        return ftsQuery(e.Field, e.Term), true
+    case "not":
+        return "", false
+    }
+    parts := make([]string, len(e.Items))
+    for i, item := range e.Items {
+        part, ok := ftsGroup(item)
+        if !ok {
+            return "", false
+        }
+        parts[i] = part
+    }
+    sep := " AND "
+    if e.Op == "or" {
+        sep = " OR "
+    }
+    return "(" + strings.Join(parts, sep) + ")", true
+}
+
+// searchOptions holds the key:value modifiers given alongside search terms
+type searchOptions struct {
+    Sort     string
+    YearFrom int // 0 when no year: filter was given
+    YearTo   int
+    Group    string
+    Offset   int // rows to skip, set by paging callers rather than a modifier
+    Scoped   []scopedTerm
+    Excluded []scopedTerm // -section:/-console:/-file: terms
+    CountBy  string
+    Format   string
+    Paged    bool
+    Merge    string // "region"
+    Verbose  bool
+    Badges   bool
+    First    bool   // only the top result, as one line
+    Random   bool   // rows in random order, set by !random
+    OneGame  bool   // 1g1r:on, one preferred variant per title
+    NewOnly  bool   // skip rows SeenBy was already shown
+    SeenBy   string // filled in by parseQuery
+    BIOS     string // "only" or "exclude"
+    // Regex post-filters RegexField; admin only, see parseQuery
+    Regex      *regexp.Regexp
+    RegexField string
+    // BIOSPatterns are the file name substrings that mark BIOS/system files,
+    // filled in from the config by parseQuery
+    BIOSPatterns []string
+    // MatchTerms are the plain search terms, kept by parseQuery for
+    // verbose:on so rows can show which fields they matched
+    MatchTerms []string
+    // AltTitles also matches terms against alternate titles, set by
+    // parseQuery when the alt_titles table has rows
+    AltTitles bool
+    // SearchBlob matches plain terms against the precomputed search_blob
+    // column instead of each field, set by parseQuery when links.db has it
+    SearchBlob bool
+    // AddedDays keeps rows build-db added in the last that many days, 0 for
+    // no limit
+    AddedDays int
+    // LiveOnly leaves out rows build-db marked as removed, set by parseQuery
+    // when links.db has deleted_at
+    LiveOnly bool
+    // LinkStatus leaves out rows the link checker found dead, set by
+    // parseQuery when links.db has status
+    LinkStatus bool
+    // Dats marks rows whose file name an imported DAT lists, set by
+    // parseQuery when links.db has dat_roms
+    Dats bool
+    // FTS looks terms up in the files_fts full-text index, set by
+    // parseQuery when links.db has one
+    FTS bool
+    // HideExtensions are the file extensions left out of displayed names,
+    // filled in from the config by parseQuery
+    HideExtensions []string
+    // Sizes reads file sizes along with the rows, set by parseQuery when
+    // links.db has them
+    Sizes bool
+    // Regions and Languages keep rows tagged with any of them (lowercase),
+    // matched against the region and languages columns from build-db
+    Regions   []string
+    Languages []string
+    // Titles reads build-db's normalized title along with the rows, set by
+    // parseQuery when links.db has it
+    Titles bool
+    // Groups are the parenthesized or OR'd parts of the search, each of
+    // which must match
+    Groups []*queryExpr
+    // Sources keeps rows from these mirrors (lowercase labels)
+    Sources []string
+    // Exts keeps rows of these file types, lowercase with the dot
+    Exts []string
+    // HasSources reads the source label along with the rows, and
+    // ShowSource puts it after each result; both set by parseQuery
+    HasSources bool
+    ShowSource bool
+    // Phrases must match as whole words too, NotPhrases not at all; both
+    // filled in from the quoted terms by applyPhrases
+    Phrases    []string
+    NotPhrases []string
+}
+
+// scopeGroups resolves @console and section:/console:/file: terms inside
+// groups to their column, like parseOptions does at the top level. Other
+// options apply to the whole search, so they are turned down inside a group
+// rather than searched for as text.
+func scopeGroups(groups []*queryExpr) error {
+    var walk func(e *queryExpr) error
+    walk = func(e *queryExpr) error {
+        if e.Op != "term" {
+            for _, item := range e.Items {
+                if err := walk(item); err != nil {
+                    return err
+                }
+            }
+            return nil
+        }
+        if e.Phrase {
+            return nil
+        }
+        if strings.HasPrefix(e.Term, "@") && len(e.Term) > 1 {
+            e.Field, e.Term = "console", e.Term[1:]
+            return nil
+        }
+        rest, opts, err := parseOptions([]string{e.Term})
+        switch {
+        case err != nil:
+            return err
+        case len(rest) > 0:
+            return nil // plain text with a colon in it
+        case len(opts.Scoped) == 1:
+            e.Field, e.Term = opts.Scoped[0].Field, opts.Scoped[0].Value
+            return nil
+        }
+        key, _, _ := strings.Cut(e.Term, ":")
+        return userErrorf("option_in_group", strings.ToLower(key))
+    }
+    for _, g := range groups {
+        if err := walk(g); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// applyPhrases makes the quoted terms among positives and negatives match
+// whole words. Quoted positives are replaced by their words, whose cheaper
+// substring match (or the full-text index) narrows the rows before the
+// phrase check. Quoted negatives are taken out of negatives, which would
+// exclude them even inside other words.
+func applyPhrases(positives, negatives, phrases []string, opts *searchOptions) ([]string, []string) {
+    if len(phrases) == 0 {
+        return positives, negatives
+    }
+    quoted := map[string]bool{}
+    for _, p := range phrases {
+        quoted[p] = true
+    }
+    var terms, rest []string
+    for _, p := range positives {
+        words := phraseWords(p)
+        if !quoted[p] || len(words) == 0 {
+            terms = append(terms, p)
+            continue
+        }
+        opts.Phrases = append(opts.Phrases, p)
+        terms = append(terms, words...)
+    }
+    for _, n := range negatives {
+        if quoted[n] && len(phraseWords(n)) > 0 {
+            opts.NotPhrases = append(opts.NotPhrases, n)
+            continue
+        }
+        rest = append(rest, n)
+    }
+    return terms, rest
+}
+
+func (o searchOptions) hasScope(field string) bool {
+    for _, t := range o.Scoped {
+        if t.Field == field {
+            return true
+        }
+    }
+    return false
+}
+
+// scopedTerm is a term that only matches one column, e.g. console:"Nintendo 64"
+type scopedTerm struct {
+    Field string
+    Value string
+}
+
+// parseExcludedScopes pulls -section:x, -console:x and -file:x out of the
+// negative terms, so they only exclude matches in that column
+func parseExcludedScopes(negatives []string) (rest []string, excluded []scopedTerm, err error) {
+    for _, n := range negatives {
+        key, value, ok := strings.Cut(n, ":")
+        switch strings.ToLower(key) {
+        case "section", "console", "file":
+            if !ok {
+                break
+            }
+            if value == "" {
+                return nil, nil, userErrorf("needs_value", "-"+key, "-"+key)
+            }
+            excluded = append(excluded, scopedTerm{Field: strings.ToLower(key), Value: value})
+            continue
+        }
+        rest = append(rest, n)
+    }
+    return rest, excluded, nil
+}
+
+// parseOptions pulls key:value modifiers out of the positive terms
+func parseOptions(terms []string) (rest []string, opts searchOptions, err error) {
+    for _, t := range terms {
+        key, value, ok := strings.Cut(t, ":")
+        if !ok {
+            rest = append(rest, t)
+            continue
+        }
+        switch strings.ToLower(key) {
+        case "sort":
+            value = strings.ToLower(value)
+            if value != "name" && value != "relevance" && value != "newest" && value != "region-priority" {
+                err = userErrorf("unknown_sort", value)
+                return
+            }
+            opts.Sort = value
+        case "section", "console", "file":
+            if value == "" {
+                err = userErrorf("needs_value", key, key)
+                return
+            }
+            opts.Scoped = append(opts.Scoped, scopedTerm{Field: strings.ToLower(key), Value: value})
+        case "re":
+            // re:<regex> matches the console, re:<field>:<regex> another column
+            opts.RegexField = "console"
+            if field, pattern, ok := strings.Cut(value, ":"); ok {
+                switch strings.ToLower(field) {
+                case "section", "console", "file":
+                    opts.RegexField = strings.ToLower(field)
+                    value = pattern
+                }
+            }
+            opts.Regex, err = regexp.Compile("(?i)" + value)
+            if err != nil {
+                err = userErrorf("invalid_regex", value, err)
+                return
+            }
+        case "bios":
+            value = strings.ToLower(value)
+            if value != "only" && value != "exclude" {
+                err = userErrorf("unknown_bios", value)
+                return
+            }
+            opts.BIOS = value
+        case "format":
+            value = strings.ToLower(value)
+            if value != "list" && value != "table" && value != "names" && value != "curl" {
+                err = userErrorf("unknown_format", value)
+                return
+            }
+            opts.Format = value
+        case "page":
+            switch strings.ToLower(value) {
+            case "on":
+                opts.Paged = true
+            case "off":
+                opts.Paged = false
+            default:
+                err = userErrorf("page_usage")
+                return
+            }
+        case "new":
+            if strings.ToLower(value) != "only" {
+                err = userErrorf("new_usage")
+                return
+            }
+            opts.NewOnly = true
+        case "verbose":
+            switch strings.ToLower(value) {
+            case "on":
+                opts.Verbose = true
+            case "off":
+                opts.Verbose = false
+            default:
+                err = userErrorf("verbose_usage")
+                return
+            }
+        case "badges":
+            switch strings.ToLower(value) {
+            case "on":
+                opts.Badges = true
+            case "off":
+                opts.Badges = false
+            default:
+                err = userErrorf("badges_usage")
+                return
+            }
+        case "first":
+            switch strings.ToLower(value) {
+            case "on":
+                opts.First = true
+            case "off":
+                opts.First = false
+            default:
+                err = userErrorf("first_usage")
+                return
+            }
+        case "1g1r":
+            switch strings.ToLower(value) {
+            case "on":
+                opts.OneGame = true
+            case "off":
+                opts.OneGame = false
+            default:
+                err = userErrorf("1g1r_usage")
+                return
+            }
+        case "countby":
+            value = strings.ToLower(value)
+            if value != "console" && value != "section" {
+                err = userErrorf("unknown_countby", value)
+                return
+            }
+            opts.CountBy = value
+        case "group":
+            value = strings.ToLower(value)
+            if value != "region" {
+                err = userErrorf("unknown_group", value)
+                return
+            }
+            opts.Group = value
+        case "merge":
+            value = strings.ToLower(value)
+            if value != "region" {
+                err = userErrorf("unknown_merge", value)
+                return
+            }
+            opts.Merge = value
+        case "year":
+            opts.YearFrom, opts.YearTo, err = parseYearRange(value)
+            if err != nil {
+                return
+            }
+        case "added":
+            days, convErr := strconv.Atoi(strings.TrimSuffix(strings.ToLower(value), "d"))
+            if convErr != nil || days < 1 {
+                err = userErrorf("invalid_added", value)
+                return
+            }
+            opts.AddedDays = days
+        case "region", "lang", "source", "ext":
+            var values []string
+            for _, v := range strings.Split(strings.ToLower(value), ",") {
+                if v = strings.TrimSpace(v); v != "" {
+                    values = append(values, v)
+                }
+            }
+            if len(values) == 0 {
+                err = userErrorf("empty_filter", key)
+                return
+            }
+            switch strings.ToLower(key) {
+            case "region":
+                opts.Regions = values
+            case "lang":
+                opts.Languages = values
+            case "ext":
+                // ext:chd and ext:.chd are the same
+                for i, v := range values {
+                    values[i] = "." + strings.TrimPrefix(v, ".")
+                }
+                opts.Exts = values
+            default:
+                opts.Sources = values
+            }
+        default:
+            rest = append(rest, t)
+        }
+    }
+    return
+}
+
+// needsAllRows reports whether results are reordered, folded or paged
+// after the query, so they can't be sent as they're read
+func (o searchOptions) needsAllRows() bool {
+    return (o.Sort != "" && o.Sort != "name") || o.Group != "" || o.Merge != "" ||
+        o.Format == "names" || o.Paged || o.OneGame || o.First || o.Random
+}
+
+// parseYearRange parses "1998" or "1995-2000"
+func parseYearRange(value string) (from, to int, err error) {
+    const maxSpan = 50
+    fromStr, toStr, isRange := strings.Cut(value, "-")
+    if !isRange {
+        toStr = fromStr
+    }
+    from, err1 := strconv.Atoi(fromStr)
+    to, err2 := strconv.Atoi(toStr)
+    if err1 != nil || err2 != nil || len(fromStr) != 4 || len(toStr) != 4 {
+        return 0, 0, userErrorf("invalid_year", value)
+    }
+    if from > to {
+        from, to = to, from
+    }
+    if to-from > maxSpan {
+        return 0, 0, userErrorf("year_span", maxSpan)
+    }
+    return from, to, nil
+}
+
+var yearPattern = regexp.MustCompile(`(?:^|[^0-9])((?:19|20)[0-9]{2})(?:[^0-9]|$)`)
+
+// yearOf returns the first standalone 4-digit year in a file name
+func yearOf(file string) (int, bool) {
+    m := yearPattern.FindStringSubmatch(file)
+    if m == nil {
+        return 0, false
+    }
+    year, _ := strconv.Atoi(m[1])
+    return year, true
+}
+
+// regionsOf returns the regions listed in a file name's tags, e.g.
+// ["USA", "Europe"] for "Game (USA, Europe) (Rev 1).zip"
+func regionsOf(file string) []string {
+    for _, m := range romname.ParenPattern.FindAllStringSubmatch(file, -1) {
+        var regions []string
+        for _, part := range strings.Split(m[1], ",") {
+            part = strings.TrimSpace(part)
+            if romname.KnownRegions[part] {
+                regions = append(regions, part)
+            }
+        }
+        if len(regions) > 0 {
+            return regions
+        }
+    }
+    return nil
+}
+
+// regionFlags are the badges:on emoji for romname.KnownRegions
+var regionFlags = map[string]string{
+    "USA": "🇺🇸", "Europe": "🇪🇺", "Japan": "🇯🇵", "World": "🌐", "Asia": "🌏",
+    "Australia": "🇦🇺", "Brazil": "🇧🇷", "Canada": "🇨🇦", "China": "🇨🇳",
+    "France": "🇫🇷", "Germany": "🇩🇪", "Hong Kong": "🇭🇰", "Italy": "🇮🇹",
+    "Korea": "🇰🇷", "Netherlands": "🇳🇱", "Russia": "🇷🇺", "Scandinavia": "🇸🇪🇳🇴🇩🇰",
+    "Spain": "🇪🇸", "Sweden": "🇸🇪", "Taiwan": "🇹🇼", "UK": "🇬🇧",
+}
+
+// languagesOf returns the languages listed in a file name's tags, e.g.
+// ["En", "Fr"] for "Game (Europe) (En,Fr).zip"
+func languagesOf(file string) []string {
+    for _, m := range romname.ParenPattern.FindAllStringSubmatch(file, -1) {
+        parts := strings.Split(m[1], ",")
+        all := true
+        for i, part := range parts {
+            parts[i] = strings.TrimSpace(part)
+            if !romname.LanguagePattern.MatchString(parts[i]) {
+                all = false
+                break
+            }
+        }
+        if all {
+            return parts
+        }
+    }
+    return nil
+}
+
+// badges is the badges:on prefix for a file: a flag per region and the
+// languages in brackets, e.g. "🇪🇺 [EN/FR]". Empty when there are no tags.
+func badges(file string) string {
+    var parts []string
+    flags := ""
+    for _, r := range regionsOf(file) {
+        flags += regionFlags[r]
+    }
+    if flags != "" {
+        parts = append(parts, flags)
+    }
+    if langs := languagesOf(file); len(langs) > 0 {
+        parts = append(parts, "["+strings.ToUpper(strings.Join(langs, "/"))+"]")
+    }
+    return strings.Join(parts, " ")
+}
+
+// regionGroups is the display order for group:region
+var regionGroups = []string{"USA", "Europe", "Japan", "Other"}
+
+// regionGroup buckets a file into one of regionGroups
+func regionGroup(file string) string {
+    named := regionGroups[:len(regionGroups)-1]
+    if rank := regionRank(file, named); rank < len(named) {
+        return named[rank]
+    }
+    return "Other"
+}
+
+// regionRank is the index in priority of the best listed region in a file
+// name. Files with regions that aren't listed rank len(priority), files
+// without any region len(priority)+1.
+func regionRank(file string, priority []string) int {
+    regions := regionsOf(file)
+    if len(regions) == 0 {
+        return len(priority) + 1
+    }
+    for i, p := range priority {
+        for _, r := range regions {
+            if strings.EqualFold(r, p) {
+                return i
+            }
+        }
+    }
+    return len(priority)
+}
+
+// sortByRegionPriority orders results by regionRank, keeping the existing
+// (alphabetical) order among equally ranked files
+func sortByRegionPriority(results []resultRow, priority []string) {
+    sort.SliceStable(results, func(i, j int) bool {
+        return regionRank(results[i].File, priority) < regionRank(results[j].File, priority)
+    })
+}
+
+// sortByRegionGroup orders results by regionGroups, keeping the existing
+// order within each group
+func sortByRegionGroup(results []resultRow) {
+    rank := map[string]int{}
+    for i, g := range regionGroups {
+        rank[g] = i
+    }
+    sort.SliceStable(results, func(i, j int) bool {
+        return rank[regionGroup(results[i].File)] < rank[regionGroup(results[j].File)]
+    })
+}
+
+var (
+    datePattern    = regexp.MustCompile(`(?:^|[^0-9])((?:19|20)[0-9]{2})-?(0[1-9]|1[0-2])-?(0[1-9]|[12][0-9]|3[01])(?:[^0-9]|$)`)
+    versionPattern = regexp.MustCompile(`(?i)\((?:v|rev |version )([0-9]+(?:\.[0-9]+)*)[a-z]?\)`)
+)
+
+// dateKey returns a sortable date for a file name: YYYY-MM-DD from a full
+// date like the (1996-02-19) or (19910128) of prototypes, or YYYY-00-00 from
+// the first year in the name, so a lone year sorts after that year's full
+// dates. It's a heuristic: a year may be part of the title, as in
+// "FIFA Soccer 2005", and most final releases carry no date at all.
+func dateKey(s string) (string, bool) {
+    if m := datePattern.FindStringSubmatch(s); m != nil {
+        return m[1] + "-" + m[2] + "-" + m[3], true
+    }
+    if year, ok := yearOf(s); ok {
+        return fmt.Sprintf("%d-00-00", year), true
+    }
+    return "", false
+}
+
+// versionOf returns the numbers of a (v1.2) / (Rev 3) tag, or nil
+func versionOf(s string) []int {
+    m := versionPattern.FindStringSubmatch(s)
+    if m == nil {
+        return nil
+    }
+    var parts []int
+    for _, p := range strings.Split(m[1], ".") {
+        n, _ := strconv.Atoi(p)
+        parts = append(parts, n)
+    }
+    return parts
+}
+
+// compareVersions orders version numbers like 1.2 < 1.10
+func compareVersions(a, b []int) int {
+    for i := 0; i < len(a) && i < len(b); i++ {
+        if a[i] != b[i] {
+            return a[i] - b[i]
+        }
+    }
+    return len(a) - len(b)
+}
+
+// sortByNewest puts the latest dated files first, using versions to break
+// ties. Files without a date go last in their existing order.
+func sortByNewest(results []resultRow) {
+    sort.SliceStable(results, func(i, j int) bool {
+        di, iok := dateKey(results[i].File)
+        dj, jok := dateKey(results[j].File)
+        if iok != jok {
+            return iok
+        }
+        if di != dj {
+            return di > dj
+        }
+        return compareVersions(versionOf(results[i].File), versionOf(results[j].File)) > 0
+    })
+}
+
+const (
+    // maxSuggestions is how many titles a search without results suggests
+    maxSuggestions = 3
+    // suggestCandidates bounds the rows ranked in Go for suggestions
+    suggestCandidates = 200
+    // maxSuggestTrigrams bounds the LIKEs in the suggestion query
+    maxSuggestTrigrams = 40
+)
+
+// trigrams returns the distinct three letter pieces of each word in s
+func trigrams(s string) []string {
+    seen := map[string]bool{}
+    var out []string
+    for _, word := range strings.Fields(strings.ToLower(s)) {
+        runes := []rune(word)
+        for i := 0; i+3 <= len(runes); i++ {
+            t := string(runes[i : i+3])
+            if !seen[t] {
+                seen[t] = true
+                out = append(out, t)
+            }
+        }
+    }
+    return out
+}
+
+// trigramSimilarity is the share of trigrams a and b have in common
+func trigramSimilarity(a, b []string) float64 {
+    if len(a) == 0 || len(b) == 0 {
+        return 0
+    }
+    in := map[string]bool{}
+    for _, t := range a {
+        in[t] = true
+    }
+    common := 0
+    for _, t := range b {
+        if in[t] {
+            common++
+        }
+    }
+    return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// suggestTitles finds up to maxSuggestions titles close to the search terms,
+// for searches that matched nothing. Candidates are the files sharing the
+// most trigrams with the terms; a title must share at least half of them.
+// With the full-text index only files sharing one of the trigrams are
+// counted, without it every row is, so it runs under query_timeout.
+func (b *Bot) suggestTitles(ctx context.Context, positives []string, atArg *string) ([]string, error) {
+    query := strings.Join(positives, " ")
+    grams := trigrams(query)
+    if len(grams) == 0 {
+        return nil, nil
+    }
+    if len(grams) > maxSuggestTrigrams {
+        grams = grams[:maxSuggestTrigrams]
+    }
+    hits := make([]string, len(grams))
+    args := []interface{}{}
+    for i, t := range grams {
+        hits[i] = "(CASE WHEN LOWER(file) LIKE ? THEN 1 ELSE 0 END)"
+        args = append(args, "%"+t+"%")
+    }
+    sqlQuery := "SELECT DISTINCT file, " + strings.Join(hits, " + ") + " AS hits FROM files WHERE " + b.live()
+    if atArg != nil {
+        sqlQuery += " AND LOWER(console) LIKE ?"
+        args = append(args, "%"+strings.ToLower(*atArg)+"%")
+    }
+    if b.fts {
+        quoted := make([]string, len(grams))
+        for i, t := range grams {
+            quoted[i] = ftsQuery("", t)
+        }
+        sqlQuery += " AND files.rowid IN (SELECT rowid FROM files_fts WHERE files_fts MATCH ?)"
+        args = append(args, "file : ("+strings.Join(quoted, " OR ")+")")
+    }
+    sqlQuery = "SELECT file, hits FROM (" + sqlQuery + ") AS candidates WHERE hits * 2 >= ? ORDER BY hits DESC LIMIT ?"
+    args = append(args, len(grams), suggestCandidates)
+
+    ctx, cancel := b.queryContext(ctx)
+    defer cancel()
+    rows, err := b.db.QueryContext(ctx, sqlQuery, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    type candidate struct {
+        title string
+        hits  int
+        score float64
+    }
+    var candidates []candidate
+    seen := map[string]bool{}
+    for rows.Next() {
+        var file string
+        var n int
+        if err := rows.Scan(&file, &n); err != nil {
+            return nil, err
+        }
+        title := romname.BaseTitle(file)
+        if seen[strings.ToLower(title)] {
+            continue
+        }
+        seen[strings.ToLower(title)] = true
+        candidates = append(candidates, candidate{title, n, trigramSimilarity(grams, trigrams(title))})
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    // Closest overall first, so short titles beat long ones that merely
+    // contain the same pieces
+    sort.SliceStable(candidates, func(i, j int) bool {
+        if candidates[i].score != candidates[j].score {
+            return candidates[i].score > candidates[j].score
+        }
+        return candidates[i].hits > candidates[j].hits
+    })
+    var titles []string
+    for _, c := range candidates {
+        if len(titles) == maxSuggestions {
+            break
+        }
+        titles = append(titles, c.title)
+    }
+    return titles, nil
+}
+
+// relevance ranks how well a file name matches the search terms: exact title
+// matches first, then prefix matches, then substring matches, then rows that
+// only matched through their section or console
+func relevance(file string, positives []string) int {
+    query := strings.ToLower(strings.Join(positives, " "))
+    title := strings.ToLower(romname.BaseTitle(file))
+    switch {
+    case query == "":
+        return 0
+    case title == query:
+        return 0
+    case strings.HasPrefix(title, query):
+        return 1
+    case strings.Contains(strings.ToLower(file), query):
+        return 2
+    }
+    return 3
+}
+
+// sortByRelevance reorders results by match quality, keeping the existing
+// order within each rank
+func sortByRelevance(results []resultRow, positives []string) {
+    sort.SliceStable(results, func(i, j int) bool {
+        return relevance(results[i].File, positives) < relevance(results[j].File, positives)
+    })
+}
+
+// maxSQLVariables is SQLite's historical default limit on bound parameters
+// (SQLITE_MAX_VARIABLE_NUMBER). Newer builds allow more, but stay under it.
+const maxSQLVariables = 999
+
+var errTooManyTerms = userErrorf("too_many_terms")
+
+// ftsQuery quotes term as an FTS5 string, which the trigram index matches
+// as a substring, optionally limited to one column
+func ftsQuery(column, term string) string {
+    q := `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+    if column != "" {
+        q = column + " : " + q
+    }
+    return q
+}
+
+// wordSeparators are what names put between words besides spaces. Phrases
+// are matched with all of them turned into spaces.
+var wordSeparators = []string{"(", ")", "[", "]", ",", ".", "_", "-", "!", "?", ":", ";", "+", "&", "/", "'"}
+
+// wordsSQL wraps a lowercase SQL string expression so its words are
+// separated by single spaces, with one at either end as well
+func wordsSQL(expr string) string {
+    for _, sep := range wordSeparators {
+        expr = "REPLACE(" + expr + ", '" + strings.ReplaceAll(sep, "'", "''") + "', ' ')"
+    }
+    // Separators often come in runs, like ") - (", three passes squeeze up
+    // to eight spaces into one
+    for i := 0; i < 3; i++ {
+        expr = "REPLACE(" + expr + ", '  ', ' ')"
+    }
+    return "(' ' || " + expr + " || ' ')"
+}
+
+// phraseWords splits phrase into its words the way wordsSQL does
+func phraseWords(phrase string) []string {
+    for _, sep := range wordSeparators {
+        phrase = strings.ReplaceAll(phrase, sep, " ")
+    }
+    return strings.Fields(phrase)
+}
+
+// phraseLike is the LIKE pattern matching phrase as whole words in wordsSQL
+func phraseLike(phrase string) string {
+    return "% " + strings.ToLower(strings.Join(phraseWords(phrase), " ")) + " %"
+}
+
+// buildWhereClause returns the " WHERE ..." filter shared by the search and
+// count queries, or "" when there is nothing to filter on
+func buildWhereClause(positives, negatives []string, atArg *string, opts searchOptions) (string, []interface{}) {
+    where := []string{}
+    args := []interface{}{}
+
+    // The full-text index finds terms of three or more characters without
+    // scanning the table; shorter ones are below its trigram size and keep
+    // using LIKE. Terms go into one MATCH where possible, so the index
+    // intersects them instead of SQLite building a rowid set per term.
+    const ftsLookup = "files.rowid IN (SELECT rowid FROM files_fts WHERE files_fts MATCH ?)"
+    useFTS := func(term string) bool {
+        return opts.FTS && len([]rune(term)) >= 3
+    }
+    var ftsTerms []string
+
+    // @ argument: restrict to console only
+    if atArg != nil {
+        w := "LOWER(console) LIKE ?"
+        val := "%" + strings.ToLower(*atArg) + "%"
+        if useFTS(*atArg) {
+            ftsTerms = append(ftsTerms, ftsQuery("console", *atArg))
+        } else {
+            where = append(where, w)
+            args = append(args, val)
+        }
+    }
+
+    // Matching each field separately costs three variables per term. If that
+    // would go over the limit, match the fields joined into one string
+    // instead (char(31) keeps terms from matching across field boundaries).
+    groupTerms := 0
+    for _, g := range opts.Groups {
+        groupTerms += g.terms()
+    }
+    compact := 4*(len(positives)+groupTerms+len(opts.Phrases)+len(opts.NotPhrases))+4*len(negatives)+2*len(opts.Scoped)+2*len(opts.Excluded)+(opts.YearTo-opts.YearFrom+1)+3 > maxSQLVariables
+    joinedFields := "LOWER(section || char(31) || console || char(31) || file)"
+    // build-db keeps that same string precomputed in search_blob, so when
+    // it's there a single LIKE per term is all it takes
+    if opts.SearchBlob {
+        joinedFields = "search_blob"
+    }
+    // A file also matches through any of its alternate titles
+    const altTitle = "EXISTS (SELECT 1 FROM alt_titles WHERE alt_titles.file = files.file AND LOWER(alt_titles.title) LIKE ?)"
+
+    // A phrase has to be whole words of one of the fields. Unlike terms it
+    // checks each field even in compact mode, or it could span two of them.
+    phraseSQL := func(phrase string) string {
+        val := phraseLike(phrase)
+        cond := "(" + wordsSQL("LOWER(section)") + " LIKE ? OR " + wordsSQL("LOWER(console)") + " LIKE ? OR " + wordsSQL("LOWER(file)") + " LIKE ?"
+        args = append(args, val, val, val)
+        if opts.AltTitles {
+            cond += " OR EXISTS (SELECT 1 FROM alt_titles WHERE alt_titles.file = files.file AND " + wordsSQL("LOWER(alt_titles.title)") + " LIKE ?)"
+            args = append(args, val)
+        }
+        return cond + ")"
+    }
+
+    // Each positive: must appear in at least one of the fields
+    for _, p := range positives {
+        val := "%" + strings.ToLower(p) + "%"
+        if useFTS(p) {
+            if opts.AltTitles {
+                where = append(where, "("+ftsLookup+" OR "+altTitle+")")
+                args = append(args, ftsQuery("", p), val)
+                continue
+            }
+            ftsTerms = append(ftsTerms, ftsQuery("", p))
+            continue
+        }
+        if (compact || opts.SearchBlob) && opts.AltTitles {
+            where = append(where, "("+joinedFields+" LIKE ? OR "+altTitle+")")
+            args = append(args, val, val)
+            continue
+        }
+        if compact || opts.SearchBlob {
+            where = append(where, joinedFields+" LIKE ?")
+            args = append(args, val)
+            continue
+        }
+        if opts.AltTitles {
+            where = append(where, "(LOWER(section) LIKE ? OR LOWER(console) LIKE ? OR LOWER(file) LIKE ? OR "+altTitle+")")
+            args = append(args, val, val, val, val)
+            continue
+        }
+        w := "(LOWER(section) LIKE ? OR LOWER(console) LIKE ? OR LOWER(file) LIKE ?)"
+        where = append(where, w)
+        args = append(args, val, val, val)
+    }
+
+    // Each scoped term: must appear in its own column. Field comes from the
+    // fixed set accepted by parseOptions, so it is safe to splice in.
+    for _, t := range opts.Scoped {
+        val := "%" + strings.ToLower(t.Value) + "%"
+        if useFTS(t.Value) {
+            if t.Field == "file" && opts.AltTitles {
+                where = append(where, "("+ftsLookup+" OR "+altTitle+")")
+                args = append(args, ftsQuery(t.Field, t.Value), val)
+                continue
+            }
+            ftsTerms = append(ftsTerms, ftsQuery(t.Field, t.Value))
+            continue
+        }
+        if t.Field == "file" && opts.AltTitles {
+            where = append(where, "(LOWER(file) LIKE ? OR "+altTitle+")")
+            args = append(args, val, val)
+            continue
+        }
+        where = append(where, "LOWER("+t.Field+") LIKE ?")
+        args = append(args, val)
+    }
+
+    if len(ftsTerms) > 0 {
+        where = append(where, ftsLookup)
+        args = append(args, strings.Join(ftsTerms, " AND "))
+    }
+
+    // Quoted terms: the positives above found their words anywhere, these
+    // keep the rows where they are whole words in that order
+    for _, p := range opts.Phrases {
+        where = append(where, phraseSQL(p))
+    }
+    for _, p := range opts.NotPhrases {
+        where = append(where, "NOT "+phraseSQL(p))
+    }
+
+    // Each group: one condition built from its terms, matched like
+    // positives. The full-text index takes whole groups it can answer.
+    var groupSQL func(e *queryExpr) string
+    groupSQL = func(e *queryExpr) string {
+        switch e.Op {
+        case "term":
+            if e.Phrase {
+                return phraseSQL(e.Term)
+            }
+            val := "%" + strings.ToLower(e.Term) + "%"
+            // Field comes from the fixed set parseOptions accepts
+            if e.Field != "" {
+                if e.Field == "file" && opts.AltTitles {
+                    args = append(args, val, val)
+                    return "(LOWER(file) LIKE ? OR " + altTitle + ")"
+                }
+                args = append(args, val)
+                return "LOWER(" + e.Field + ") LIKE ?"
+            }
+            cond, n := "(LOWER(section) LIKE ? OR LOWER(console) LIKE ? OR LOWER(file) LIKE ?)", 3
+            if compact || opts.SearchBlob {
+                cond, n = joinedFields+" LIKE ?", 1
+            }
+            if opts.AltTitles {
+                cond, n = "("+cond+" OR "+altTitle+")", n+1
+            }
+            for i := 0; i < n; i++ {
+                args = append(args, val)
+            }
+            return cond
+        case "not":
+            return "NOT " + groupSQL(e.Items[0])
+        }
+        parts := make([]string, len(e.Items))
+        for i, item := range e.Items {
+            parts[i] = groupSQL(item)
+        }
+        if e.Op == "or" {
+            return "(" + strings.Join(parts, " OR ") + ")"
+        }
+        return "(" + strings.Join(parts, " AND ") + ")"
+    }
+    for _, g := range opts.Groups {
+        if opts.FTS && !opts.AltTitles {
+            if q, ok := ftsGroup(g); ok {
+                where = append(where, ftsLookup)
+                args = append(args, q)
+                continue
+            }
+        }
+        where = append(where, groupSQL(g))
+    }
+
+    // Each negative: must NOT appear in any of the fields, nor in an
+    // alternate title, since a positive would have matched that too
+    for _, n := range negatives {
+        val := "%" + strings.ToLower(n) + "%"
+        w := "(LOWER(section) NOT LIKE ? AND LOWER(console) NOT LIKE ? AND LOWER(file) NOT LIKE ?)"
+        vals := []interface{}{val, val, val}
+        if compact || opts.SearchBlob {
+            w, vals = joinedFields+" NOT LIKE ?", vals[:1]
+        }
+        if opts.AltTitles {
+            w, vals = "("+w+" AND NOT "+altTitle+")", append(vals, val)
+        }
+        where = append(where, w)
+        args = append(args, vals...)
+    }
+
+    // Each excluded scoped term: must NOT appear in its own column, for
+    // -file:x nor in an alternate title
+    for _, t := range opts.Excluded {
+        val := "%" + strings.ToLower(t.Value) + "%"
+        if t.Field == "file" && opts.AltTitles {
+            where = append(where, "(LOWER(file) NOT LIKE ? AND NOT "+altTitle+")")
+            args = append(args, val, val)
+            continue
+        }
+        where = append(where, "LOWER("+t.Field+") NOT LIKE ?")
+        args = append(args, val)
+    }
+
+    // Year filter: narrow candidates in SQL, yearOf does the exact check later
+    if opts.YearFrom != 0 {
+        years := []string{}
+        for y := opts.YearFrom; y <= opts.YearTo; y++ {
+            years = append(years, "file LIKE ?")
+            args = append(args, fmt.Sprintf("%%%d%%", y))
+        }
+        where = append(where, "("+strings.Join(years, " OR ")+")")
+    }
+
+    // BIOS filter: any of the patterns marks a BIOS/system file
+    if opts.BIOS != "" && len(opts.BIOSPatterns) > 0 {
+        conds := []string{}
+        for _, pat := range opts.BIOSPatterns {
+            if opts.BIOS == "only" {
+                conds = append(conds, "LOWER(file) LIKE ?")
+            } else {
+                conds = append(conds, "LOWER(file) NOT LIKE ?")
+            }
+            args = append(args, "%"+strings.ToLower(pat)+"%")
+        }
+        if opts.BIOS == "only" {
+            where = append(where, "("+strings.Join(conds, " OR ")+")")
+        } else {
+            where = append(where, "("+strings.Join(conds, " AND ")+")")
+        }
+    }
+
+    // Rows removed from the mirror stay in links.db, marked
+    if opts.LiveOnly {
+        where = append(where, "deleted_at IS NULL")
+    }
+    if opts.LinkStatus {
+        where = append(where, "COALESCE(status, '') <> 'dead'")
+    }
+    if opts.AddedDays > 0 {
+        where = append(where, "added_at >= ?")
+        args = append(args, time.Now().AddDate(0, 0, -opts.AddedDays).Unix())
+    }
+    // region and languages are comma-separated lists like "USA,Europe", so
+    // wrap them in commas to match whole entries
+    for _, filter := range []struct {
+        column string
+        values []string
+    }{{"region", opts.Regions}, {"languages", opts.Languages}} {
+        if len(filter.values) == 0 {
+            continue
+        }
+        var conds []string
+        for _, v := range filter.values {
+            conds = append(conds, "',' || LOWER("+filter.column+") || ',' LIKE ?")
+            args = append(args, "%,"+v+",%")
+        }
+        where = append(where, "("+strings.Join(conds, " OR ")+")")
+    }
+    for _, filter := range []struct {
+        column string
+        values []string
+    }{{"source", opts.Sources}, {"ext", opts.Exts}} {
+        if len(filter.values) == 0 {
+            continue
+        }
+        var conds []string
+        for _, v := range filter.values {
+            conds = append(conds, "LOWER("+filter.column+") = ?")
+            args = append(args, v)
+        }
+        where = append(where, "("+strings.Join(conds, " OR ")+")")
+    }
+
+    // Only rows the user hasn't been shown yet
+    if opts.NewOnly {
+        where = append(where, "NOT EXISTS (SELECT 1 FROM seen WHERE seen.user_id = ? AND seen.rawurl = files.rawurl)")
+        args = append(args, opts.SeenBy)
+    }
+
+    if len(where) == 0 {
+        return "", args
+    }
+    return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func buildSQLQuery(positives, negatives []string, atArg *string, opts searchOptions, maxResults int) (string, []interface{}) {
+    where, args := buildWhereClause(positives, negatives, atArg, opts)
+    size := "0"
+    if opts.Sizes {
+        size = "COALESCE(size, 0)"
+    }
+    title := "''"
+    if opts.Titles {
+        title = "COALESCE(title, '')"
+    }
+    inDat := "0"
+    if opts.Dats {
+        inDat = "EXISTS (SELECT 1 FROM dat_roms WHERE dat_roms.file = files.file AND dat_roms.console IN ('', files.console))"
+    }
+    source := "''"
+    if opts.HasSources {
+        source = "COALESCE(source, '')"
+    }
+    sql := "SELECT section, console, file, rawurl, " + size + ", " + title + ", " + inDat + ", " + source + " FROM files" + where
+    switch query := strings.ToLower(strings.Join(positives, " ")); {
+    case opts.Random:
+        sql += " ORDER BY RANDOM() LIMIT ? OFFSET ?"
+    case opts.Sort == "relevance" && query != "":
+        // Roughly what relevance ranks, so the best matches are among the
+        // rows read: names starting with the query, then containing it,
+        // shortest first
+        sql += " ORDER BY CASE WHEN LOWER(file) LIKE ? THEN 0 WHEN LOWER(file) LIKE ? THEN 1 ELSE 2 END, LENGTH(file), section, console, file LIMIT ? OFFSET ?"
+        args = append(args, query+"%", "%"+query+"%")
+    default:
+        sql += " ORDER BY section, console, file LIMIT ? OFFSET ?"
+    }
+    args = append(args, maxResults+1, opts.Offset) // +1 for over-limit check
+    return sql, args
+}
+
+// buildCountQuery counts the rows matching the same filter as buildSQLQuery.
+// Post-filters such as year: are only approximated by their SQL narrowing.
+func buildCountQuery(positives, negatives []string, atArg *string, opts searchOptions) (string, []interface{}) {
+    where, args := buildWhereClause(positives, negatives, atArg, opts)
+    return "SELECT COUNT(*) FROM files" + where, args
+}
+
+
+type resultRow struct {
+    Section string `json:"section"`
+    Console string `json:"console"`
+    File    string `json:"file"`
+    Rawurl  string `json:"url"`
+    Size    int64  `json:"size,omitempty"` // bytes, 0 when unknown
+    Title   string `json:"-"`              // normalized title from build-db, if any
+    // InDat is set when an imported No-Intro/Redump DAT lists a file of
+    // this name. Only the name is matched, not the size or checksums.
+    InDat bool `json:"in_dat,omitempty"`
+    // Source is the label of the mirror the link is on, e.g. "myrient"
+    Source string `json:"source,omitempty"`
+    // Links holds the region variants of a merge:region row, whose File is
+    // then the bare title
+    Links []regionLink `json:"links,omitempty"`
+}
+
+type regionLink struct {
+    Label string `json:"label"`
+    URL   string `json:"url"`
+}
+
+// field returns the named column, defaulting to the file name
+func (r resultRow) field(name string) string {
+    switch name {
+    case "section":
+        return r.Section
+    case "console":
+        return r.Console
+    }
+    return r.File
+}
+
+// Bounds for searches whose rows are filtered after the query, see eachResult
+const (
+    maxPostFilterCandidates = 50000
+    postFilterTimeout       = 10 * time.Second
+)
+
+// search runs the query and returns up to maxResults+1 rows, so callers can
+// tell when the limit was exceeded
+func (b *Bot) search(ctx context.Context, positives, negatives []string, atArg *string, opts searchOptions, maxResults int) ([]resultRow, error) {
+    var results []resultRow
+    _, err := b.eachResult(ctx, positives, negatives, atArg, opts, maxResults, func(r resultRow) error {
+        results = append(results, r)
+        return nil
+    })
+    return results, err
+}
+
+// eachResult runs the query and hands fn up to maxResults+1 rows as they
+// are read, stopping early if fn returns an error. It returns how many
+// rows fn got.
+func (b *Bot) eachResult(ctx context.Context, positives, negatives []string, atArg *string, opts searchOptions, maxResults int, fn func(resultRow) error) (int, error) {
+    started := time.Now()
+    // query_timeout only runs while the database is read, not while fn
+    // sends what was read, so the timer is paused around fn
+    budget := b.config().Bot.queryTimeout()
+    ctx, cancelQuery := context.WithCancelCause(ctx)
+    defer cancelQuery(nil)
+    timer := time.AfterFunc(budget, func() { cancelQuery(context.DeadlineExceeded) })
+    defer timer.Stop()
+    reading := time.Now()
+    timedOut := func(err error) error {
+        if err != nil && context.Cause(ctx) == context.DeadlineExceeded {
+            return context.DeadlineExceeded
+        }
+        return err
+    }
+    // A regex or year: can't narrow the SQL query enough, and the rows
+    // they drop would otherwise use up the LIMIT, so scan a bounded number
+    // of candidates under a timeout instead. The offset then counts
+    // matching rows, so it is skipped here rather than in SQL.
+    limit, skip := maxResults, 0
+    if opts.Regex != nil || opts.YearFrom != 0 {
+        limit, skip = maxPostFilterCandidates, opts.Offset
+        opts.Offset = 0
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, postFilterTimeout)
+        defer cancel()
+    }
+    sqlQuery, args := buildSQLQuery(positives, negatives, atArg, opts, limit)
+    if len(args) > maxSQLVariables {
+        return 0, errTooManyTerms
+    }
+    rows, err := b.db.QueryContext(ctx, sqlQuery, args...)
+    if err != nil {
+        return 0, timedOut(err)
+    }
+    defer rows.Close()
+
+    n := 0
+    for rows.Next() {
+        var r resultRow
+        if err := rows.Scan(&r.Section, &r.Console, &r.File, &r.Rawurl, &r.Size, &r.Title, &r.InDat, &r.Source); err != nil {
+            continue
+        }
+        if opts.YearFrom != 0 {
+            // Files without a year are left out of year-filtered searches
+            year, ok := yearOf(r.File)
+            if !ok || year < opts.YearFrom || year > opts.YearTo {
+                continue
+            }
+        }
+        if opts.Regex != nil && !opts.Regex.MatchString(r.field(opts.RegexField)) {
+            continue
+        }
+        if skip > 0 {
+            skip--
+            continue
+        }
+        paused := timer.Stop()
+        budget -= time.Since(reading)
+        if err := fn(r); err != nil {
+            return n, err
+        }
+        if paused {
+            timer.Reset(budget)
+            reading = time.Now()
+        }
+        n++
+        if n > maxResults {
+            break // enough to know the limit was exceeded
+        }
+    }
+    elapsed := time.Since(started)
+    metrics.search(n, elapsed)
+    logFor(ctx).Info("Search", "terms", positives, "excluded", negatives,
+        "results", n, "duration", elapsed.Round(time.Millisecond))
+    return n, timedOut(rows.Err())
+}
+
+type groupCount struct {
+    Name  string
+    Count int
+}
+
+// countBy returns the number of matching rows per console or section,
+// largest first. field must be "console" or "section".
+func (b *Bot) countBy(ctx context.Context, field string, positives, negatives []string, atArg *string, opts searchOptions) ([]groupCount, error) {
+    where, args := buildWhereClause(positives, negatives, atArg, opts)
+    if len(args) > maxSQLVariables {
+        return nil, errTooManyTerms
+    }
+    sqlQuery := "SELECT " + field + ", COUNT(*) FROM files" + where +
+        " GROUP BY " + field + " ORDER BY COUNT(*) DESC, " + field
+    ctx, cancel := b.queryContext(ctx)
+    defer cancel()
+    rows, err := b.db.QueryContext(ctx, sqlQuery, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var counts []groupCount
+    for rows.Next() {
+        var c groupCount
+        if err := rows.Scan(&c.Name, &c.Count); err != nil {
+            return nil, err
+        }
+        counts = append(counts, c)
+    }
+    return counts, rows.Err()
+}
+
+// sendCounts replies with a per-group breakdown as produced by countBy,
+// followed by note unless it's empty
+func (b *Bot) sendCounts(ctx context.Context, roomID id.RoomID, eventID id.EventID, field string, counts []groupCount, note string) {
+    const maxGroups = 50
+
+    title := b.msg(roomID, "matches_per", field)
+    total := 0
+    for _, c := range counts {
+        total += c.Count
+    }
+    var html strings.Builder
+    var plain strings.Builder
+    html.WriteString("<b>" + htmlEscape(title) + "</b> " + b.msg(roomID, "n_matches", total) + "<ul>")
+    plain.WriteString(title + " " + b.msg(roomID, "n_matches", total) + "\n")
+    for i, c := range counts {
+        if i == maxGroups {
+            more := b.msg(roomID, "and_more", len(counts)-maxGroups)
+            html.WriteString("<li><i>" + more + "</i></li>")
+            plain.WriteString(more + "\n")
+            break
+        }
+        html.WriteString(fmt.Sprintf("<li>%s: %d</li>", htmlEscape(c.Name), c.Count))
+        plain.WriteString(fmt.Sprintf("%s: %d\n", c.Name, c.Count))
+    }
+    html.WriteString("</ul>")
+    if note != "" {
+        html.WriteString(htmlEscape(note))
+        plain.WriteString(note)
+    }
+
+    msg := map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain.String(),
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html.String(),
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": eventID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, msg); err != nil {
+        logFor(ctx).Error("Failed to send counts", "err", err)
+    }
+}
+
+// count returns the number of rows matching the query
+func (b *Bot) count(ctx context.Context, positives, negatives []string, atArg *string, opts searchOptions) (int, error) {
+    sqlQuery, args := buildCountQuery(positives, negatives, atArg, opts)
+    if len(args) > maxSQLVariables {
+        return 0, errTooManyTerms
+    }
+    ctx, cancel := b.queryContext(ctx)
+    defer cancel()
+    var n int
+    err := b.db.QueryRowContext(ctx, sqlQuery, args...).Scan(&n)
+    return n, err
+}
+
+// queryContext is ctx limited to bot.query_timeout
+func (b *Bot) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    return context.WithTimeout(ctx, b.config().Bot.queryTimeout())
+}
+
+func htmlEscape(s string) string {
+    replacer := strings.NewReplacer(
+        "&", "&amp;",
+        "<", "&lt;",
+        ">", "&gt;",
+        "\"", "&quot;",
+        "'", "&#39;",
+    )
+    return replacer.Replace(s)
+}
+
+
+// command is one entry of the command registry. handleCommand only answers
+// registered names, and !help lists them in this order with their usage and
+// the "cmd_" message for the name as description.
+type command struct {
+    name  string
+    args  string
+    admin bool
+}
+
+var commandList = []command{
+    {"!roms", "[what to search] [@console] [-exclude] [options]", false},
+    {"!count", "<query>", false},
+    {"!queue", "title one, title two, ...", false},
+    {"!expand", "", false},
+    {"!more", "", false},
+    {"!random", "[query]", false},
+    {"!get", "<file name | result number>", false},
+    {"!consoles", "[query]", false},
+    {"!sections", "", false},
+    {"!browse", "[section]", false},
+    {"!stats", "", false},
+    {"!parse", "<query>", false},
+    {"!verify", "<url>", false},
+    {"!history", "[n]", false},
+    {"!seen", "clear", false},
+    {"!pref", "set <option> <value> | show | clear [option]", false},
+    {"!help", "", false},
+    {"!jobs", "", true},
+    {"!cancel", "<job id>", true},
+    {"!cache", "stats | clear", true},
+    {"!dump", "", true},
+}
+
+// commands indexes commandList by name; anything else starting with ! is
+// left alone, it may be meant for another bot
+var commands = func() map[string]command {
+    m := make(map[string]command, len(commandList))
+    for _, c := range commandList {
+        m[c.name] = c
+    }
+    return m
+}()
+
+func (b *Bot) handleCommand(ctx context.Context, ev *event.Event, body string) {
+    client := b.client
+    roomID := ev.RoomID
+    eventID := ev.ID
+
+    cmd := strings.Fields(body)
+    if len(cmd) == 0 {
+        return
+    }
+    if _, ok := commands[cmd[0]]; !ok {
+        return
+    }
+    ctx = withLog(ctx, "room", roomID, "sender", ev.Sender, "command", cmd[0])
+    metrics.command(cmd[0])
+    defer func(started time.Time) {
+        logFor(ctx).Debug("Command done", "duration", time.Since(started).Round(time.Millisecond))
+    }(time.Now())
+    if b.throttled(ctx, roomID, ev.Sender, eventID) {
+        return
+    }
+    switch cmd[0] {
+
+    //Help Message
+    case "!help":
+        b.react(ctx, roomID, eventID, "ℹ️")
+        b.handleHelp(ctx, ev)
+        return
+
+    //List running searches (admin)
+    case "!jobs":
+        if !b.isAdmin(ctx, roomID, ev.Sender) {
+            return
+        }
+        running := b.jobs.list()
+        if len(running) == 0 {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "no_jobs"))
+            return
+        }
+        var lines []string
+        for _, j := range running {
+            lines = append(lines, fmt.Sprintf("#%d %s %q (%s)",
+                j.id, j.sender, j.query, time.Since(j.started).Round(time.Millisecond)))
+        }
+        b.sendReply(ctx, roomID, eventID, strings.Join(lines, "\n"))
+        return
+
+    //Cancel a running search (admin)
+    case "!cancel":
+        if !b.isAdmin(ctx, roomID, ev.Sender) {
+            return
+        }
+        if len(cmd) != 2 {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "usage_cancel"))
+            return
+        }
+        jobID, err := strconv.Atoi(strings.TrimPrefix(cmd[1], "#"))
+        if err != nil {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "usage_cancel"))
+            return
+        }
+        if !b.jobs.cancel(jobID) {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "no_such_job", jobID))
+            return
+        }
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "job_cancelled", jobID))
+        return
+
+    //Cache sizes and hit rates, or drop them (admin)
+    case "!cache":
+        if !b.isAdmin(ctx, roomID, ev.Sender) {
+            return
+        }
+        b.handleCache(ctx, ev, cmd[1:])
+        return
+
+    //List or re-run the sender's recent searches
+    case "!history":
+        b.handleHistory(ctx, ev, cmd[1:])
+        return
+
+    //Show how a query is understood, without searching
+    case "!parse":
+        b.handleParse(ctx, ev, strings.TrimSpace(body[len("!parse"):]))
+        return
+
+    //Next rows of a listing cut short by more_after
+    case "!more":
+        b.handleMore(ctx, ev)
+        return
+
+    //How many rows a search matches, before listing them
+    case "!count":
+        b.handleCount(ctx, ev, strings.TrimSpace(body[len("!count"):]))
+        return
+
+    //Which consoles have matches for a search
+    case "!consoles":
+        b.handleConsoles(ctx, ev, strings.TrimSpace(body[len("!consoles"):]))
+        return
+
+    //Catalog totals
+    case "!stats":
+        b.handleStats(ctx, ev)
+        return
+
+    //One random match
+    case "!random":
+        b.handleRandom(ctx, ev, strings.TrimSpace(body[len("!random"):]))
+        return
+
+    //Download a file and post it to the room
+    case "!get":
+        b.handleGet(ctx, ev, strings.TrimSpace(body[len("!get"):]))
+        return
+
+    //Sections with their file and console counts
+    case "!sections":
+        b.handleSections(ctx, ev)
+        return
+
+    //Sections and the consoles under each
+    case "!browse":
+        b.handleBrowse(ctx, ev, strings.Join(cmd[1:], " "))
+        return
+
+    //Upload the whole catalog as a gzipped CSV (admin)
+    case "!dump":
+        if !b.isAdmin(ctx, roomID, ev.Sender) {
+            return
+        }
+        b.dumpCatalog(ctx, roomID, eventID)
+        return
+
+    //Per-user default search options
+    case "!pref":
+        b.handlePref(ctx, ev, cmd[1:])
+        return
+
+    //Forget which results the sender has seen (for new:only)
+    case "!seen":
+        b.handleSeen(ctx, ev, cmd[1:])
+        return
+
+    //Check whether a URL is in the catalog
+    case "!verify":
+        if len(cmd) != 2 {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "usage_verify"))
+            return
+        }
+        b.verifyURL(ctx, ev, cmd[1])
+        return
+
+    //Search several titles at once
+    case "!queue":
+        const maxTitles = 10
+        const perTitle = 3
+
+        var titles []string
+        for _, t := range strings.FieldsFunc(body[len("!queue"):], func(r rune) bool {
+            return r == '\n' || r == ','
+        }) {
+            if t = strings.TrimSpace(t); t != "" {
+                titles = append(titles, t)
+            }
+        }
+        if len(titles) == 0 {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "usage_queue"))
+            return
+        }
+        if len(titles) > maxTitles {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "too_many_titles", len(titles), maxTitles))
+            return
+        }
+        logFor(ctx).Info("Query", "titles", titles)
+
+        var html strings.Builder
+        var plain strings.Builder
+        for _, title := range titles {
+            html.WriteString("<b>" + htmlEscape(title) + "</b><br>")
+            plain.WriteString(title + "\n")
+
+            positives, negatives, atArg, groups, phrases, parseErr := parseArgs(title)
+            if parseErr != nil {
+                html.WriteString("&nbsp;&nbsp;" + htmlEscape(b.errorText(roomID, parseErr)) + "<br>")
+                plain.WriteString("  " + b.errorText(roomID, parseErr) + "\n")
+                continue
+            }
+            if parseErr = scopeGroups(groups); parseErr != nil {
+                html.WriteString("&nbsp;&nbsp;" + htmlEscape(b.errorText(roomID, parseErr)) + "<br>")
+                plain.WriteString("  " + b.errorText(roomID, parseErr) + "\n")
+                continue
+            }
+            opts := searchOptions{Groups: groups}
+            positives, negatives = applyPhrases(positives, negatives, phrases, &opts)
+            results, err := b.search(ctx, positives, negatives, atArg, opts, perTitle)
+            if err != nil {
+                html.WriteString("&nbsp;&nbsp;" + b.msg(roomID, "queue_error") + "<br>")
+                plain.WriteString("  " + b.msg(roomID, "queue_error") + "\n")
+                logFor(ctx).Error("!queue search error", "title", title, "err", err)
+                continue
+            }
+            if len(results) == 0 {
+                html.WriteString("&nbsp;&nbsp;" + b.msg(roomID, "queue_not_found") + "<br>")
+                plain.WriteString("  " + b.msg(roomID, "queue_not_found") + "\n")
+                continue
+            }
+            more := len(results) > perTitle
+            if more {
+                results = results[:perTitle]
+            }
+            for _, row := range results {
+                file := displayName(row.File, b.config().Bot.HideExtensions)
+                html.WriteString(fmt.Sprintf(
+                    "&nbsp;&nbsp;%s | <a href=\"%s\">%s</a><br>",
+                    htmlEscape(row.Console), row.Rawurl, htmlEscape(file),
+                ))
+                plain.WriteString(fmt.Sprintf("  %s | %s\n", row.Console, file))
+            }
+            if more {
+                html.WriteString("&nbsp;&nbsp;<i>" + b.msg(roomID, "queue_more") + "</i><br>")
+                plain.WriteString("  " + b.msg(roomID, "queue_more") + "\n")
+            }
+        }
+
+        queueMsg := map[string]interface{}{
+            "msgtype":        "m.text",
+            "body":           plain.String(),
+            "format":         "org.matrix.custom.html",
+            "formatted_body": html.String(),
+            "m.relates_to": map[string]interface{}{
+                "m.in_reply_to": map[string]interface{}{
+                    "event_id": eventID,
+                },
+            },
+        }
+        if _, err := client.SendMessageEvent(ctx, roomID, event.EventMessage, queueMsg); err != nil {
+            logFor(ctx).Error("Failed to send !queue results", "err", err)
+        }
+        return
+
+    //List the first page of the sender's last rejected search
+    case "!expand":
+        query, ok := b.rejected.take(roomID, ev.Sender)
+        if !ok {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "nothing_to_expand"))
+            return
+        }
+        b.runRoms(ctx, ev, query, true)
+
+    //Search roms
+    case "!roms":
+        b.runRoms(ctx, ev, strings.TrimSpace(body[len("!roms"):]), false)
+    }
+}
+
+// runCounts answers a search with its number of matches per opts.CountBy
+func (b *Bot) runCounts(ctx context.Context, ev *event.Event, positives, negatives []string, atArg *string, opts searchOptions) {
+    counts, err := b.countBy(ctx, opts.CountBy, positives, negatives, atArg, opts)
+    if err != nil {
+        b.searchFailed(ctx, ev.RoomID, ev.ID, err)
+        return
+    }
+    if len(counts) == 0 {
+        b.react(ctx, ev.RoomID, ev.ID, "❌️")
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "no_results"))
+        return
+    }
+    b.react(ctx, ev.RoomID, ev.ID, "✅️")
+    b.sendCounts(ctx, ev.RoomID, ev.ID, opts.CountBy, counts, "")
+}
+
+// handleConsoles implements !consoles <query>: which consoles have matches,
+// and how many, using the same filters as !roms. Without a query it lists
+// every console in the catalog, grouped by section.
+func (b *Bot) handleConsoles(ctx context.Context, ev *event.Event, query string) {
+    if query == "" {
+        b.handleBrowse(ctx, ev, "")
+        return
+    }
+    positives, negatives, atArg, opts, err := b.parseQuery(ctx, query, ev.Sender, ev.RoomID)
+    if err != nil {
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.errorText(ev.RoomID, err))
+        return
+    }
+    opts.CountBy = "console"
+    b.runCounts(ctx, ev, positives, negatives, atArg, opts)
+}
+
+// handleCount implements !count <query>: how many rows the same !roms search
+// would match, per console, without reading them. The note says whether
+// !roms would list them all.
+func (b *Bot) handleCount(ctx context.Context, ev *event.Event, query string) {
+    roomID := ev.RoomID
+    if query == "" {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "usage_count"))
+        return
+    }
+    positives, negatives, atArg, opts, err := b.parseQuery(ctx, query, ev.Sender, roomID)
+    if err != nil {
+        b.sendReply(ctx, roomID, ev.ID, b.errorText(roomID, err))
+        return
+    }
+    total, err := b.count(ctx, positives, negatives, atArg, opts)
+    if err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    if total == 0 {
+        b.react(ctx, roomID, ev.ID, "❌️")
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "no_results"))
+        return
+    }
+    counts, err := b.countBy(ctx, "console", positives, negatives, atArg, opts)
+    if err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    // year: and regex: are only checked on the rows read, so the count
+    // can only be an upper bound
+    maxResults := b.config().Bot.maxResults()
+    resultCap := b.config().Bot.ResultCap
+    note := b.msg(roomID, "count_fits", maxResults)
+    switch {
+    case opts.YearFrom != 0 || opts.Regex != nil:
+        note = b.msg(roomID, "count_upper_bound")
+    case resultCap > 0 && total > resultCap:
+        note = b.msg(roomID, "count_capped", resultCap)
+    case total > maxResults:
+        note = b.msg(roomID, "count_too_many", maxResults)
+    }
+    b.react(ctx, roomID, ev.ID, "✅️")
+    b.sendCounts(ctx, roomID, ev.ID, "console", counts, note)
+}
+
+// runRoms runs a !roms search and posts the results. With expand set, a
+// search that would be rejected as too broad lists its first page instead.
+func (b *Bot) runRoms(ctx context.Context, ev *event.Event, query string, expand bool) {
+    const tableBatchSize = 50
+    batchSize := 100
+    maxResults := b.config().Bot.maxResults()
+    resultCap := b.config().Bot.ResultCap
+    if expand && (resultCap == 0 || resultCap > batchSize) {
+        resultCap = batchSize
+    }
+
+    client := b.client
+    roomID := ev.RoomID
+    eventID := ev.ID
+
+    logFor(ctx).Info("Query", "query", query)
+
+    positives, negatives, atArg, opts, parseErr := b.parseQuery(ctx, query, ev.Sender, ev.RoomID)
+    if parseErr != nil {
+        // reply to Matrix and return
+       client.SendText(ctx, roomID, b.errorText(roomID, parseErr))
+       return
+    }
+    // Summary mode: counts per console/section instead of the rows
+    if opts.CountBy != "" {
+        b.runCounts(ctx, ev, positives, negatives, atArg, opts)
+        return
+    }
+
+    // Daily row quota against bulk scraping, admins are exempt
+    quota := b.config().Bot.DailyQuota
+    if quota > 0 && !b.isAdmin(ctx, roomID, ev.Sender) {
+        used, err := b.quotaUsed(ctx, ev.Sender)
+        if err != nil {
+            logFor(ctx).Warn("Could not read quota", "err", err)
+        } else if used >= quota {
+            b.react(ctx, roomID, eventID, "⏳")
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "quota_reached", quota))
+            return
+        }
+    }
+
+    jobCtx, job := b.jobs.start(ctx, ev.Sender, query)
+    // With a result cap we list the first rows instead of rejecting
+    fetchLimit := maxResults
+    if resultCap > 0 && !opts.First {
+        fetchLimit = resultCap
+    }
+    // "I'm feeling lucky": the best match unless a sort was asked for.
+    // SQL puts it first, so one row will do unless year: or regex: drop
+    // rows after the query.
+    if opts.First && opts.Sort == "" {
+        opts.Sort = "relevance"
+    }
+    if opts.First && opts.YearFrom == 0 && opts.Regex == nil {
+        fetchLimit = 0
+    }
+    searchFailed := func(err error) {
+        if errors.Is(err, context.Canceled) {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "search_cancelled"))
+            return
+        }
+        b.searchFailed(ctx, roomID, eventID, err)
+    }
+
+    // Count first, so searches over the limit are turned down without
+    // reading their rows. year: and regex: drop rows after the query,
+    // which makes the count only an upper bound, so those read the rows.
+    total := -1
+    if opts.YearFrom == 0 && opts.Regex == nil {
+        n, err := b.count(jobCtx, positives, negatives, atArg, opts)
+        if err != nil {
+            b.jobs.finish(job)
+            searchFailed(err)
+            return
+        }
+        total = n
+    }
+
+    // Tables are much more verbose, so send fewer rows per message
+    if opts.Format == "table" {
+        batchSize = tableBatchSize
+    }
+    // Big listings go to the paste service when one is configured
+    paste := b.config().Paste
+    minPaste := paste.MinResults
+    if minPaste <= 0 {
+        minPaste = batchSize + 1
+    }
+
+    // Rows are sent as they're read unless something needs all of them
+    // first: a sort or grouping SQL doesn't do, paging or a paste
+    stream := total >= 0 && !opts.needsAllRows() && (paste.URL == "" || total < minPaste)
+    var results []resultRow
+    n := total
+    if !stream {
+        var err error
+        results, err = b.search(jobCtx, positives, negatives, atArg, opts, fetchLimit)
+        b.jobs.finish(job)
+        if err != nil {
+            searchFailed(err)
+            return
+        }
+        n = len(results)
+    }
+    if err := b.logQuery(ctx, ev.Sender, roomID, query, n); err != nil {
+        logFor(ctx).Warn("Could not log query", "err", err)
+    }
+    // 1g1r thins out the rows, but whether there were too many is still
+    // decided on what the search matched
+    read := n
+    if total > read {
+        read = total
+    }
+    if opts.OneGame {
+        results = oneGameOneROM(results, b.config().Bot.regionPriority())
+        n = len(results)
+    }
+
+    // SQL already sorts by section, console and file
+    if opts.Sort == "relevance" {
+        sortByRelevance(results, positives)
+    }
+    if opts.Sort == "newest" {
+        sortByNewest(results)
+    }
+    if opts.Sort == "region-priority" {
+        sortByRegionPriority(results, b.config().Bot.regionPriority())
+    }
+    if opts.Group == "region" {
+        sortByRegionGroup(results)
+    }
+
+    // No results: react with ❌️ and notify, including the number of results
+    if n < 1 {
+        if stream {
+            b.jobs.finish(job)
+        }
+        b.react(ctx, roomID, eventID, "❌️")
+        text := b.msg(roomID, "no_results")
+        // Point at near misses, e.g. a typo in the title
+        suggestions, err := b.suggestTitles(ctx, positives, atArg)
+        if err != nil {
+            logFor(ctx).Warn("Could not look for suggestions", "err", err)
+        }
+        if len(suggestions) > 0 {
+            text += "\n" + b.msg(roomID, "did_you_mean", strings.Join(suggestions, ", "))
+        }
+        tooManyMsg := map[string]interface{}{
+            "msgtype": "m.text",
+            "body":    text,
+            "m.relates_to": map[string]interface{}{
+                "m.in_reply_to": map[string]interface{}{
+                    "event_id": eventID,
+                },
+            },
+        }
+        _, _ = client.SendMessageEvent(ctx, roomID, event.EventMessage, tooManyMsg)
+
+        // Admins can have the mirror checked for entries the index is missing
+        if b.config().Bot.UpstreamCheck && b.isAdmin(ctx, roomID, ev.Sender) {
+            b.checkUpstream(ctx, roomID, eventID, positives, negatives, atArg)
+        }
+        return
+    }
+
+    if opts.First {
+        b.listed.set(roomID, ev.Sender, results[:1])
+        b.sendFirst(ctx, ev, results, total, positives, negatives, atArg, opts)
+        return
+    }
+
+    // Capped: keep the first rows and tell the user how many there were
+    if resultCap > 0 && read > resultCap {
+        if !stream && len(results) > resultCap {
+            results = results[:resultCap]
+        }
+        n = min(n, resultCap)
+        if total < 0 {
+            var err error
+            if total, err = b.count(ctx, positives, negatives, atArg, opts); err != nil {
+                logFor(ctx).Warn("Could not count results", "err", err)
+            }
+        }
+        if total < 0 {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "showing_first", resultCap))
+        } else {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "showing_first_of", resultCap, total))
+        }
+    }
+
+    // Too many results: react with ❌️ and notify, including the number of
+    // results. A result cap lists the first rows instead, even above
+    // max_results.
+    if resultCap == 0 && read > maxResults {
+        if stream {
+            b.jobs.finish(job)
+        }
+        b.rejected.remember(roomID, ev.Sender, query)
+        b.react(ctx, roomID, eventID, "❌️")
+        // Repeat offenders get one hint, then only the reaction
+        text := b.msg(roomID, "too_many_results", read, batchSize)
+        switch strikes := b.rejected.strike(ev.Sender); {
+        case strikes == rejectionHintAt:
+            text = b.msg(roomID, "too_broad_hint")
+        case strikes > rejectionHintAt:
+            return
+        }
+        tooManyMsg := map[string]interface{}{
+            "msgtype": "m.text",
+            "body":    text,
+            "m.relates_to": map[string]interface{}{
+                "m.in_reply_to": map[string]interface{}{
+                    "event_id": eventID,
+                },
+            },
+        }
+        _, _ = client.SendMessageEvent(ctx, roomID, event.EventMessage, tooManyMsg)
+        return
+    }
+
+    // React with ✅️ to confirm
+    b.react(ctx, roomID, eventID, "✅️")
+
+    if quota > 0 && !b.isAdmin(ctx, roomID, ev.Sender) {
+        if err := b.addQuotaUsed(ctx, ev.Sender, n); err != nil {
+            logFor(ctx).Warn("Could not update quota", "err", err)
+        }
+    }
+
+    // Threading logic: small result sets go straight into the room as a
+    // reply, larger ones into a thread to keep the room readable
+    inThread := n > b.config().Bot.ThreadThreshold
+
+    if !stream {
+        // Remember what was shown for new:only, including paged results
+        // the user may not have paged through
+        if err := b.markSeen(ctx, ev.Sender, results); err != nil {
+            logFor(ctx).Warn("Could not record seen results", "err", err)
+        }
+
+        // One row per title, with a link per region variant
+        if opts.Merge == "region" {
+            results = mergeRegions(results)
+        }
+
+        // Names only: the same file in several consoles/sections is listed once
+        if opts.Format == "names" {
+            results = uniqueFiles(results)
+        }
+        n = len(results)
+
+        // Numbered as listed, for !get <number>
+        b.listed.set(roomID, ev.Sender, results)
+
+        // One message edited in place as the user pages with reactions
+        if opts.Paged {
+            b.sendPaged(ctx, roomID, eventID, ev.Sender, results, opts)
+            return
+        }
+
+        // Big listings go to the paste service, falling back to batches if
+        // the upload fails
+        if paste.URL != "" && n >= minPaste {
+            plain, _ := renderRows(results, 1, opts, b.config().language(roomID))
+            link, err := b.uploadPaste(ctx, paste, plain)
+            if err == nil {
+                b.sendReply(ctx, roomID, eventID, b.msg(roomID, "pasted", n, link))
+                return
+            }
+            logFor(ctx).Warn("Paste upload failed, sending batches instead", "err", err)
+        }
+    }
+
+    // Listings can go to another room, under a header linking back to the
+    // search; the header then takes the place of the user's message
+    outRoom, rootID := roomID, eventID
+    if out := b.config().room(roomID).OutputRoom; out != "" && id.RoomID(out) != roomID {
+        header, err := b.postResultsHeader(ctx, id.RoomID(out), ev, query)
+        if err != nil {
+            logFor(ctx).Warn("Could not post to output room, answering inline", "output_room", out, "err", err)
+        } else {
+            outRoom, rootID = id.RoomID(out), header
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "results_posted", n, outRoom.EventURI(header).MatrixToURL()))
+        }
+    }
+
+    relation := func() map[string]interface{} {
+        if !inThread {
+            return map[string]interface{}{
+                "m.in_reply_to": map[string]interface{}{
+                    "event_id": rootID,
+                },
+            }
+        }
+        return map[string]interface{}{
+            "event_id":        rootID, // always the thread root (user message or header)
+            "is_falling_back": true,
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": rootID, // for clients without threads
+            },
+            "rel_type": "m.thread",
+        }
+    }
+
+    // Long listings stop after more_after rows, !more posts the rest
+    shown := n
+    if after := b.config().Bot.moreAfter(); after > 0 && n > after {
+        shown = after
+    }
+    lang := b.config().language(roomID)
+    if stream {
+        // Each batch goes out as soon as its rows are read; the rest are
+        // kept for !more, !get and new:only
+        send := b.newBatchSender(outRoom, 1, batchSize, opts, lang, relation)
+        _, err := b.eachResult(jobCtx, positives, negatives, atArg, opts, n-1, func(r resultRow) error {
+            results = append(results, r)
+            if len(results) > shown {
+                return nil
+            }
+            return send.add(ctx, r)
+        })
+        // Rows read before a timeout or !cancel still go out, so the
+        // listing doesn't stop in the middle of a batch
+        if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+            if flushErr := send.flush(ctx); err == nil {
+                err = flushErr
+            } else if flushErr != nil {
+                logFor(ctx).Error("Failed to send results", "err", flushErr)
+            }
+        }
+        b.jobs.finish(job)
+        if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+            searchFailed(err)
+            return
+        }
+        if err != nil {
+            logFor(ctx).Error("Failed to stream results", "err", err)
+            return
+        }
+        // The count can go stale while the rows are read
+        n = len(results)
+        if shown > n {
+            shown = n
+        }
+        if err := b.markSeen(ctx, ev.Sender, results); err != nil {
+            logFor(ctx).Warn("Could not record seen results", "err", err)
+        }
+        b.listed.set(roomID, ev.Sender, results)
+    } else if err := b.sendBatches(ctx, outRoom, results[:shown], 1, batchSize, opts, lang, relation); err != nil {
+        logFor(ctx).Error("Failed to send HTML message", "err", err)
+        return
+    }
+    if left := n - shown; left > 0 {
+        b.more.set(roomID, ev.Sender, &moreCursor{
+            results:   results,
+            next:      shown,
+            opts:      opts,
+            batchSize: batchSize,
+            outRoom:   outRoom,
+            lang:      lang,
+            relation:  relation,
+        })
+        b.sendMoreHint(ctx, outRoom, roomID, left, relation)
+    }
+
+    // Recap of what the listing covered
+    if b.config().Bot.ResultStats {
+        consoles, sections := distinctScopes(results)
+        _, err := client.SendMessageEvent(ctx, outRoom, event.EventMessage, map[string]interface{}{
+            "msgtype":      "m.notice",
+            "body":         b.msg(roomID, "result_stats", n, consoles, sections),
+            "m.relates_to": relation(),
+        })
+        if err != nil {
+            logFor(ctx).Error("Failed to send result stats", "err", err)
+        }
+    }
+}
+
+// sendBatches posts rows batchSize at a time, numbered from index, each
+// message related to the search by relation
+func (b *Bot) sendBatches(ctx context.Context, roomID id.RoomID, rows []resultRow, index, batchSize int, opts searchOptions, lang string, relation func() map[string]interface{}) error {
+    s := b.newBatchSender(roomID, index, batchSize, opts, lang, relation)
+    s.pending = rows
+    return s.flush(ctx)
+}
+
+// batchSender posts rows batchSize at a time as they are added, so a
+// listing can go out while its rows are still being read
+type batchSender struct {
+    b         *Bot
+    roomID    id.RoomID
+    index     int // the number the next row is listed with
+    batchSize int
+    opts      searchOptions
+    lang      string
+    relation  func() map[string]interface{}
+    pending   []resultRow
+}
+
+func (b *Bot) newBatchSender(roomID id.RoomID, index, batchSize int, opts searchOptions, lang string, relation func() map[string]interface{}) *batchSender {
+    return &batchSender{b: b, roomID: roomID, index: index, batchSize: batchSize, opts: opts, lang: lang, relation: relation}
+}
+
+// add queues a row, sending a message once there is a batch's worth
+func (s *batchSender) add(ctx context.Context, row resultRow) error {
+    s.pending = append(s.pending, row)
+    if len(s.pending) < s.batchSize {
+        return nil
+    }
+    return s.send(ctx)
+}
+
+// flush sends whatever is still queued
+func (s *batchSender) flush(ctx context.Context) error {
+    for len(s.pending) > 0 {
+        if err := s.send(ctx); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// send posts one message of up to batchSize queued rows
+func (s *batchSender) send(ctx context.Context) error {
+    rows := s.pending
+    if len(rows) > s.batchSize {
+        rows = rows[:s.batchSize]
+    }
+    // Rows that would make the message too big move on to the next one
+    plain, html, fit := renderFitting(rows, s.index, s.opts, s.lang)
+    batch := sentBatch{rows: rows[:fit], index: s.index, lang: s.lang, relation: s.relation, roomID: s.roomID}
+    resp, err := s.b.client.SendMessageEvent(ctx, s.roomID, event.EventMessage, map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html,
+        "m.relates_to":   s.relation(),
+    })
+    if err != nil {
+        return err
+    }
+    s.b.batches.add(resp.EventID, batch)
+    s.pending = s.pending[fit:]
+    s.index += fit
+    return nil
+}
+
+// batchIndex remembers which rows went into each listing message, so a
+// number reacted or replied to one of them can be looked up
+type batchIndex struct {
+    mu      sync.Mutex
+    batches map[id.EventID]sentBatch
+}
+
+type sentBatch struct {
+    rows     []resultRow
+    index    int // the number rows[0] was listed with
+    lang     string
+    relation func() map[string]interface{}
+    roomID   id.RoomID // where the listing was sent
+    created  time.Time
+}
+
+func newBatchIndex() *batchIndex {
+    return &batchIndex{batches: map[id.EventID]sentBatch{}}
+}
+
+func (x *batchIndex) add(eventID id.EventID, batch sentBatch) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    for k, old := range x.batches {
+        if time.Since(old.created) > pageTTL {
+            delete(x.batches, k)
+        }
+    }
+    batch.created = time.Now()
+    x.batches[eventID] = batch
+}
+
+// get returns the batch sent as eventID
+func (x *batchIndex) get(eventID id.EventID) (sentBatch, bool) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    batch, ok := x.batches[eventID]
+    if !ok || time.Since(batch.created) > pageTTL {
+        return sentBatch{}, false
+    }
+    return batch, true
+}
+
+// resultNumber reads a result number from a reaction or reply: 7, #7, a
+// keycap emoji such as 7️⃣, or 🔟
+func resultNumber(s string) (int, bool) {
+    s = strings.TrimSpace(s)
+    if s == "🔟" {
+        return 10, true
+    }
+    s = strings.TrimPrefix(s, "#")
+    s = strings.TrimSuffix(strings.TrimSuffix(s, "\u20e3"), "\ufe0f")
+    n, err := strconv.Atoi(s)
+    return n, err == nil && n > 0
+}
+
+// showCard answers a number picked from listing message batchID with the
+// details of that row. replyTo is the user's reply, or the listing itself
+// for reactions. Numbers go on across a search's messages and reactions
+// only go up to 🔟, so a number the message doesn't list gets a hint with
+// the ones it does instead. Listings sent to another room are ignored.
+func (b *Bot) showCard(ctx context.Context, roomID id.RoomID, batchID id.EventID, n int, replyTo id.EventID) {
+    batch, ok := b.batches.get(batchID)
+    if !ok || len(batch.rows) == 0 || batch.roomID != roomID {
+        return
+    }
+    var plain, html string
+    if last := batch.index + len(batch.rows) - 1; n < batch.index || n > last {
+        plain = translate(batch.lang, "not_in_batch", n, batch.index, last)
+        html = htmlEscape(plain)
+    } else {
+        row := batch.rows[n-batch.index]
+        var roms []datRom
+        if b.dats {
+            var err error
+            if roms, err = b.datRoms(ctx, row.Console, row.File); err != nil {
+                logFor(ctx).Warn("Could not look up checksums", "file", row.File, "err", err)
+            }
+        }
+        plain, html = resultCard(row, roms, batch.lang)
+    }
+
+    relation := batch.relation()
+    relation["m.in_reply_to"] = map[string]interface{}{"event_id": replyTo}
+    if relation["rel_type"] == "m.thread" {
+        relation["is_falling_back"] = false
+    }
+    _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, map[string]interface{}{
+        "msgtype":        "m.notice",
+        "body":           plain,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html,
+        "m.relates_to":   relation,
+    })
+    if err != nil {
+        logFor(ctx).Error("Failed to send result card", "err", err)
+    }
+}
+
+// datMark follows files whose name an imported DAT lists. It doesn't
+// vouch for the file itself, only sizes and checksums could.
+const datMark = "📋"
+
+// datRom is a rom of a file's set in an imported DAT
+type datRom struct {
+    Game, Rom, CRC32, MD5, SHA1, Dat string
+}
+
+// datRoms returns what the imported DATs list for file in console
+func (b *Bot) datRoms(ctx context.Context, console, file string) ([]datRom, error) {
+    rows, err := b.db.QueryContext(ctx, "SELECT game, rom, crc32, md5, sha1, dat FROM dat_roms WHERE file = ? AND console IN ('', ?) ORDER BY dat, rom", file, console)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var roms []datRom
+    for rows.Next() {
+        var r datRom
+        if err := rows.Scan(&r.Game, &r.Rom, &r.CRC32, &r.MD5, &r.SHA1, &r.Dat); err != nil {
+            return nil, err
+        }
+        roms = append(roms, r)
+    }
+    return roms, rows.Err()
+}
+
+// resultCard renders one row in full: name, section, console, size, every
+// link and, when a DAT lists it, its canonical name and checksums
+func resultCard(row resultRow, roms []datRom, lang string) (string, string) {
+    var plain, html strings.Builder
+    plain.WriteString(row.File + "\n")
+    html.WriteString("<b>" + htmlEscape(row.File) + "</b><br>")
+    field := func(key, value string) {
+        plain.WriteString(translate(lang, key) + ": " + value + "\n")
+        html.WriteString(htmlEscape(translate(lang, key)) + ": " + htmlEscape(value) + "<br>")
+    }
+    field("col_section", row.Section)
+    field("col_console", row.Console)
+    if row.Size > 0 {
+        field("col_size", humanSize(row.Size))
+    }
+    if row.Source != "" {
+        field("col_source", row.Source)
+    }
+    links := row.Links
+    if len(links) == 0 {
+        links = []regionLink{{URL: row.Rawurl}}
+    }
+    for _, l := range links {
+        label := translate(lang, "col_link")
+        if l.Label != "" {
+            label += " (" + l.Label + ")"
+        }
+        plain.WriteString(label + ": " + l.URL + "\n")
+        html.WriteString(fmt.Sprintf("%s: <a href=\"%s\">%s</a><br>", htmlEscape(label), htmlEscape(l.URL), htmlEscape(l.URL)))
+    }
+    if len(roms) > 0 {
+        field("col_dat", roms[0].Dat)
+        field("col_game", roms[0].Game)
+    }
+    for _, r := range roms {
+        line := fmt.Sprintf("%s  CRC32 %s  MD5 %s  SHA1 %s", r.Rom, r.CRC32, r.MD5, r.SHA1)
+        plain.WriteString(line + "\n")
+        html.WriteString("<code>" + htmlEscape(line) + "</code><br>")
+    }
+    return plain.String(), html.String()
+}
+
+// sendMoreHint tells the user how many rows !more has left. msgRoom picks
+// the language, the hint itself goes to roomID with the listing.
+func (b *Bot) sendMoreHint(ctx context.Context, roomID, msgRoom id.RoomID, left int, relation func() map[string]interface{}) {
+    _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, map[string]interface{}{
+        "msgtype":      "m.notice",
+        "body":         b.msg(msgRoom, "more_left", left),
+        "m.relates_to": relation(),
+    })
+    if err != nil {
+        logFor(ctx).Error("Failed to send !more hint", "err", err)
+    }
+}
+
+// moreCursors keeps the rest of each listing cut short by more_after, one
+// per user per room, for !more
+type moreCursors struct {
+    mu      sync.Mutex
+    cursors map[moreKey]*moreCursor
+}
+
+type moreKey struct {
+    roomID id.RoomID
+    userID id.UserID
+}
+
+type moreCursor struct {
+    results   []resultRow // the whole listing
+    next      int         // index of the first row not shown yet
+    opts      searchOptions
+    batchSize int
+    outRoom   id.RoomID // where the listing went, see output_room
+    lang      string
+    relation  func() map[string]interface{}
+    created   time.Time
+}
+
+func newMoreCursors() *moreCursors {
+    return &moreCursors{cursors: map[moreKey]*moreCursor{}}
+}
+
+// set replaces the user's listing in roomID, a new search starts over
+func (m *moreCursors) set(roomID id.RoomID, userID id.UserID, c *moreCursor) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for k, old := range m.cursors {
+        if time.Since(old.created) > pageTTL {
+            delete(m.cursors, k)
+        }
+    }
+    c.created = time.Now()
+    m.cursors[moreKey{roomID, userID}] = c
+}
+
+// next returns up to n more rows of the user's listing, the number of the
+// first of them and how many are left after, forgetting the listing once
+// it's all been shown. c is nil when there is nothing more.
+func (m *moreCursors) next(roomID id.RoomID, userID id.UserID, n int) (c *moreCursor, rows []resultRow, index, left int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    k := moreKey{roomID, userID}
+    c, ok := m.cursors[k]
+    if !ok || time.Since(c.created) > pageTTL {
+        delete(m.cursors, k)
+        return nil, nil, 0, 0
+    }
+    start := c.next
+    end := len(c.results)
+    if n > 0 && start+n < end {
+        end = start + n
+    }
+    c.next = end
+    if end == len(c.results) {
+        delete(m.cursors, k)
+    }
+    return c, c.results[start:end], start + 1, len(c.results) - end
+}
+
+// listings remembers each user's last listing per room, so !get can take a
+// result number from it
+type listings struct {
+    mu      sync.Mutex
+    entries map[moreKey]listing
+}
+
+type listing struct {
+    results []resultRow
+    created time.Time
+}
+
+func newListings() *listings {
+    return &listings{entries: map[moreKey]listing{}}
+}
+
+func (l *listings) set(roomID id.RoomID, userID id.UserID, results []resultRow) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for k, old := range l.entries {
+        if time.Since(old.created) > pageTTL {
+            delete(l.entries, k)
+        }
+    }
+    l.entries[moreKey{roomID, userID}] = listing{results: results, created: time.Now()}
+}
+
+// get returns row n (1-based) of the user's last listing in roomID
+func (l *listings) get(roomID id.RoomID, userID id.UserID, n int) (resultRow, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    e, ok := l.entries[moreKey{roomID, userID}]
+    if !ok || time.Since(e.created) > pageTTL || n < 1 || n > len(e.results) {
+        return resultRow{}, false
+    }
+    return e.results[n-1], true
+}
+
+// handleMore implements !more: the next more_after rows of the sender's last
+// listing in this room
+func (b *Bot) handleMore(ctx context.Context, ev *event.Event) {
+    c, rows, index, left := b.more.next(ev.RoomID, ev.Sender, b.config().Bot.moreAfter())
+    if c == nil {
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "nothing_more"))
+        return
+    }
+    b.react(ctx, ev.RoomID, ev.ID, "✅️")
+    if err := b.sendBatches(ctx, c.outRoom, rows, index, c.batchSize, c.opts, c.lang, c.relation); err != nil {
+        logFor(ctx).Error("Failed to send HTML message", "err", err)
+        return
+    }
+    if left > 0 {
+        b.sendMoreHint(ctx, c.outRoom, ev.RoomID, left, c.relation)
+    }
+}
+
+// sendFirst answers a first:on search with its top result as a single line,
+// noting how many other rows matched: total, when already counted
+func (b *Bot) sendFirst(ctx context.Context, ev *event.Event, results []resultRow, total int, positives, negatives []string, atArg *string, opts searchOptions) {
+    roomID := ev.RoomID
+    top := results[0]
+    others := len(results) - 1
+    if total > 0 {
+        others = total - 1
+    }
+    // The search stops at max_results, so count past it
+    if total < 0 && len(results) > b.config().Bot.maxResults() {
+        if total, err := b.count(ctx, positives, negatives, atArg, opts); err == nil {
+            others = total - 1
+        }
+    }
+    b.react(ctx, roomID, ev.ID, "✅️")
+    if quota := b.config().Bot.DailyQuota; quota > 0 && !b.isAdmin(ctx, roomID, ev.Sender) {
+        if err := b.addQuotaUsed(ctx, ev.Sender, 1); err != nil {
+            logFor(ctx).Warn("Could not update quota", "err", err)
+        }
+    }
+    if err := b.markSeen(ctx, ev.Sender, results[:1]); err != nil {
+        logFor(ctx).Warn("Could not record seen results", "err", err)
+    }
+
+    plain, html := resultLine(top, opts)
+    if others > 0 {
+        more := b.msg(roomID, "first_others", others)
+        plain += "\n" + more
+        html += "<br><i>" + htmlEscape(more) + "</i>"
+    }
+    msg := map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html,
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": ev.ID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, msg); err != nil {
+        logFor(ctx).Error("Failed to send first result", "err", err)
+    }
+}
+
+// resultLine formats a single result as "section | console | file" with the
+// file linked, for replies that carry just one row
+func resultLine(r resultRow, opts searchOptions) (plain, html string) {
+    file := displayName(r.File, opts.HideExtensions)
+    size := ""
+    if r.Size > 0 {
+        size = " (" + humanSize(r.Size) + ")"
+    }
+    if r.InDat {
+        size += " " + datMark
+    }
+    if opts.ShowSource && r.Source != "" {
+        size += " [" + r.Source + "]"
+    }
+    plain = fmt.Sprintf("%s | %s | %s%s\n%s", r.Section, r.Console, file, size, r.Rawurl)
+    html = fmt.Sprintf("%s | %s | <a href=\"%s\">%s</a>%s",
+        htmlEscape(r.Section), htmlEscape(r.Console), htmlEscape(r.Rawurl), htmlEscape(file), htmlEscape(size))
+    return plain, html
+}
+
+// handleRandom implements !random [filters]: one random row matching the
+// same filters as !roms, or from the whole catalog without any
+func (b *Bot) handleRandom(ctx context.Context, ev *event.Event, query string) {
+    roomID := ev.RoomID
+    positives, negatives, atArg, opts, err := b.parseQuery(ctx, query, ev.Sender, roomID)
+    if err != nil {
+        b.sendReply(ctx, roomID, ev.ID, b.errorText(roomID, err))
+        return
+    }
+    opts.Random = true
+    // year: is checked after the query, so draw enough rows for some to
+    // pass it; otherwise a single row will do
+    limit := 0
+    if opts.YearFrom != 0 {
+        limit = b.config().Bot.maxResults()
+    }
+    results, err := b.search(ctx, positives, negatives, atArg, opts, limit)
+    if err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    if len(results) == 0 {
+        b.react(ctx, roomID, ev.ID, "❌️")
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "no_results"))
+        return
+    }
+    pick := results[0]
+    b.react(ctx, roomID, ev.ID, "🎲")
+    if quota := b.config().Bot.DailyQuota; quota > 0 && !b.isAdmin(ctx, roomID, ev.Sender) {
+        if err := b.addQuotaUsed(ctx, ev.Sender, 1); err != nil {
+            logFor(ctx).Warn("Could not update quota", "err", err)
+        }
+    }
+    if err := b.markSeen(ctx, ev.Sender, results[:1]); err != nil {
+        logFor(ctx).Warn("Could not record seen results", "err", err)
+    }
+
+    plain, html := resultLine(pick, opts)
+    msg := map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           "🎲 " + plain,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": "🎲 " + html,
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": ev.ID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, msg); err != nil {
+        logFor(ctx).Error("Failed to send random result", "err", err)
+    }
+}
+
+// postResultsHeader starts a listing in an output room with who searched for
+// what, linking back to the search message, and returns its event ID
+func (b *Bot) postResultsHeader(ctx context.Context, outRoom id.RoomID, ev *event.Event, query string) (id.EventID, error) {
+    link := ev.RoomID.EventURI(ev.ID).MatrixToURL()
+    text := b.msg(ev.RoomID, "results_for", ev.Sender, query)
+    resp, err := b.client.SendMessageEvent(ctx, outRoom, event.EventMessage, map[string]interface{}{
+        "msgtype":        "m.notice",
+        "body":           text + " " + link,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": fmt.Sprintf("<a href=\"%s\">%s</a>", htmlEscape(link), htmlEscape(text)),
+    })
+    if err != nil {
+        return "", err
+    }
+    return resp.EventID, nil
+}
+
+// distinctScopes counts the different consoles and sections in results
+func distinctScopes(results []resultRow) (consoles, sections int) {
+    seenConsoles := map[string]bool{}
+    seenSections := map[string]bool{}
+    for _, r := range results {
+        seenConsoles[r.Section+"/"+r.Console] = true
+        seenSections[r.Section] = true
+    }
+    return len(seenConsoles), len(seenSections)
+}
+
+// prereleasePattern matches tags of files that aren't the final release
+var prereleasePattern = regexp.MustCompile(`(?i)\((?:[^)]*\b)?(?:beta|proto|demo|sample|preview|kiosk)\b[^)]*\)`)
+
+// revisionPattern matches "(Rev 2)", "(Rev A)" and "(v1.1)" tags
+var revisionPattern = regexp.MustCompile(`(?i)\((?:rev ([0-9]+|[a-z])|v([0-9]+(?:\.[0-9]+)?))\)`)
+
+// revisionOf ranks a file's revision tag, higher is newer; 0 without one
+func revisionOf(file string) float64 {
+    m := revisionPattern.FindStringSubmatch(file)
+    switch {
+    case m == nil:
+        return 0
+    case m[1] != "":
+        if n, err := strconv.Atoi(m[1]); err == nil {
+            return float64(n)
+        }
+        return float64(strings.ToLower(m[1])[0]-'a') + 1
+    default:
+        v, _ := strconv.ParseFloat(m[2], 64)
+        return v
+    }
+}
+
+// oneGameOneROM keeps one file per title per console for 1g1r:on: final
+// releases over betas and demos, then the best region in priority, then
+// the highest revision. The kept rows stay in their original order.
+func oneGameOneROM(results []resultRow, priority []string) []resultRow {
+    type key struct{ section, console, title string }
+    better := func(a, b resultRow) bool {
+        if pa, pb := prereleasePattern.MatchString(a.File), prereleasePattern.MatchString(b.File); pa != pb {
+            return pb
+        }
+        if ra, rb := regionRank(a.File, priority), regionRank(b.File, priority); ra != rb {
+            return ra < rb
+        }
+        return revisionOf(a.File) > revisionOf(b.File)
+    }
+    best := map[key]int{}
+    for i, r := range results {
+        title := r.Title
+        if title == "" {
+            title = romname.NormalizeTitle(r.File)
+        }
+        k := key{r.Section, r.Console, title}
+        if j, ok := best[k]; !ok || better(r, results[j]) {
+            best[k] = i
+        }
+    }
+    keep := make([]bool, len(results))
+    for _, i := range best {
+        keep[i] = true
+    }
+    kept := results[:0]
+    for i, r := range results {
+        if keep[i] {
+            kept = append(kept, r)
+        }
+    }
+    return kept
+}
+
+// regionAbbrevs shortens the common regions in merge:region labels
+var regionAbbrevs = map[string]string{"USA": "USA", "Europe": "EUR", "Japan": "JPN", "World": "WLD"}
+
+// mergeRegions folds rows that only differ in their tags, e.g. the USA,
+// Europe and Japan releases of a game, into one row per title per console.
+// Rows keep their order, a merged row sits where its first variant was.
+func mergeRegions(results []resultRow) []resultRow {
+    type key struct{ section, console, title string }
+    index := map[key]int{}
+    var merged []resultRow
+    for _, r := range results {
+        k := key{r.Section, r.Console, romname.BaseTitle(r.File)}
+        i, ok := index[k]
+        if !ok {
+            i = len(merged)
+            index[k] = i
+            merged = append(merged, resultRow{Section: r.Section, Console: r.Console, File: k.title, Rawurl: r.Rawurl})
+        }
+        merged[i].Links = append(merged[i].Links, regionLink{Label: variantLabel(r.File), URL: r.Rawurl})
+    }
+    // Variants with the same label, e.g. two untagged dumps, get numbered
+    for i := range merged {
+        seen := map[string]int{}
+        for j := range merged[i].Links {
+            label := merged[i].Links[j].Label
+            seen[label]++
+            if seen[label] > 1 {
+                merged[i].Links[j].Label = fmt.Sprintf("%s #%d", label, seen[label])
+            }
+        }
+    }
+    return merged
+}
+
+// variantLabel names a file's variant by its regions and other tags, e.g.
+// "USA/EUR Rev 1" for "Game (USA, Europe) (Rev 1).zip"
+func variantLabel(file string) string {
+    var parts []string
+    regions := regionsOf(file)
+    if len(regions) > 0 {
+        short := make([]string, len(regions))
+        for i, r := range regions {
+            short[i] = r
+            if abbrev, ok := regionAbbrevs[r]; ok {
+                short[i] = abbrev
+            }
+        }
+        parts = append(parts, strings.Join(short, "/"))
+    }
+    for _, tag := range romname.TagPattern.FindAllString(file, -1) {
+        tag = strings.Trim(strings.TrimSpace(tag), "()[]")
+        isRegion := false
+        for _, part := range strings.Split(tag, ",") {
+            if romname.KnownRegions[strings.TrimSpace(part)] {
+                isRegion = true
+            }
+        }
+        if !isRegion {
+            parts = append(parts, tag)
+        }
+    }
+    if len(parts) == 0 {
+        return "?"
+    }
+    return strings.Join(parts, " ")
+}
+
+// mergedLinks renders a merge:region row's title with a link per variant
+func mergedLinks(row resultRow) (string, string) {
+    var html, plain []string
+    for _, l := range row.Links {
+        html = append(html, fmt.Sprintf("<a href=\"%s\">%s</a>", htmlEscape(l.URL), htmlEscape(l.Label)))
+        plain = append(plain, l.Label)
+    }
+    return htmlEscape(row.File) + " — " + strings.Join(html, " | "), row.File + " [" + strings.Join(plain, " | ") + "]"
+}
+
+// maxMessageBytes keeps rendered messages (plain and HTML body together)
+// safely under the homeserver's 64 KiB event limit
+const maxMessageBytes = 60000
+
+// renderFitting renders as many leading rows as fit in one message and
+// returns how many that was, at least one
+func renderFitting(rows []resultRow, index int, opts searchOptions, lang string) (string, string, int) {
+    n := len(rows)
+    plain, html := renderRows(rows, index, opts, lang)
+    for n > 1 && len(plain)+len(html) > maxMessageBytes {
+        // Scale down by the overshoot, always dropping at least one row
+        smaller := n * maxMessageBytes / (len(plain) + len(html))
+        if smaller >= n {
+            smaller = n - 1
+        }
+        if smaller < 1 {
+            smaller = 1
+        }
+        n = smaller
+        plain, html = renderRows(rows[:n], index, opts, lang)
+    }
+    return plain, html, n
+}
+
+// matchedFields lists the columns of row that contain one of the search
+// terms, the same case-insensitive substring test the database uses
+func matchedFields(row resultRow, opts searchOptions) []string {
+    var fields []string
+    for _, field := range []string{"section", "console", "file"} {
+        value := strings.ToLower(row.field(field))
+        matched := false
+        for _, t := range opts.MatchTerms {
+            if strings.Contains(value, strings.ToLower(t)) {
+                matched = true
+                break
+            }
+        }
+        for _, t := range opts.Scoped {
+            if t.Field == field && strings.Contains(value, strings.ToLower(t.Value)) {
+                matched = true
+            }
+        }
+        if matched {
+            fields = append(fields, field)
+        }
+    }
+    return fields
+}
+
+// shellQuote single-quotes s for a POSIX shell
+func shellQuote(s string) string {
+    return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// uploadPaste posts text to the paste service and returns the paste's URL
+func (b *Bot) uploadPaste(ctx context.Context, paste PasteConfig, text string) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, paste.URL, strings.NewReader(text))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+    if paste.Token != "" {
+        req.Header.Set("Authorization", "Bearer "+paste.Token)
+    }
+    resp, err := b.http.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+    if err != nil {
+        return "", err
+    }
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return "", fmt.Errorf("%s returned %s", paste.URL, resp.Status)
+    }
+    link := strings.TrimSpace(string(body))
+    if u, err := url.Parse(link); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+        return "", fmt.Errorf("%s didn't answer with a URL: %q", paste.URL, link)
+    }
+    return link, nil
+}
+
+// displayName is file as shown to users, without the longest of the hidden
+// extensions it ends in. Only the end is compared, so "Game v1.2 (USA).zip"
+// loses ".zip" and keeps its other dots.
+func displayName(file string, hide []string) string {
+    cut := 0
+    for _, ext := range hide {
+        if !strings.HasPrefix(ext, ".") {
+            ext = "." + ext
+        }
+        if len(ext) > cut && len(file) > len(ext) && strings.EqualFold(file[len(file)-len(ext):], ext) {
+            cut = len(ext)
+        }
+    }
+    return file[:len(file)-cut]
+}
+
+// uniqueFiles drops rows whose file name was already seen, keeping order
+func uniqueFiles(results []resultRow) []resultRow {
+    seen := map[string]bool{}
+    unique := results[:0]
+    for _, r := range results {
+        if !seen[r.File] {
+            seen[r.File] = true
+            unique = append(unique, r)
+        }
+    }
+    return unique
+}
+
+// renderRows formats a batch of results as plain text and HTML. index is the
+// number shown for the first row, lang the language of the table headers.
+func renderRows(batch []resultRow, index int, opts searchOptions, lang string) (string, string) {
+    var html strings.Builder
+    var plain strings.Builder
+    if opts.Format == "names" {
+        for _, row := range batch {
+            name := displayName(row.File, opts.HideExtensions)
+            html.WriteString(htmlEscape(name) + "<br>")
+            plain.WriteString(name + "\n")
+        }
+        return plain.String(), html.String()
+    }
+    if opts.Format == "curl" {
+        plain.WriteString("```\n")
+        html.WriteString("<pre><code>")
+        for _, row := range batch {
+            urls := []string{row.Rawurl}
+            if len(row.Links) > 0 {
+                urls = urls[:0]
+                for _, l := range row.Links {
+                    urls = append(urls, l.URL)
+                }
+            }
+            for _, u := range urls {
+                line := "wget " + shellQuote(u)
+                plain.WriteString(line + "\n")
+                html.WriteString(htmlEscape(line) + "\n")
+            }
+        }
+        plain.WriteString("```\n")
+        html.WriteString("</code></pre>")
+        return plain.String(), html.String()
+    }
+    table := opts.Format == "table"
+    if table {
+        html.WriteString(fmt.Sprintf("<table><tr><th>#</th><th>%s</th><th>%s</th><th>%s</th></tr>",
+            translate(lang, "col_section"), translate(lang, "col_console"), translate(lang, "col_file")))
+    }
+    group := ""
+    for _, row := range batch {
+        // Merged rows span regions, so they can't go under a region header
+        if opts.Group == "region" && len(row.Links) == 0 {
+            if g := regionGroup(row.File); g != group {
+                group = g
+                if table {
+                    html.WriteString("<tr><th colspan=\"4\">" + g + "</th></tr>")
+                } else {
+                    html.WriteString("<h3>" + g + "</h3>")
+                }
+                plain.WriteString("== " + g + " ==\n")
+            }
+        }
+        note := ""
+        if opts.Verbose {
+            if fields := matchedFields(row, opts); len(fields) > 0 {
+                note = " " + translate(lang, "matched", strings.Join(fields, ", "))
+            }
+        }
+        file := displayName(row.File, opts.HideExtensions)
+        link := fmt.Sprintf("<a href=\"%s\">%s</a>", row.Rawurl, htmlEscape(file))
+        if len(row.Links) > 0 {
+            link, file = mergedLinks(row)
+        } else if row.Size > 0 {
+            size := " (" + humanSize(row.Size) + ")"
+            link += htmlEscape(size)
+            file += size
+        }
+        if row.InDat {
+            link += " " + datMark
+            file += " " + datMark
+        }
+        if opts.ShowSource && row.Source != "" {
+            link += " " + htmlEscape("["+row.Source+"]")
+            file += " [" + row.Source + "]"
+        }
+        if opts.Badges {
+            if badge := badges(row.File); badge != "" {
+                link = htmlEscape(badge) + " " + link
+                file = badge + " " + file
+            }
+        }
+        if table {
+            html.WriteString(fmt.Sprintf(
+                "<tr><td>%d</td><td>%s</td><td>%s</td><td>%s%s</td></tr>",
+                index, htmlEscape(row.Section), htmlEscape(row.Console), link, htmlEscape(note),
+            ))
+            plain.WriteString(fmt.Sprintf("%d. %s | %s | %s%s\n", index, row.Section, row.Console, file, note))
+        } else {
+            html.WriteString(fmt.Sprintf(
+                "<h4>%d. %s | %s</h4>&nbsp;&nbsp;&nbsp;&nbsp;%s%s<br><br>",
+                index, htmlEscape(row.Section), htmlEscape(row.Console), link, htmlEscape(note),
+            ))
+            plain.WriteString(fmt.Sprintf(
+                "%d. %s | %s\n\t%s%s\n",
+                index, row.Section, row.Console, file, note,
+            ))
+        }
+        index++
+    }
+    if table {
+        html.WriteString("</table>")
+    }
+    return plain.String(), html.String()
+}
+
+
+// upstreamCache keeps recently fetched mirror directory listings so repeated
+// checks against the same console don't hammer the upstream server.
+type upstreamCache struct {
+    mu      sync.Mutex
+    http    *http.Client
+    ttl     time.Duration
+    entries map[string]upstreamListing
+    stats   cacheStats
+}
+
+type upstreamListing struct {
+    files   []string
+    fetched time.Time
+}
+
+// hrefPattern matches links to the file types build-db imports by default
+var hrefPattern = regexp.MustCompile(`(?i)href="([^"?]+\.(?:zip|7z|chd|rvz|iso|wbfs))"`)
+
+func newUpstreamCache(transport http.RoundTripper) *upstreamCache {
+    return &upstreamCache{
+        http:    &http.Client{Timeout: 15 * time.Second, Transport: transport},
+        ttl:     time.Hour,
+        entries: map[string]upstreamListing{},
+    }
+}
+
+// list returns the ROM file names found in the directory index at dirURL
+func (c *upstreamCache) list(ctx context.Context, dirURL string) ([]string, error) {
+    c.mu.Lock()
+    entry, ok := c.entries[dirURL]
+    hit := ok && time.Since(entry.fetched) < c.ttl
+    c.stats.record(hit)
+    c.mu.Unlock()
+    if hit {
+        return entry.files, nil
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, dirURL, nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s returned %s", dirURL, resp.Status)
+    }
+    // Directory listings are large but bounded; cap the read anyway
+    body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 32<<20))
+    if err != nil {
+        return nil, err
+    }
+
+    var files []string
+    for _, m := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+        name, err := url.PathUnescape(m[1])
+        if err != nil {
+            continue
+        }
+        files = append(files, name)
+    }
+
+    c.mu.Lock()
+    c.entries[dirURL] = upstreamListing{files: files, fetched: time.Now()}
+    c.mu.Unlock()
+    return files, nil
+}
+
+// checkUpstream looks for files matching the query in the mirror's directory
+// listing for the @console, reporting anything that exists upstream but is
+// missing from links.db.
+func (b *Bot) checkUpstream(ctx context.Context, roomID id.RoomID, eventID id.EventID, positives, negatives []string, atArg *string) {
+    const maxDirs = 3
+    const maxListed = 20
+
+    if atArg == nil {
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "upstream_needs_console"))
+        return
+    }
+
+    // Find the directories to look at from the consoles we already know
+    // about, leaving out ones only removed files are left in
+    rows, err := b.db.QueryContext(ctx,
+        "SELECT console, MIN(rawurl) FROM files WHERE LOWER(console) LIKE ? AND "+b.live()+" GROUP BY section, console LIMIT ?",
+        "%"+strings.ToLower(*atArg)+"%", maxDirs,
+    )
+    if err != nil {
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "upstream_error", err))
+        b.alert(ctx, "db", "Upstream check error: "+err.Error())
+        return
+    }
+    type dir struct {
+        console string
+        url     string
+    }
+    var dirs []dir
+    for rows.Next() {
+        var console, rawurl string
+        if err := rows.Scan(&console, &rawurl); err != nil {
+            continue
+        }
+        dirs = append(dirs, dir{console: console, url: rawurl[:strings.LastIndex(rawurl, "/")+1]})
+    }
+    rows.Close()
+    if len(dirs) == 0 {
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "upstream_no_console", *atArg))
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+
+    var found []string
+    for _, d := range dirs {
+        files, err := b.upstream.list(ctx, d.url)
+        if err != nil {
+            logFor(ctx).Warn("Upstream check failed", "url", d.url, "err", err)
+            continue
+        }
+        for _, f := range files {
+            if matchesTerms(f, positives, negatives) {
+                found = append(found, fmt.Sprintf("%s | %s", d.console, f))
+            }
+        }
+    }
+
+    if len(found) == 0 {
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "upstream_not_found"))
+        return
+    }
+    msg := b.msg(roomID, "upstream_found", len(found)) + "\n"
+    if len(found) > maxListed {
+        found = found[:maxListed]
+    }
+    msg += strings.Join(found, "\n")
+    b.sendReply(ctx, roomID, eventID, msg)
+}
+
+// matchesTerms reports whether name contains every positive and no negative term
+func matchesTerms(name string, positives, negatives []string) bool {
+    lower := strings.ToLower(name)
+    for _, p := range positives {
+        if !strings.Contains(lower, strings.ToLower(p)) {
+            return false
+        }
+    }
+    for _, n := range negatives {
+        if strings.Contains(lower, strings.ToLower(n)) {
+            return false
+        }
+    }
+    return true
+}
+
+// searchFailed reports a failed search to the room. Database errors are also
+// raised to the admins, user errors such as too many terms are not.
+// Queries that ran out of time get a ⏱️ on eventID.
+func (b *Bot) searchFailed(ctx context.Context, roomID id.RoomID, eventID id.EventID, err error) {
+    if errors.Is(err, errTooManyTerms) {
+        b.client.SendText(ctx, roomID, b.errorText(roomID, err))
+        return
+    }
+    if errors.Is(err, context.DeadlineExceeded) {
+        b.react(ctx, roomID, eventID, "⏱️")
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "search_timed_out"))
+        return
+    }
+    b.client.SendText(ctx, roomID, b.msg(roomID, "search_error", err))
+    b.alert(ctx, "db", "Search error: "+err.Error())
+}
+
+// react annotates eventID with key, unless reactions are turned off
+func (b *Bot) react(ctx context.Context, roomID id.RoomID, eventID id.EventID, key string) {
+    if b.config().Bot.Quiet {
+        return
+    }
+    reaction := map[string]interface{}{
+        "m.relates_to": map[string]interface{}{
+            "rel_type": "m.annotation",
+            "event_id": eventID,
+            "key":      key,
+        },
+    }
+    // A missing reaction is only cosmetic, so log it and carry on with
+    // whatever the caller sends next
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventReaction, reaction); err != nil {
+        logFor(ctx).Error("Failed to react", "key", key, "event", eventID, "err", err)
+    }
+}
+
+// sendReply sends a plain text message as a reply to eventID
+func (b *Bot) sendReply(ctx context.Context, roomID id.RoomID, eventID id.EventID, text string) {
+    msg := map[string]interface{}{
+        "msgtype": "m.text",
+        "body":    text,
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": eventID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, msg); err != nil {
+        logFor(ctx).Error("Failed to send reply", "err", err)
+    }
+}
+
+// buildTime returns when build-db last imported into links.db, falling back
+// to the file's mtime for databases built before the meta table existed
+func (b *Bot) buildTime(ctx context.Context) (time.Time, bool) {
+    var value string
+    err := b.db.QueryRowContext(ctx, "SELECT value FROM meta WHERE key = 'built_at'").Scan(&value)
+    if err == nil {
+        if t, err := time.Parse(time.RFC3339, value); err == nil {
+            return t, true
+        }
+    }
+    if info, err := os.Stat(dbPath); err == nil {
+        return info.ModTime(), true
+    }
+    return time.Time{}, false
+}
+
+// ensureLinkStatus adds the link checker's columns to files: status is NULL
+// until checked, then "ok" or "dead", and checked_at is when
+func ensureLinkStatus(ctx context.Context, db Store) error {
+    hasStatus, err := db.HasColumn(ctx, "files", "status")
+    if err != nil {
+        return err
+    }
+    if !hasStatus {
+        for _, stmt := range []string{
+            "ALTER TABLE files ADD COLUMN status TEXT",
+            "ALTER TABLE files ADD COLUMN checked_at BIGINT",
+        } {
+            if _, err := db.ExecContext(ctx, stmt); err != nil {
+                return err
+            }
+        }
+    }
+    _, err = db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS files_checked_at ON files(checked_at)")
+    return err
+}
+
+// linkCheckSummaryEvery is how often checkLinks reports to the admins
+const linkCheckSummaryEvery = 7 * 24 * time.Hour
+
+// checkLinks HEADs the least recently checked links every
+// link_check_interval, marking the ones the mirror no longer has as dead so
+// searches leave them out, and sends the admins a weekly summary
+func (b *Bot) checkLinks(ctx context.Context) {
+    var checked, died, revived int
+    lastSummary := time.Now()
+    for {
+        cfg := b.config().Bot
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(cfg.LinkCheckInterval):
+        }
+        c, d, r, err := b.checkLinkBatch(ctx, cfg.linkCheckBatch(), cfg.linkCheckWorkers())
+        checked, died, revived = checked+c, died+d, revived+r
+        if err != nil && ctx.Err() == nil {
+            slog.Warn("Link check failed", "err", err)
+        } else {
+            slog.Info("Link check done", "checked", c, "dead", d, "revived", r)
+        }
+        if time.Since(lastSummary) >= linkCheckSummaryEvery {
+            var dead int
+            if err := b.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM files WHERE status = 'dead' AND "+b.live()).Scan(&dead); err != nil {
+                slog.Warn("Could not count dead links", "err", err)
+            }
+            b.notifyAdmins(ctx, fmt.Sprintf("Link check, last 7 days: %d links checked, %d newly dead, %d back. %d dead links in total.",
+                checked, died, revived, dead))
+            checked, died, revived = 0, 0, 0
+            lastSummary = time.Now()
+        }
+    }
+}
+
+// checkLinkBatch checks up to n links, never checked ones first (PostgreSQL
+// would sort their NULLs last), then oldest check first, with workers
+// requests at a time. It returns how many were checked, found dead and
+// found back after being dead.
+func (b *Bot) checkLinkBatch(ctx context.Context, n, workers int) (checked, died, revived int, err error) {
+    rows, err := b.db.QueryContext(ctx, "SELECT rawurl, COALESCE(status, '') FROM files WHERE "+b.live()+" ORDER BY checked_at NULLS FIRST LIMIT ?", n)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    type link struct{ url, status string }
+    var links []link
+    for rows.Next() {
+        var l link
+        if err := rows.Scan(&l.url, &l.status); err != nil {
+            rows.Close()
+            return 0, 0, 0, err
+        }
+        links = append(links, l)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, 0, 0, err
+    }
+
+    // HEAD in parallel, then save in one transaction so the workers don't
+    // compete for the write lock
+    statuses := make([]string, len(links))
+    var wg sync.WaitGroup
+    jobs := make(chan int)
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := range jobs {
+                status, ok := b.linkStatusOf(ctx, links[j].url)
+                if !ok {
+                    // Mirror or network trouble says nothing about the link,
+                    // keep its status but move it to the back of the line
+                    status = links[j].status
+                }
+                statuses[j] = status
+            }
+        }()
+    }
+    sent := 0
+    for ; sent < len(links) && ctx.Err() == nil; sent++ {
+        jobs <- sent
+    }
+    close(jobs)
+    wg.Wait()
+
+    tx, err := b.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    defer tx.Rollback()
+    now := time.Now().Unix()
+    for j, l := range links[:sent] {
+        if _, err := tx.ExecContext(ctx, b.db.Rebind("UPDATE files SET status = NULLIF(?, ''), checked_at = ? WHERE rawurl = ?"), statuses[j], now, l.url); err != nil {
+            return 0, 0, 0, err
+        }
+        if statuses[j] == "dead" && l.status != "dead" {
+            died++
+        } else if statuses[j] == "ok" && l.status == "dead" {
+            revived++
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, 0, 0, err
+    }
+    return sent, died, revived, ctx.Err()
+}
+
+// linkStatusOf HEADs rawurl: "dead" for 404 and 410, "ok" for success. ok
+// is false when the answer doesn't tell, e.g. a timeout or a 5xx.
+func (b *Bot) linkStatusOf(ctx context.Context, rawurl string) (string, bool) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawurl, nil)
+    if err != nil {
+        return "", false
+    }
+    resp, err := b.http.Do(req)
+    if err != nil {
+        return "", false
+    }
+    resp.Body.Close()
+    switch {
+    case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+        return "dead", true
+    case resp.StatusCode < 300:
+        return "ok", true
+    }
+    return "", false
+}
+
+// updatePresence publishes the catalog size and build date as the bot's
+// presence status message
+func (b *Bot) updatePresence(ctx context.Context) {
+    var count int
+    if err := b.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM files WHERE "+b.live()).Scan(&count); err != nil {
+        slog.Warn("Could not count rows for presence", "err", err)
+        return
+    }
+    lang := b.config().Bot.Language
+    status := translate(lang, "games_indexed", count)
+    if built, ok := b.buildTime(ctx); ok {
+        status += " · " + translate(lang, "updated", built.Format("2006-01-02"))
+    }
+    err := b.client.SetPresence(ctx, mautrix.ReqPresence{
+        Presence:  event.PresenceOnline,
+        StatusMsg: status,
+    })
+    if err != nil {
+        slog.Warn("Could not set presence", "err", err)
+        return
+    }
+    slog.Info("Presence set", "status", status)
+}
+
+// handleStats implements !stats: catalog totals and the build date as a table
+func (b *Bot) handleStats(ctx context.Context, ev *event.Event) {
+    roomID := ev.RoomID
+    var files, sections, consoles int
+    err := b.db.QueryRowContext(ctx,
+        "SELECT COUNT(*), COUNT(DISTINCT section), COUNT(DISTINCT console) FROM files WHERE "+b.live()).
+        Scan(&files, &sections, &consoles)
+    if err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    stats := [][2]string{
+        {b.msg(roomID, "stat_files"), strconv.Itoa(files)},
+        {b.msg(roomID, "stat_sections"), strconv.Itoa(sections)},
+        {b.msg(roomID, "stat_consoles"), strconv.Itoa(consoles)},
+    }
+    if b.sizes {
+        var total, known sql.NullInt64
+        err := b.db.QueryRowContext(ctx, "SELECT SUM(size), COUNT(size) FROM files WHERE "+b.live()).Scan(&total, &known)
+        if err != nil {
+            logFor(ctx).Warn("Could not sum sizes", "err", err)
+        } else if known.Int64 > 0 {
+            size := humanSize(total.Int64)
+            if known.Int64 < int64(files) {
+                size += " " + b.msg(roomID, "size_partial", known.Int64)
+            }
+            stats = append(stats, [2]string{b.msg(roomID, "stat_size"), size})
+        }
+    }
+    if built, ok := b.buildTime(ctx); ok {
+        stats = append(stats, [2]string{b.msg(roomID, "stat_built"), built.UTC().Format("2006-01-02 15:04 UTC")})
+    }
+
+    var html strings.Builder
+    var plain strings.Builder
+    html.WriteString("<table>")
+    for _, stat := range stats {
+        html.WriteString("<tr><th align=\"left\">" + htmlEscape(stat[0]) + "</th><td>" + htmlEscape(stat[1]) + "</td></tr>")
+        plain.WriteString(stat[0] + ": " + stat[1] + "\n")
+    }
+    html.WriteString("</table>")
+
+    msg := map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain.String(),
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html.String(),
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": ev.ID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, msg); err != nil {
+        logFor(ctx).Error("Failed to send stats", "err", err)
+    }
+}
+
+// humanSize formats a byte count as e.g. "1.4 GiB"
+func humanSize(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%d B", n)
+    }
+    div, exp := int64(unit), 0
+    for m := n / unit; m >= unit; m /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// jobRegistry tracks in-flight searches so admins can list and cancel them
+type jobRegistry struct {
+    mu     sync.Mutex
+    nextID int
+    jobs   map[int]*job
+}
+
+type job struct {
+    id      int
+    sender  id.UserID
+    query   string
+    started time.Time
+    cancel  context.CancelFunc
+}
+
+func newJobRegistry() *jobRegistry {
+    return &jobRegistry{jobs: map[int]*job{}}
+}
+
+// start registers a search and returns the context it should run under
+func (r *jobRegistry) start(ctx context.Context, sender id.UserID, query string) (context.Context, *job) {
+    ctx, cancel := context.WithCancel(ctx)
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.nextID++
+    j := &job{id: r.nextID, sender: sender, query: query, started: time.Now(), cancel: cancel}
+    r.jobs[j.id] = j
+    return ctx, j
+}
+
+func (r *jobRegistry) finish(j *job) {
+    j.cancel()
+    r.mu.Lock()
+    delete(r.jobs, j.id)
+    r.mu.Unlock()
+}
+
+func (r *jobRegistry) cancel(jobID int) bool {
+    r.mu.Lock()
+    j, ok := r.jobs[jobID]
+    r.mu.Unlock()
+    if ok {
+        j.cancel()
+    }
+    return ok
+}
+
+// list returns the running jobs, oldest first
+func (r *jobRegistry) list() []*job {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    jobs := make([]*job, 0, len(r.jobs))
+    for _, j := range r.jobs {
+        jobs = append(jobs, j)
+    }
+    sort.Slice(jobs, func(i, k int) bool { return jobs[i].id < jobs[k].id })
+    return jobs
+}
+
+// alerter rate-limits error notifications and remembers the DM rooms used to
+// reach each admin
+type alerter struct {
+    mu      sync.Mutex
+    last    map[string]time.Time
+    dmRooms map[id.UserID]id.RoomID
+}
+
+func newAlerter() *alerter {
+    return &alerter{
+        last:    map[string]time.Time{},
+        dmRooms: map[id.UserID]id.RoomID{},
+    }
+}
+
+// alert notifies operators about a serious error, either in the configured
+// alert room or by DM to every admin. Alerts with the same key are sent at
+// most once per alert_interval.
+func (b *Bot) alert(ctx context.Context, key, text string) {
+    cfg := b.config()
+    interval := cfg.Bot.AlertInterval
+    if interval <= 0 {
+        interval = 10 * time.Minute
+    }
+    b.alerts.mu.Lock()
+    if last, ok := b.alerts.last[key]; ok && time.Since(last) < interval {
+        b.alerts.mu.Unlock()
+        return
+    }
+    b.alerts.last[key] = time.Now()
+    b.alerts.mu.Unlock()
+
+    b.notifyAdmins(ctx, "⚠️ "+text)
+}
+
+// notifyAdmins posts text to the alert room, or to each admin's DM when
+// there is none
+func (b *Bot) notifyAdmins(ctx context.Context, text string) {
+    cfg := b.config()
+    if cfg.Bot.AlertRoom != "" {
+        if _, err := b.client.SendNotice(ctx, id.RoomID(cfg.Bot.AlertRoom), text); err != nil {
+            slog.Error("Failed to send alert", "err", err)
+        }
+        return
+    }
+    for _, admin := range cfg.Bot.Admins {
+        roomID, err := b.dmRoom(ctx, id.UserID(strings.TrimSpace(admin)))
+        if err != nil {
+            slog.Error("Failed to open DM", "admin", admin, "err", err)
+            continue
+        }
+        if _, err := b.client.SendNotice(ctx, roomID, text); err != nil {
+            slog.Error("Failed to send alert", "admin", admin, "err", err)
+        }
+    }
+}
+
+// dmRoom returns the DM room with userID, creating it on first use
+func (b *Bot) dmRoom(ctx context.Context, userID id.UserID) (id.RoomID, error) {
+    b.alerts.mu.Lock()
+    roomID, ok := b.alerts.dmRooms[userID]
+    b.alerts.mu.Unlock()
+    if ok {
+        return roomID, nil
+    }
+    resp, err := b.client.CreateRoom(ctx, &mautrix.ReqCreateRoom{
+        Preset:   "trusted_private_chat",
+        Invite:   []id.UserID{userID},
+        IsDirect: true,
+    })
+    if err != nil {
+        return "", err
+    }
+    b.alerts.mu.Lock()
+    b.alerts.dmRooms[userID] = resp.RoomID
+    b.alerts.mu.Unlock()
+    return resp.RoomID, nil
+}
+
+// dmCache remembers which rooms are 1:1 rooms with the bot
+type dmCache struct {
+    mu    sync.Mutex
+    rooms map[id.RoomID]dmEntry
+    stats cacheStats
+}
+
+type dmEntry struct {
+    isDM    bool
+    checked time.Time
+}
+
+func newDMCache() *dmCache {
+    return &dmCache{rooms: map[id.RoomID]dmEntry{}}
+}
+
+// isDM reports whether roomID has exactly two joined members, the bot and
+// one user. Results are cached for a few minutes.
+func (b *Bot) isDM(ctx context.Context, roomID id.RoomID) bool {
+    const ttl = 5 * time.Minute
+    b.dms.mu.Lock()
+    entry, ok := b.dms.rooms[roomID]
+    hit := ok && time.Since(entry.checked) < ttl
+    b.dms.stats.record(hit)
+    b.dms.mu.Unlock()
+    if hit {
+        return entry.isDM
+    }
+
+    resp, err := b.client.JoinedMembers(ctx, roomID)
+    if err != nil {
+        logFor(ctx).Warn("Could not fetch room members", "members_of", roomID, "err", err)
+        return false
+    }
+    _, botJoined := resp.Joined[b.client.UserID]
+    isDM := botJoined && len(resp.Joined) == 2
+
+    b.dms.mu.Lock()
+    b.dms.rooms[roomID] = dmEntry{isDM: isDM, checked: time.Now()}
+    b.dms.mu.Unlock()
+    return isDM
+}
+
+const (
+    // maxDumpRows and maxDumpBytes cap !dump; the upload has to stay under
+    // the homeserver's media size limit
+    maxDumpRows  = 5000000
+    maxDumpBytes = 100 << 20
+)
+
+// getTimeout bounds a !get download and upload
+const getTimeout = 5 * time.Minute
+
+// handleGet implements !get: it downloads a file, given by its exact name or
+// its number in the sender's last listing here, and uploads it to the
+// room, for clients where following the mirror link is a hassle
+func (b *Bot) handleGet(ctx context.Context, ev *event.Event, arg string) {
+    roomID := ev.RoomID
+    if arg == "" {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "usage_get"))
+        return
+    }
+    var row resultRow
+    if n, err := strconv.Atoi(arg); err == nil {
+        var ok bool
+        if row, ok = b.listed.get(roomID, ev.Sender, n); !ok {
+            b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "get_no_result", n))
+            return
+        }
+    } else {
+        size := "0"
+        if b.sizes {
+            size = "COALESCE(size, 0)"
+        }
+        err := b.db.QueryRowContext(ctx, "SELECT section, console, file, rawurl, "+size+" FROM files WHERE file = ? AND "+b.live()+" LIMIT 1", arg).
+            Scan(&row.Section, &row.Console, &row.File, &row.Rawurl, &row.Size)
+        if err == sql.ErrNoRows {
+            b.react(ctx, roomID, ev.ID, "❌️")
+            b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "get_not_found", arg))
+            return
+        }
+        if err != nil {
+            b.searchFailed(ctx, roomID, ev.ID, err)
+            return
+        }
+    }
+    maxSize := b.config().Bot.getMaxSize()
+    if row.Size > maxSize {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "get_too_big", row.File, humanSize(maxSize)))
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, getTimeout)
+    defer cancel()
+    b.react(ctx, roomID, ev.ID, "⏳")
+
+    tmp, err := os.CreateTemp("", "roms-get-*")
+    if err != nil {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "get_failed", err))
+        return
+    }
+    defer os.Remove(tmp.Name())
+    defer tmp.Close()
+
+    size, err := b.download(ctx, row.Rawurl, tmp, maxSize)
+    if errors.Is(err, errTooBig) {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "get_too_big", row.File, humanSize(maxSize)))
+        return
+    }
+    if err == nil {
+        _, err = tmp.Seek(0, io.SeekStart)
+    }
+    if err != nil {
+        logFor(ctx).Warn("!get download failed", "url", row.Rawurl, "err", err)
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "get_failed", err))
+        return
+    }
+
+    mimeType := mime.TypeByExtension(path.Ext(row.File))
+    if mimeType == "" {
+        mimeType = "application/octet-stream"
+    }
+    upload, err := b.client.UploadMedia(ctx, mautrix.ReqUploadMedia{
+        Content:       tmp,
+        ContentLength: size,
+        ContentType:   mimeType,
+        FileName:      row.File,
+    })
+    if err != nil {
+        logFor(ctx).Error("!get upload failed", "err", err)
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "get_failed", err))
+        return
+    }
+    _, err = b.client.SendMessageEvent(ctx, roomID, event.EventMessage, map[string]interface{}{
+        "msgtype":  "m.file",
+        "body":     row.File,
+        "filename": row.File,
+        "url":      upload.ContentURI.CUString(),
+        "info": map[string]interface{}{
+            "mimetype": mimeType,
+            "size":     size,
+        },
+        "m.relates_to": replyRelation(ev),
+    })
+    if err != nil {
+        logFor(ctx).Error("Failed to send !get file", "err", err)
+        return
+    }
+    b.react(ctx, roomID, ev.ID, "✅️")
+    logFor(ctx).Info("!get uploaded", "file", row.File, "bytes", size)
+}
+
+// errTooBig is returned by download when the file is over its size cap
+var errTooBig = errors.New("file too big")
+
+// download writes rawurl to w and returns its size, stopping with errTooBig
+// once it is known to be over maxSize
+func (b *Bot) download(ctx context.Context, rawurl string, w io.Writer, maxSize int64) (int64, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+    if err != nil {
+        return 0, err
+    }
+    // b.http's timeout is meant for small requests, ctx bounds this one
+    client := &http.Client{Transport: b.http.Transport}
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("mirror answered %s", resp.Status)
+    }
+    if resp.ContentLength > maxSize {
+        return 0, errTooBig
+    }
+    n, err := io.Copy(w, io.LimitReader(resp.Body, maxSize+1))
+    if err != nil {
+        return n, err
+    }
+    if n > maxSize {
+        return n, errTooBig
+    }
+    return n, nil
+}
+
+// replyRelation answers ev in its thread when it was sent in one, or as a
+// plain reply otherwise
+func replyRelation(ev *event.Event) map[string]interface{} {
+    reply := map[string]interface{}{
+        "m.in_reply_to": map[string]interface{}{
+            "event_id": ev.ID,
+        },
+    }
+    msg := ev.Content.AsMessage()
+    if msg == nil || msg.RelatesTo == nil {
+        return reply
+    }
+    root := msg.RelatesTo.GetThreadParent()
+    if root == "" {
+        return reply
+    }
+    reply["rel_type"] = "m.thread"
+    reply["event_id"] = root
+    reply["is_falling_back"] = false
+    return reply
+}
+
+// dumpCatalog uploads the files table as a gzipped CSV. Rows are streamed
+// from the database through the CSV and gzip writers into a temp file, so
+// memory use doesn't grow with the catalog.
+func (b *Bot) dumpCatalog(ctx context.Context, roomID id.RoomID, eventID id.EventID) {
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+    defer cancel()
+    b.react(ctx, roomID, eventID, "⏳")
+
+    tmp, err := os.CreateTemp("", "roms-dump-*.csv.gz")
+    if err != nil {
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "dump_failed", err))
+        return
+    }
+    defer os.Remove(tmp.Name())
+    defer tmp.Close()
+
+    rows, size, err := b.writeDump(ctx, tmp)
+    if err != nil {
+        logFor(ctx).Error("!dump failed", "err", err)
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "dump_failed", b.errorText(roomID, err)))
+        return
+    }
+    if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "dump_failed", err))
+        return
+    }
+
+    name := "links-" + time.Now().UTC().Format("2006-01-02") + ".csv.gz"
+    upload, err := b.client.UploadMedia(ctx, mautrix.ReqUploadMedia{
+        Content:       tmp,
+        ContentLength: size,
+        ContentType:   "application/gzip",
+        FileName:      name,
+    })
+    if err != nil {
+        logFor(ctx).Error("!dump upload failed", "err", err)
+        b.sendReply(ctx, roomID, eventID, b.msg(roomID, "dump_failed", err))
+        return
+    }
+    _, err = b.client.SendMessageEvent(ctx, roomID, event.EventMessage, map[string]interface{}{
+        "msgtype":  "m.file",
+        "body":     name,
+        "filename": name,
+        "url":      upload.ContentURI.CUString(),
+        "info": map[string]interface{}{
+            "mimetype": "application/gzip",
+            "size":     size,
+        },
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": eventID,
+            },
+        },
+    })
+    if err != nil {
+        logFor(ctx).Error("Failed to send !dump file", "err", err)
+        return
+    }
+    logFor(ctx).Info("!dump uploaded", "rows", rows, "bytes", size)
+}
+
+// writeDump writes the catalog as gzipped CSV to w and returns the number of
+// rows and compressed bytes written
+func (b *Bot) writeDump(ctx context.Context, w io.Writer) (int, int64, error) {
+    counter := &countingWriter{w: w}
+    gz := gzip.NewWriter(counter)
+    out := csv.NewWriter(gz)
+    if err := out.Write([]string{"section", "console", "file", "url"}); err != nil {
+        return 0, 0, err
+    }
+
+    rows, err := b.db.QueryContext(ctx, "SELECT section, console, file, rawurl FROM files WHERE "+b.live()+" ORDER BY section, console, file")
+    if err != nil {
+        return 0, 0, err
+    }
+    defer rows.Close()
+    n := 0
+    for rows.Next() {
+        var r resultRow
+        if err := rows.Scan(&r.Section, &r.Console, &r.File, &r.Rawurl); err != nil {
+            return 0, 0, err
+        }
+        if err := out.Write([]string{r.Section, r.Console, r.File, r.Rawurl}); err != nil {
+            return 0, 0, err
+        }
+        n++
+        if n > maxDumpRows || counter.n > maxDumpBytes {
+            return 0, 0, userErrorf("dump_too_big", maxDumpRows, maxDumpBytes>>20)
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return 0, 0, err
+    }
+    out.Flush()
+    if err := out.Error(); err != nil {
+        return 0, 0, err
+    }
+    if err := gz.Close(); err != nil {
+        return 0, 0, err
+    }
+    return n, counter.n, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+    w io.Writer
+    n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+    n, err := c.w.Write(p)
+    c.n += int64(n)
+    return n, err
+}
+
+// cacheStats counts lookups in one of the bot's caches. Callers hold the
+// cache's own mutex.
+type cacheStats struct {
+    hits   int
+    misses int
+}
+
+func (s *cacheStats) record(hit bool) {
+    if hit {
+        s.hits++
+    } else {
+        s.misses++
+    }
+}
+
+// handleCache implements !cache stats and !cache clear. Clearing only drops
+// cached lookups and remembered state; running searches are unaffected and
+// anything needed again is simply fetched again.
+func (b *Bot) handleCache(ctx context.Context, ev *event.Event, args []string) {
+    if len(args) != 1 || (args[0] != "stats" && args[0] != "clear") {
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "usage_cache"))
+        return
+    }
+    clearing := args[0] == "clear"
+    var lines []string
+    cleared := 0
+    lookups := func(name string, mu *sync.Mutex, size func() int, stats *cacheStats, reset func()) {
+        mu.Lock()
+        defer mu.Unlock()
+        if clearing {
+            cleared += size()
+            reset()
+            *stats = cacheStats{}
+            return
+        }
+        lines = append(lines, b.msg(ev.RoomID, "cache_lookups", name, size(), stats.hits, stats.misses))
+    }
+    entries := func(name string, mu *sync.Mutex, size func() int, reset func()) {
+        mu.Lock()
+        defer mu.Unlock()
+        if clearing {
+            cleared += size()
+            reset()
+            return
+        }
+        lines = append(lines, b.msg(ev.RoomID, "cache_entries", name, size()))
+    }
+
+    lookups("upstream listings", &b.upstream.mu, func() int { return len(b.upstream.entries) }, &b.upstream.stats,
+        func() { b.upstream.entries = map[string]upstreamListing{} })
+    lookups("DM checks", &b.dms.mu, func() int { return len(b.dms.rooms) }, &b.dms.stats,
+        func() { b.dms.rooms = map[id.RoomID]dmEntry{} })
+    lookups("power levels", &b.powerLevels.mu, func() int { return len(b.powerLevels.rooms) }, &b.powerLevels.stats,
+        func() { b.powerLevels.rooms = map[id.RoomID]*event.PowerLevelsEventContent{} })
+    entries("paged results", &b.pages.mu, func() int { return len(b.pages.pages) },
+        func() { b.pages.pages = map[id.EventID]*pagedResult{} })
+    entries("rejected searches", &b.rejected.mu, func() int { return len(b.rejected.queries) },
+        func() {
+            b.rejected.queries = map[rejectedKey]string{}
+            b.rejected.strikes = map[id.UserID][]time.Time{}
+        })
+    entries("!more listings", &b.more.mu, func() int { return len(b.more.cursors) },
+        func() { b.more.cursors = map[moreKey]*moreCursor{} })
+    entries("room cooldowns", &b.cooldown.mu, func() int { return len(b.cooldown.last) },
+        func() { b.cooldown.last = map[id.RoomID]time.Time{} })
+    entries("user rate limits", &b.userLimit.mu, func() int { return len(b.userLimit.buckets) },
+        func() { b.userLimit.buckets = map[id.UserID]*userBucket{} })
+
+    if clearing {
+        logFor(ctx).Info("Caches cleared", "entries", cleared)
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "cache_cleared", cleared))
+        return
+    }
+    b.sendReply(ctx, ev.RoomID, ev.ID, strings.Join(lines, "\n"))
+}
+
+// powerLevelCache keeps each room's m.room.power_levels content. Entries are
+// fetched on first use and replaced as new state arrives through sync.
+type powerLevelCache struct {
+    mu    sync.Mutex
+    rooms map[id.RoomID]*event.PowerLevelsEventContent
+    stats cacheStats
+}
+
+func newPowerLevelCache() *powerLevelCache {
+    return &powerLevelCache{rooms: map[id.RoomID]*event.PowerLevelsEventContent{}}
+}
+
+func (c *powerLevelCache) set(roomID id.RoomID, pl *event.PowerLevelsEventContent) {
+    c.mu.Lock()
+    c.rooms[roomID] = pl
+    c.mu.Unlock()
+}
+
+// get returns the power levels of roomID, or nil if they can't be fetched
+func (c *powerLevelCache) get(ctx context.Context, client *mautrix.Client, roomID id.RoomID) *event.PowerLevelsEventContent {
+    c.mu.Lock()
+    pl, ok := c.rooms[roomID]
+    c.stats.record(ok)
+    c.mu.Unlock()
+    if ok {
+        return pl
+    }
+    pl = &event.PowerLevelsEventContent{}
+    if err := client.StateEvent(ctx, roomID, event.StatePowerLevels, "", pl); err != nil {
+        logFor(ctx).Warn("Could not fetch power levels", "levels_of", roomID, "err", err)
+        return nil
+    }
+    c.set(roomID, pl)
+    return pl
+}
+
+// serveAPI runs the read-only HTTP/JSON search API
+func (b *Bot) serveAPI(ctx context.Context, addr string) {
+    mux := http.NewServeMux()
+    // /search was the first path; /api/search keeps the API apart from
+    // anything else served on the same host
+    mux.HandleFunc("/search", b.handleAPISearch)
+    mux.HandleFunc("/api/search", b.handleAPISearch)
+    if b.config().API.Web {
+        mux.HandleFunc("/", b.handleWeb)
+    }
+    listenAndServe(ctx, "HTTP API", addr, mux)
+}
+
+// listenAndServe serves handler on addr until ctx is done
+func listenAndServe(ctx context.Context, name, addr string, handler http.Handler) {
+    server := &http.Server{
+        Addr:              addr,
+        Handler:           handler,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+    }()
+    slog.Info(name+" listening", "addr", addr)
+    if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        slog.Error(name+" stopped", "err", err)
+    }
+}
+
+// serveMetrics serves GET /metrics in the Prometheus text format
+func serveMetrics(ctx context.Context, addr string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        metrics.writeTo(w)
+    })
+    listenAndServe(ctx, "Metrics", addr, mux)
+}
+
+// metrics counts what the bot does for /metrics
+var metrics = newBotMetrics()
+
+// latencyBuckets are the upper bounds of the search latency histogram, in
+// seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type botMetrics struct {
+    mu           sync.Mutex
+    commands     map[string]int64 // by command
+    searches     map[string]int64 // by resultBucket
+    sendErrors   int64
+    syncRestarts int64
+    latency      []int64 // per latencyBuckets, not cumulative
+    latencySum   float64
+    latencyCount int64
+}
+
+func newBotMetrics() *botMetrics {
+    return &botMetrics{
+        commands: map[string]int64{},
+        searches: map[string]int64{},
+        latency:  make([]int64, len(latencyBuckets)),
+    }
+}
+
+// resultBucket groups result counts into a few labels, so graphs can tell
+// empty searches from over-broad ones
+func resultBucket(n int) string {
+    switch {
+    case n == 0:
+        return "0"
+    case n == 1:
+        return "1"
+    case n <= 10:
+        return "2-10"
+    case n <= 100:
+        return "11-100"
+    }
+    return "100+"
+}
+
+func (m *botMetrics) command(name string) {
+    m.mu.Lock()
+    m.commands[name]++
+    m.mu.Unlock()
+}
+
+func (m *botMetrics) search(results int, took time.Duration) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.searches[resultBucket(results)]++
+    secs := took.Seconds()
+    for i, bound := range latencyBuckets {
+        if secs <= bound {
+            m.latency[i]++
+            break
+        }
+    }
+    m.latencySum += secs
+    m.latencyCount++
+}
+
+func (m *botMetrics) sendError() {
+    m.mu.Lock()
+    m.sendErrors++
+    m.mu.Unlock()
+}
+
+func (m *botMetrics) syncRestart() {
+    m.mu.Lock()
+    m.syncRestarts++
+    m.mu.Unlock()
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format
+func (m *botMetrics) writeTo(w io.Writer) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    labeled := func(name, help, label string, values map[string]int64) {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+        keys := make([]string, 0, len(values))
+        for k := range values {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+        }
+    }
+    labeled("romsbot_commands_total", "Commands handled.", "command", m.commands)
+    labeled("romsbot_searches_total", "Searches run, by number of results.", "results", m.searches)
+    fmt.Fprintf(w, "# HELP romsbot_send_errors_total Matrix sends that failed.\n# TYPE romsbot_send_errors_total counter\nromsbot_send_errors_total %d\n", m.sendErrors)
+    fmt.Fprintf(w, "# HELP romsbot_sync_restarts_total Sync loop restarts after a rejected access token.\n# TYPE romsbot_sync_restarts_total counter\nromsbot_sync_restarts_total %d\n", m.syncRestarts)
+
+    fmt.Fprintf(w, "# HELP romsbot_search_duration_seconds Search query latency.\n# TYPE romsbot_search_duration_seconds histogram\n")
+    var cumulative int64
+    for i, bound := range latencyBuckets {
+        cumulative += m.latency[i]
+        fmt.Fprintf(w, "romsbot_search_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+    }
+    fmt.Fprintf(w, "romsbot_search_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+    fmt.Fprintf(w, "romsbot_search_duration_seconds_sum %g\n", m.latencySum)
+    fmt.Fprintf(w, "romsbot_search_duration_seconds_count %d\n", m.latencyCount)
+}
+
+type apiSearchResponse struct {
+    Query   string      `json:"query"`
+    Offset  int         `json:"offset"`
+    Limit   int         `json:"limit"`
+    More    bool        `json:"more"`
+    Results []resultRow `json:"results"`
+}
+
+// handleAPISearch serves GET /api/search?q=...&limit=...&offset=...
+func (b *Bot) handleAPISearch(w http.ResponseWriter, r *http.Request) {
+    const defaultLimit = 50
+    const maxLimit = 1000
+
+    if r.Method != http.MethodGet {
+        writeAPIError(w, http.StatusMethodNotAllowed, "only GET is supported")
+        return
+    }
+    q := strings.TrimSpace(r.URL.Query().Get("q"))
+    if q == "" {
+        writeAPIError(w, http.StatusBadRequest, "missing q parameter")
+        return
+    }
+    limit, err := intParam(r, "limit", defaultLimit)
+    if err != nil || limit < 1 || limit > maxLimit {
+        writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+        return
+    }
+    offset, err := intParam(r, "offset", 0)
+    if err != nil || offset < 0 {
+        writeAPIError(w, http.StatusBadRequest, "offset must be a non-negative number")
+        return
+    }
+
+    positives, negatives, atArg, opts, err := b.parseQuery(r.Context(), q, "", "")
+    if err != nil {
+        writeAPIError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    results, more, err := b.searchPage(r.Context(), positives, negatives, atArg, opts, offset, limit)
+    if errors.Is(err, errTooManyTerms) || errors.Is(err, errTooManyToSort) {
+        writeAPIError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    if errors.Is(err, context.DeadlineExceeded) {
+        writeAPIError(w, http.StatusGatewayTimeout, "search timed out")
+        return
+    }
+    if err != nil {
+        slog.Error("API search error", "query", q, "err", err)
+        writeAPIError(w, http.StatusInternalServerError, "search failed")
+        return
+    }
+    resp := apiSearchResponse{Query: q, Offset: offset, Limit: limit, Results: results, More: more}
+    if resp.Results == nil {
+        resp.Results = []resultRow{}
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
+
+var errTooManyToSort = userErrorf("too_many_to_sort", maxPostFilterCandidates)
+
+// searchPage returns limit rows from offset on, and whether there are more,
+// after the same 1g1r, sorting and merging as !roms. SQL pages in name
+// order, so anything but relevance reads every candidate, up to
+// maxPostFilterCandidates, and reorders or folds them before cutting the
+// page. Relevance only reorders the page, as SQL roughly ranks by it
+// already.
+func (b *Bot) searchPage(ctx context.Context, positives, negatives []string, atArg *string, opts searchOptions, offset, limit int) ([]resultRow, bool, error) {
+    wholeSet := opts.Sort == "newest" || opts.Sort == "region-priority" ||
+        opts.OneGame || opts.Group == "region" || opts.Merge == "region"
+    if !wholeSet {
+        opts.Offset = offset
+        results, err := b.search(ctx, positives, negatives, atArg, opts, limit)
+        if err != nil {
+            return nil, false, err
+        }
+        more := len(results) > limit
+        if more {
+            results = results[:limit]
+        }
+        if opts.Sort == "relevance" {
+            sortByRelevance(results, positives)
+        }
+        return results, more, nil
+    }
+
+    results, err := b.search(ctx, positives, negatives, atArg, opts, maxPostFilterCandidates)
+    if err != nil {
+        return nil, false, err
+    }
+    if len(results) > maxPostFilterCandidates {
+        return nil, false, errTooManyToSort
+    }
+    priority := b.config().Bot.regionPriority()
+    if opts.OneGame {
+        results = oneGameOneROM(results, priority)
+    }
+    switch opts.Sort {
+    case "relevance":
+        sortByRelevance(results, positives)
+    case "newest":
+        sortByNewest(results)
+    case "region-priority":
+        sortByRegionPriority(results, priority)
+    }
+    if opts.Group == "region" {
+        sortByRegionGroup(results)
+    }
+    if opts.Merge == "region" {
+        results = mergeRegions(results)
+    }
+    if offset >= len(results) {
+        return nil, false, nil
+    }
+    results = results[offset:]
+    more := len(results) > limit
+    if more {
+        results = results[:limit]
+    }
+    return results, more, nil
+}
+
+// webPageSize is how many results a web search page shows
+const webPageSize = 50
+
+// webPage is what webTemplate renders: the section list, one section's
+// consoles, or a page of search results
+type webPage struct {
+    Query    string
+    Room     string // matrix.to link to the bot's room
+    Error    string
+    Sections []webSection
+    Section  string
+    Consoles []groupCount
+    Searched bool
+    Results  []resultRow
+    // ShowSource labels results with their mirror when there are several
+    ShowSource bool
+    Offset     int
+    Prev       int // offset of the previous page, -1 on the first
+    Next       int // offset of the next page, 0 on the last
+}
+
+type webSection struct {
+    Name     string
+    Consoles int
+    Files    int
+}
+
+var webTemplate = template.Must(template.New("web").Funcs(template.FuncMap{
+    "size":    humanSize,
+    "console": func(name string) string { return "@" + strconv.Quote(name) },
+    "number":  func(offset, i int) int { return offset + i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Query}}{{.Query}} - {{end}}ROMs</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; padding: 0 1em; }
+input[type=search] { width: 70%; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid #ddd; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1><a href="/">ROMs</a></h1>
+<form action="/">
+<input type="search" name="q" value="{{.Query}}" placeholder="mario kart -europe" autofocus>
+<button>Search</button>
+</form>
+{{if .Room}}<p>Also in Matrix: <a href="{{.Room}}">the ROMs room</a></p>{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Searched}}
+{{if .Results}}
+<table>
+<tr><th>#</th><th>Section</th><th>Console</th><th>File</th></tr>
+{{range $i, $r := .Results}}<tr><td>{{number $.Offset $i}}</td><td>{{$r.Section}}</td><td>{{$r.Console}}</td><td>{{if $r.Links}}{{$r.File}}:{{range $r.Links}} <a href="{{.URL}}">{{.Label}}</a>{{end}}{{else}}<a href="{{$r.Rawurl}}">{{$r.File}}</a>{{end}}{{if $r.Size}} ({{size $r.Size}}){{end}}{{if $r.InDat}} 📋{{end}}{{if $.ShowSource}}{{with $r.Source}} [{{.}}]{{end}}{{end}}</td></tr>
+{{end}}</table>
+<p>{{if ge .Prev 0}}<a href="/?q={{.Query}}&amp;offset={{.Prev}}">◀ Previous</a> {{end}}{{if .Next}}<a href="/?q={{.Query}}&amp;offset={{.Next}}">Next ▶</a>{{end}}</p>
+{{else if not .Error}}<p>No results.</p>{{end}}
+{{else if .Section}}
+<h2>{{.Section}}</h2>
+<ul>
+{{range .Consoles}}<li><a href="/?q={{console .Name}}">{{.Name}}</a> ({{.Count}})</li>
+{{end}}</ul>
+{{else}}
+<h2>Sections</h2>
+<ul>
+{{range .Sections}}<li><a href="/?section={{.Name}}">{{.Name}}</a>: {{.Files}} files in {{.Consoles}} consoles</li>
+{{end}}</ul>
+{{end}}
+</body>
+</html>
+`))
+
+// handleWeb serves the web page: the sections at /, a section's consoles at
+// /?section=..., and search results at /?q=...&offset=...
+func (b *Bot) handleWeb(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+        http.NotFound(w, r)
+        return
+    }
+    if r.Method != http.MethodGet {
+        http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+        return
+    }
+    ctx := r.Context()
+    page := webPage{
+        Query:   strings.TrimSpace(r.URL.Query().Get("q")),
+        Section: r.URL.Query().Get("section"),
+        Prev:    -1,
+    }
+    if room := b.config().Matrix.Room; room != "" {
+        page.Room = id.RoomID(room).URI().MatrixToURL()
+    }
+    status := http.StatusOK
+
+    var err error
+    switch {
+    case page.Query != "":
+        page.Searched = true
+        page.Offset, _ = intParam(r, "offset", 0)
+        if page.Offset < 0 {
+            page.Offset = 0
+        }
+        var more bool
+        page.Results, more, err = b.webSearch(ctx, page.Query, page.Offset)
+        var ue *userError
+        if errors.As(err, &ue) || errors.Is(err, errTooManyTerms) {
+            page.Error = b.errorText("", err)
+            status = http.StatusBadRequest
+            err = nil
+            break
+        }
+        if errors.Is(err, context.DeadlineExceeded) {
+            page.Error = b.msg("", "search_timed_out")
+            status = http.StatusGatewayTimeout
+            err = nil
+            break
+        }
+        if more {
+            page.Next = page.Offset + webPageSize
+        }
+        if page.Offset > 0 {
+            page.Prev = page.Offset - webPageSize
+            if page.Prev < 0 {
+                page.Prev = 0
+            }
+        }
+        page.ShowSource = b.sources && len(b.config().Sources) > 0
+    case page.Section != "":
+        page.Consoles, err = b.sectionConsoles(ctx, page.Section)
+    default:
+        page.Sections, err = b.webSections(ctx)
+    }
+    if err != nil {
+        slog.Error("Web page failed", "query", page.Query, "err", err)
+        page.Error = "Search failed, try again later."
+        status = http.StatusInternalServerError
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.WriteHeader(status)
+    if err := webTemplate.Execute(w, page); err != nil {
+        slog.Warn("Failed to write web page", "err", err)
+    }
+}
+
+// webSearch runs a web search for the page at offset, and tells whether
+// there is a next one
+func (b *Bot) webSearch(ctx context.Context, query string, offset int) ([]resultRow, bool, error) {
+    positives, negatives, atArg, opts, err := b.parseQuery(ctx, query, "", "")
+    if err != nil {
+        return nil, false, err
+    }
+    return b.searchPage(ctx, positives, negatives, atArg, opts, offset, webPageSize)
+}
+
+// webSections lists the sections with their console and file counts
+func (b *Bot) webSections(ctx context.Context) ([]webSection, error) {
+    rows, err := b.db.QueryContext(ctx,
+        "SELECT section, COUNT(DISTINCT console), COUNT(*) FROM files WHERE "+b.live()+" GROUP BY section ORDER BY section")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var sections []webSection
+    for rows.Next() {
+        var s webSection
+        if err := rows.Scan(&s.Name, &s.Consoles, &s.Files); err != nil {
+            return nil, err
+        }
+        sections = append(sections, s)
+    }
+    return sections, rows.Err()
+}
+
+// sectionConsoles lists the consoles of section with their file counts
+func (b *Bot) sectionConsoles(ctx context.Context, section string) ([]groupCount, error) {
+    rows, err := b.db.QueryContext(ctx,
+        "SELECT console, COUNT(*) FROM files WHERE "+b.live()+" AND section = ? GROUP BY console ORDER BY console", section)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var consoles []groupCount
+    for rows.Next() {
+        var c groupCount
+        if err := rows.Scan(&c.Name, &c.Count); err != nil {
+            return nil, err
+        }
+        consoles = append(consoles, c)
+    }
+    return consoles, rows.Err()
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+    v := r.URL.Query().Get(name)
+    if v == "" {
+        return def, nil
+    }
+    return strconv.Atoi(v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        slog.Warn("Failed to write API response", "err", err)
+    }
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+    writeJSON(w, status, map[string]string{"error": msg})
+}
+
+type pref struct {
+    Key   string
+    Value string
+}
+
+func (b *Bot) loadPrefs(ctx context.Context, userID id.UserID) ([]pref, error) {
+    rows, err := b.db.QueryContext(ctx, "SELECT key, value FROM prefs WHERE user_id = ? ORDER BY key", userID.String())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var prefs []pref
+    for rows.Next() {
+        var p pref
+        if err := rows.Scan(&p.Key, &p.Value); err != nil {
+            return nil, err
+        }
+        prefs = append(prefs, p)
+    }
+    return prefs, rows.Err()
+}
+
+// applyPrefs adds the user's saved options as key:value terms, unless the
+// query already sets that option inline
+func applyPrefs(terms []string, prefs []pref) []string {
+    for _, p := range prefs {
+        overridden := false
+        for _, t := range terms {
+            if key, _, ok := strings.Cut(t, ":"); ok && strings.EqualFold(key, p.Key) {
+                overridden = true
+                break
+            }
+        }
+        if !overridden {
+            terms = append(terms, p.Key+":"+p.Value)
+        }
+    }
+    return terms
+}
+
+// handlePref implements !pref set/show/clear
+func (b *Bot) handlePref(ctx context.Context, ev *event.Event, args []string) {
+    usage := b.msg(ev.RoomID, "usage_pref")
+    if len(args) == 0 {
+        b.sendReply(ctx, ev.RoomID, ev.ID, usage)
+        return
+    }
+    user := ev.Sender.String()
+    switch args[0] {
+    case "set":
+        if len(args) < 3 {
+            b.sendReply(ctx, ev.RoomID, ev.ID, usage)
+            return
+        }
+        key := strings.ToLower(args[1])
+        value := strings.Join(args[2:], " ")
+        // Only accept what parseOptions would accept inline
+        rest, _, err := parseOptions([]string{key + ":" + value})
+        if err != nil {
+            b.sendReply(ctx, ev.RoomID, ev.ID, b.errorText(ev.RoomID, err))
+            return
+        }
+        if len(rest) > 0 {
+            b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "unknown_option", key))
+            return
+        }
+        _, err = b.db.ExecContext(ctx,
+            "INSERT INTO prefs(user_id, key, value) VALUES (?, ?, ?) ON CONFLICT(user_id, key) DO UPDATE SET value = excluded.value", user, key, value)
+        if err != nil {
+            b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "pref_save_failed", err))
+            return
+        }
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "pref_saved", key, value))
+    case "show":
+        prefs, err := b.loadPrefs(ctx, ev.Sender)
+        if err != nil {
+            b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "pref_load_failed", err))
+            return
+        }
+        if len(prefs) == 0 {
+            b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "no_prefs"))
+            return
+        }
+        var lines []string
+        for _, p := range prefs {
+            lines = append(lines, p.Key+":"+p.Value)
+        }
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "your_prefs", strings.Join(lines, " ")))
+    case "clear":
+        var err error
+        if len(args) > 1 {
+            _, err = b.db.ExecContext(ctx, "DELETE FROM prefs WHERE user_id = ? AND key = ?", user, strings.ToLower(args[1]))
+        } else {
+            _, err = b.db.ExecContext(ctx, "DELETE FROM prefs WHERE user_id = ?", user)
+        }
+        if err != nil {
+            b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "pref_clear_failed", err))
+            return
+        }
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "prefs_cleared"))
+    default:
+        b.sendReply(ctx, ev.RoomID, ev.ID, usage)
+    }
+}
+
+// throttled applies room_cooldown and the per-user limits to a request from
+// sender, and if it has to wait reacts to eventID with ⏳. Only the first
+// throttled request gets a notice, the rest of a flood just gets the
+// reaction.
+func (b *Bot) throttled(ctx context.Context, roomID id.RoomID, sender id.UserID, eventID id.EventID) bool {
+    cfg := b.config().Bot
+    // Room-wide flood protection, on top of any per-user limits
+    if !b.cooldown.allow(roomID, cfg.RoomCooldown) {
+        b.react(ctx, roomID, eventID, "⏳")
+        return true
+    }
+    if wait, notice := b.userLimit.allow(sender, cfg.UserBurst, cfg.UserRefill); wait > 0 {
+        b.react(ctx, roomID, eventID, "⏳")
+        if notice {
+            b.sendReply(ctx, roomID, eventID, b.msg(roomID, "slow_down", wait.Round(time.Second)))
+        }
+        return true
+    }
+    return false
+}
+
+// roomCooldown tracks when each room last had a command handled
+type roomCooldown struct {
+    mu   sync.Mutex
+    last map[id.RoomID]time.Time
+}
+
+func newRoomCooldown() *roomCooldown {
+    return &roomCooldown{last: map[id.RoomID]time.Time{}}
+}
+
+// allow reports whether a command may run in roomID now, and if so starts a
+// new cooldown. An interval of 0 always allows.
+func (c *roomCooldown) allow(roomID id.RoomID, interval time.Duration) bool {
+    if interval <= 0 {
+        return true
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if time.Since(c.last[roomID]) < interval {
+        return false
+    }
+    c.last[roomID] = time.Now()
+    return true
+}
+
+// userLimiter is a token bucket per sender: a user may run user_burst
+// commands in a row and gets one more every user_refill
+type userLimiter struct {
+    mu      sync.Mutex
+    buckets map[id.UserID]*userBucket
+}
+
+type userBucket struct {
+    tokens   float64
+    last     time.Time
+    notified bool // already told they are throttled
+}
+
+func newUserLimiter() *userLimiter {
+    return &userLimiter{buckets: map[id.UserID]*userBucket{}}
+}
+
+// allow takes a token from userID's bucket. When there is none it returns how
+// long until the next one, and notice is set only for the first refusal since
+// the user last got a token. A refill of 0 always allows.
+func (l *userLimiter) allow(userID id.UserID, burst int, refill time.Duration) (wait time.Duration, notice bool) {
+    if refill <= 0 {
+        return 0, false
+    }
+    if burst < 1 {
+        burst = 1
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    bucket, ok := l.buckets[userID]
+    if !ok {
+        bucket = &userBucket{tokens: float64(burst), last: now}
+        l.buckets[userID] = bucket
+    }
+    bucket.tokens += float64(now.Sub(bucket.last)) / float64(refill)
+    if bucket.tokens > float64(burst) {
+        bucket.tokens = float64(burst)
+    }
+    bucket.last = now
+    if bucket.tokens >= 1 {
+        bucket.tokens--
+        bucket.notified = false
+        l.prune(now, burst, refill)
+        return 0, false
+    }
+    notice = !bucket.notified
+    bucket.notified = true
+    return time.Duration((1 - bucket.tokens) * float64(refill)), notice
+}
+
+// prune drops buckets that have refilled completely, they behave the same as
+// a missing one
+func (l *userLimiter) prune(now time.Time, burst int, refill time.Duration) {
+    if len(l.buckets) < 1000 {
+        return
+    }
+    for userID, bucket := range l.buckets {
+        if bucket.tokens+float64(now.Sub(bucket.last))/float64(refill) >= float64(burst) {
+            delete(l.buckets, userID)
+        }
+    }
+}
+
+// rejectedQueries remembers each user's last search that was rejected as too
+// broad, per room, so !expand can list its first page
+type rejectedQueries struct {
+    mu      sync.Mutex
+    queries map[rejectedKey]string
+    strikes map[id.UserID][]time.Time // recent rejections per sender
+}
+
+const (
+    // rejectionWindow is how long a rejection counts towards rejectionHintAt
+    rejectionWindow = 10 * time.Minute
+    // rejectionHintAt is the rejection that gets the !help hint instead of
+    // the usual notice; later ones within the window only get ❌
+    rejectionHintAt = 3
+)
+
+type rejectedKey struct {
+    room id.RoomID
+    user id.UserID
+}
+
+func newRejectedQueries() *rejectedQueries {
+    return &rejectedQueries{queries: map[rejectedKey]string{}, strikes: map[id.UserID][]time.Time{}}
+}
+
+func (r *rejectedQueries) remember(roomID id.RoomID, userID id.UserID, query string) {
+    r.mu.Lock()
+    r.queries[rejectedKey{roomID, userID}] = query
+    r.mu.Unlock()
+}
+
+// strike records a rejection for userID and returns how many they've had
+// within rejectionWindow, this one included
+func (r *rejectedQueries) strike(userID id.UserID) int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now()
+    recent := r.strikes[userID][:0]
+    for _, t := range r.strikes[userID] {
+        if now.Sub(t) < rejectionWindow {
+            recent = append(recent, t)
+        }
+    }
+    recent = append(recent, now)
+    r.strikes[userID] = recent
+    return len(recent)
+}
+
+// take returns and forgets the user's last rejected query
+func (r *rejectedQueries) take(roomID id.RoomID, userID id.UserID) (string, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    key := rejectedKey{roomID, userID}
+    query, ok := r.queries[key]
+    delete(r.queries, key)
+    return query, ok
+}
+
+const (
+    // historyShown is how many searches !history lists
+    historyShown = 10
+    // historyKept is how many searches per user query_log keeps
+    historyKept = 50
+)
+
+// logQuery adds a search to the sender's history, dropping their oldest
+// entries beyond historyKept
+func (b *Bot) logQuery(ctx context.Context, userID id.UserID, roomID id.RoomID, query string, results int) error {
+    _, err := b.db.ExecContext(ctx,
+        "INSERT INTO query_log(user_id, room_id, query, results, at) VALUES (?, ?, ?, ?, ?)",
+        userID.String(), roomID.String(), query, results, time.Now().Unix())
+    if err != nil {
+        return err
+    }
+    _, err = b.db.ExecContext(ctx, `
+        DELETE FROM query_log WHERE user_id = ? AND id NOT IN (
+            SELECT id FROM query_log WHERE user_id = ? ORDER BY id DESC LIMIT ?)`,
+        userID.String(), userID.String(), historyKept)
+    return err
+}
+
+// recentQueries returns the user's last searches, newest first, without
+// repeats
+func (b *Bot) recentQueries(ctx context.Context, userID id.UserID) ([]string, error) {
+    rows, err := b.db.QueryContext(ctx, `
+        SELECT query FROM query_log WHERE user_id = ?
+        GROUP BY query ORDER BY MAX(id) DESC LIMIT ?`,
+        userID.String(), historyShown)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var queries []string
+    for rows.Next() {
+        var q string
+        if err := rows.Scan(&q); err != nil {
+            return nil, err
+        }
+        queries = append(queries, q)
+    }
+    return queries, rows.Err()
+}
+
+// handleHistory implements !history and !history <n>
+func (b *Bot) handleHistory(ctx context.Context, ev *event.Event, args []string) {
+    queries, err := b.recentQueries(ctx, ev.Sender)
+    if err != nil {
+        b.searchFailed(ctx, ev.RoomID, ev.ID, err)
+        return
+    }
+    if len(args) == 0 {
+        if len(queries) == 0 {
+            b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "no_history"))
+            return
+        }
+        lines := []string{b.msg(ev.RoomID, "history_header")}
+        prefix := b.config().prefix(ev.RoomID)
+        for i, q := range queries {
+            lines = append(lines, fmt.Sprintf("%d. %sroms %s", i+1, prefix, q))
+        }
+        b.sendReply(ctx, ev.RoomID, ev.ID, strings.Join(lines, "\n"))
+        return
+    }
+    n, err := strconv.Atoi(args[0])
+    if err != nil || len(args) != 1 || n < 1 || n > len(queries) {
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "usage_history", len(queries)))
+        return
+    }
+    b.runRoms(ctx, ev, queries[n-1], false)
+}
+
+// markSeen records that userID was shown results
+func (b *Bot) markSeen(ctx context.Context, userID id.UserID, results []resultRow) error {
+    tx, err := b.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    stmt, err := tx.PrepareContext(ctx, b.db.Rebind("INSERT INTO seen(user_id, rawurl, seen_at) VALUES (?, ?, ?) ON CONFLICT(user_id, rawurl) DO UPDATE SET seen_at = excluded.seen_at"))
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    now := time.Now().Unix()
+    for _, r := range results {
+        if _, err := stmt.ExecContext(ctx, userID.String(), r.Rawurl, now); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// handleSeen implements !seen clear
+func (b *Bot) handleSeen(ctx context.Context, ev *event.Event, args []string) {
+    if len(args) != 1 || args[0] != "clear" {
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "usage_seen"))
+        return
+    }
+    res, err := b.db.ExecContext(ctx, "DELETE FROM seen WHERE user_id = ?", ev.Sender.String())
+    if err != nil {
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "seen_clear_failed", err))
+        return
+    }
+    n, _ := res.RowsAffected()
+    b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "seen_cleared", n))
+}
+
+// handleParse implements !parse <query>: it echoes back the terms and options
+// as runRoms would see them, including the sender's prefs and room scopes
+func (b *Bot) handleParse(ctx context.Context, ev *event.Event, query string) {
+    roomID := ev.RoomID
+    if query == "" {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "usage_parse"))
+        return
+    }
+    positives, negatives, atArg, opts, err := b.parseQuery(ctx, query, ev.Sender, roomID)
+    if err != nil {
+        b.sendReply(ctx, roomID, ev.ID, b.errorText(roomID, err))
+        return
+    }
+    quoted := func(terms []string) string {
+        if len(terms) == 0 {
+            return b.msg(roomID, "parse_none")
+        }
+        out := make([]string, len(terms))
+        for i, t := range terms {
+            out[i] = strconv.Quote(t)
+        }
+        return strings.Join(out, " ")
+    }
+    lines := []string{
+        b.msg(roomID, "parse_terms", quoted(positives)),
+        b.msg(roomID, "parse_excluded", quoted(negatives)),
+    }
+    if len(opts.Phrases) > 0 || len(opts.NotPhrases) > 0 {
+        words := []string{}
+        for _, p := range opts.Phrases {
+            words = append(words, strconv.Quote(p))
+        }
+        for _, p := range opts.NotPhrases {
+            words = append(words, "-"+strconv.Quote(p))
+        }
+        lines = append(lines, b.msg(roomID, "parse_phrases", strings.Join(words, " ")))
+    }
+    for _, g := range opts.Groups {
+        lines = append(lines, b.msg(roomID, "parse_group", g.String()))
+    }
+    if atArg != nil {
+        lines = append(lines, b.msg(roomID, "parse_console", strconv.Quote(*atArg)))
+    }
+    if len(opts.Scoped) > 0 || len(opts.Excluded) > 0 {
+        scoped := []string{}
+        for _, t := range opts.Scoped {
+            scoped = append(scoped, t.Field+":"+strconv.Quote(t.Value))
+        }
+        for _, t := range opts.Excluded {
+            scoped = append(scoped, "-"+t.Field+":"+strconv.Quote(t.Value))
+        }
+        lines = append(lines, b.msg(roomID, "parse_scoped", strings.Join(scoped, " ")))
+    }
+    if set := describeOptions(opts); len(set) > 0 {
+        lines = append(lines, b.msg(roomID, "parse_options", strings.Join(set, " ")))
+    }
+    b.sendReply(ctx, roomID, ev.ID, strings.Join(lines, "\n"))
+}
+
+// describeOptions lists the modifiers set in opts in the form they're typed
+func describeOptions(opts searchOptions) []string {
+    set := []string{}
+    if opts.Sort != "" && opts.Sort != "name" {
+        set = append(set, "sort:"+opts.Sort)
+    }
+    if opts.YearFrom != 0 {
+        if opts.YearFrom == opts.YearTo {
+            set = append(set, fmt.Sprintf("year:%d", opts.YearFrom))
+        } else {
+            set = append(set, fmt.Sprintf("year:%d-%d", opts.YearFrom, opts.YearTo))
+        }
+    }
+    if opts.AddedDays > 0 {
+        set = append(set, fmt.Sprintf("added:%dd", opts.AddedDays))
+    }
+    if len(opts.Regions) > 0 {
+        set = append(set, "region:"+strings.Join(opts.Regions, ","))
+    }
+    if len(opts.Languages) > 0 {
+        set = append(set, "lang:"+strings.Join(opts.Languages, ","))
+    }
+    if len(opts.Sources) > 0 {
+        set = append(set, "source:"+strings.Join(opts.Sources, ","))
+    }
+    if len(opts.Exts) > 0 {
+        set = append(set, "ext:"+strings.Join(opts.Exts, ","))
+    }
+    if opts.Group != "" {
+        set = append(set, "group:"+opts.Group)
+    }
+    if opts.CountBy != "" {
+        set = append(set, "countby:"+opts.CountBy)
+    }
+    if opts.BIOS != "" {
+        set = append(set, "bios:"+opts.BIOS)
+    }
+    if opts.Format != "" && opts.Format != "list" {
+        set = append(set, "format:"+opts.Format)
+    }
+    if opts.Merge != "" {
+        set = append(set, "merge:"+opts.Merge)
+    }
+    if opts.Paged {
+        set = append(set, "page:on")
+    }
+    if opts.Verbose {
+        set = append(set, "verbose:on")
+    }
+    if opts.Badges {
+        set = append(set, "badges:on")
+    }
+    if opts.First {
+        set = append(set, "first:on")
+    }
+    if opts.OneGame {
+        set = append(set, "1g1r:on")
+    }
+    if opts.NewOnly {
+        set = append(set, "new:only")
+    }
+    if opts.Regex != nil {
+        set = append(set, "re:"+opts.RegexField+":"+strconv.Quote(strings.TrimPrefix(opts.Regex.String(), "(?i)")))
+    }
+    return set
+}
+
+// handleBrowse implements !browse [section]: every section with its consoles
+// underneath, as collapsible <details> in clients that render them
+func (b *Bot) handleBrowse(ctx context.Context, ev *event.Event, filter string) {
+    roomID := ev.RoomID
+    rows, err := b.db.QueryContext(ctx,
+        "SELECT section, console, COUNT(*) FROM files WHERE "+b.live()+" AND LOWER(section) LIKE ? GROUP BY section, console ORDER BY section, console",
+        "%"+strings.ToLower(filter)+"%")
+    if err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    var sections []string
+    consoles := map[string][]groupCount{}
+    for rows.Next() {
+        var section string
+        var c groupCount
+        if err := rows.Scan(&section, &c.Name, &c.Count); err != nil {
+            rows.Close()
+            b.searchFailed(ctx, roomID, ev.ID, err)
+            return
+        }
+        if _, ok := consoles[section]; !ok {
+            sections = append(sections, section)
+        }
+        consoles[section] = append(consoles[section], c)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    if len(sections) == 0 {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "no_sections", filter))
+        return
+    }
+
+    var html strings.Builder
+    var plain strings.Builder
+    for _, section := range sections {
+        heading := section + " " + b.msg(roomID, "n_consoles", len(consoles[section]))
+        // A single section is what was asked for, so show it open
+        if len(sections) == 1 {
+            html.WriteString("<details open>")
+        } else {
+            html.WriteString("<details>")
+        }
+        html.WriteString("<summary><b>" + htmlEscape(heading) + "</b></summary><ul>")
+        plain.WriteString(heading + "\n")
+        for i, console := range consoles[section] {
+            // Leave room for the closing tags and the rest of the sections
+            if html.Len()+plain.Len() > maxMessageBytes-1000 {
+                more := b.msg(roomID, "and_more", len(consoles[section])-i)
+                html.WriteString("<li><i>" + more + "</i></li>")
+                plain.WriteString("  " + more + "\n")
+                break
+            }
+            html.WriteString(fmt.Sprintf("<li>%s: %d</li>", htmlEscape(console.Name), console.Count))
+            plain.WriteString(fmt.Sprintf("  %s: %d\n", console.Name, console.Count))
+        }
+        html.WriteString("</ul></details>")
+    }
+
+    msg := map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain.String(),
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html.String(),
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": ev.ID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, msg); err != nil {
+        logFor(ctx).Error("Failed to send browse listing", "err", err)
+    }
+}
+
+// handleHelp answers !help with the command registry, the search syntax and
+// options, and the limits in effect for the room
+func (b *Bot) handleHelp(ctx context.Context, ev *event.Event) {
+    roomID := ev.RoomID
+    var html, plain strings.Builder
+    section := func(heading string) {
+        if plain.Len() > 0 {
+            plain.WriteString("\n")
+        }
+        plain.WriteString(heading + ":\n")
+        html.WriteString("<p><b>" + htmlEscape(heading) + "</b></p>")
+    }
+    // item writes one "syntax  description" line, with the syntax as code
+    item := func(syntax, desc string) {
+        html.WriteString("<li><code>" + htmlEscape(syntax) + "</code>")
+        plain.WriteString(syntax)
+        if desc != "" {
+            html.WriteString(" " + htmlEscape(desc))
+            plain.WriteString("  " + desc)
+        }
+        html.WriteString("</li>")
+        plain.WriteString("\n")
+    }
+    // lines writes a catalog message one item per line
+    lines := func(key string, code bool) {
+        html.WriteString("<ul>")
+        for _, line := range strings.Split(b.msg(roomID, key), "\n") {
+            if code {
+                syntax, desc, _ := strings.Cut(line, "  ")
+                item(syntax, desc)
+                continue
+            }
+            html.WriteString("<li>" + htmlEscape(line) + "</li>")
+            plain.WriteString(line + "\n")
+        }
+        html.WriteString("</ul>")
+    }
+
+    section(b.msg(roomID, "hdr_commands"))
+    html.WriteString("<ul>")
+    prefix := b.config().prefix(roomID)
+    for _, c := range commandList {
+        usage := prefix + strings.TrimPrefix(c.name, "!")
+        if c.args != "" {
+            usage += " " + c.args
+        }
+        desc := b.msg(roomID, "cmd_"+strings.TrimPrefix(c.name, "!"))
+        if c.admin {
+            desc += " " + b.msg(roomID, "admins_only")
+        }
+        item(usage, desc)
+    }
+    html.WriteString("</ul>")
+
+    section(b.msg(roomID, "hdr_syntax"))
+    lines("help_syntax", false)
+    section(b.msg(roomID, "hdr_options"))
+    lines("help_options", true)
+
+    cfg := b.config().Bot
+    section(b.msg(roomID, "hdr_limits"))
+    html.WriteString("<ul>")
+    limits := []string{b.msg(roomID, "limit_max_results", cfg.maxResults())}
+    if cfg.ResultCap > 0 {
+        limits = append(limits, b.msg(roomID, "limit_result_cap", cfg.ResultCap))
+    }
+    if after := cfg.moreAfter(); after > 0 {
+        limits = append(limits, b.msg(roomID, "limit_more_after", after))
+    }
+    if cfg.DailyQuota > 0 {
+        limits = append(limits, b.msg(roomID, "limit_quota", cfg.DailyQuota))
+    }
+    if cfg.RoomCooldown > 0 {
+        limits = append(limits, b.msg(roomID, "limit_cooldown", cfg.RoomCooldown))
+    }
+    if cfg.UserRefill > 0 {
+        limits = append(limits, b.msg(roomID, "limit_user", max(cfg.UserBurst, 1), cfg.UserRefill))
+    }
+    for _, l := range limits {
+        html.WriteString("<li>" + htmlEscape(l) + "</li>")
+        plain.WriteString(l + "\n")
+    }
+    html.WriteString("</ul>")
+
+    section(b.msg(roomID, "hdr_examples"))
+    lines("help_examples", true)
+
+    notice := map[string]interface{}{
+        "msgtype":        "m.notice",
+        "body":           plain.String(),
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html.String(),
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": ev.ID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, notice); err != nil {
+        logFor(ctx).Error("Failed to send help", "err", err)
+    }
+}
+
+// handleSections implements !sections: each section of the catalog with how
+// many files and consoles it has
+func (b *Bot) handleSections(ctx context.Context, ev *event.Event) {
+    roomID := ev.RoomID
+    rows, err := b.db.QueryContext(ctx,
+        "SELECT section, COUNT(DISTINCT console), COUNT(*) FROM files WHERE "+b.live()+" GROUP BY section ORDER BY section")
+    if err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    var html strings.Builder
+    var plain strings.Builder
+    html.WriteString("<ul>")
+    n := 0
+    for rows.Next() {
+        var section string
+        var consoles, files int
+        if err := rows.Scan(&section, &consoles, &files); err != nil {
+            rows.Close()
+            b.searchFailed(ctx, roomID, ev.ID, err)
+            return
+        }
+        line := b.msg(roomID, "section_counts", section, files, consoles)
+        html.WriteString("<li>" + htmlEscape(line) + "</li>")
+        plain.WriteString(line + "\n")
+        n++
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        b.searchFailed(ctx, roomID, ev.ID, err)
+        return
+    }
+    if n == 0 {
+        b.sendReply(ctx, roomID, ev.ID, b.msg(roomID, "no_results"))
+        return
+    }
+    html.WriteString("</ul>")
+
+    msg := map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain.String(),
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html.String(),
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": ev.ID,
+            },
+        },
+    }
+    if _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, msg); err != nil {
+        logFor(ctx).Error("Failed to send sections", "err", err)
+    }
+}
+
+// quotaDay keys quota rows by UTC date, so counts reset at midnight UTC
+func quotaDay() string {
+    return time.Now().UTC().Format("2006-01-02")
+}
+
+// quotaUsed returns how many result rows userID has received today
+func (b *Bot) quotaUsed(ctx context.Context, userID id.UserID) (int, error) {
+    var used int
+    err := b.db.QueryRowContext(ctx,
+        "SELECT rows FROM quota WHERE user_id = ? AND day = ?", userID.String(), quotaDay(),
+    ).Scan(&used)
+    if err == sql.ErrNoRows {
+        return 0, nil
+    }
+    return used, err
+}
+
+func (b *Bot) addQuotaUsed(ctx context.Context, userID id.UserID, n int) error {
+    day := quotaDay()
+    _, err := b.db.ExecContext(ctx, `
+        INSERT INTO quota(user_id, day, rows) VALUES (?, ?, ?)
+        ON CONFLICT(user_id, day) DO UPDATE SET rows = quota.rows + excluded.rows`,
+        userID.String(), day, n)
+    if err != nil {
+        return err
+    }
+    // Old days are never read again
+    _, err = b.db.ExecContext(ctx, "DELETE FROM quota WHERE day < ?", day)
+    return err
+}
+
+// mirrorHost and mirrorFilesPath locate catalog files on the mirror; rawurls
+// look like https://myrient.erista.me/files/<section>/<console>/<file>
+const (
+    mirrorHost      = "myrient.erista.me"
+    mirrorFilesPath = "/files/"
+)
+
+// parseCatalogURL normalizes a user supplied link into the section, console
+// and file it points at. Escaping differences and http vs https are ignored.
+func parseCatalogURL(raw string) (section, console, file string, err error) {
+    raw = strings.Trim(strings.TrimSpace(raw), "<>")
+    u, err := url.Parse(raw)
+    if err != nil {
+        return "", "", "", userErrorf("not_a_url")
+    }
+    if (u.Scheme != "http" && u.Scheme != "https") || !strings.EqualFold(u.Hostname(), mirrorHost) {
+        return "", "", "", userErrorf("wrong_host", mirrorHost)
+    }
+    if !strings.HasPrefix(u.Path, mirrorFilesPath) {
+        return "", "", "", userErrorf("not_a_file_link")
+    }
+    // u.Path is already unescaped, matching the decoded columns
+    parts := strings.SplitN(strings.TrimPrefix(u.Path, mirrorFilesPath), "/", 3)
+    if len(parts) != 3 || parts[2] == "" {
+        return "", "", "", userErrorf("not_a_file_link")
+    }
+    return parts[0], parts[1], parts[2], nil
+}
+
+// verifyURL replies whether the link is an indexed catalog entry
+func (b *Bot) verifyURL(ctx context.Context, ev *event.Event, raw string) {
+    section, console, file, err := parseCatalogURL(raw)
+    if err != nil {
+        b.react(ctx, ev.RoomID, ev.ID, "❌️")
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "verify_no", b.errorText(ev.RoomID, err)))
+        return
+    }
+    var r resultRow
+    err = b.db.QueryRowContext(ctx, `
+        SELECT section, console, file, rawurl FROM files
+        WHERE (rawurl = ? OR (section = ? AND console = ? AND file = ?)) AND `+b.live()+`
+        LIMIT 1`,
+        strings.TrimSpace(raw), section, console, file,
+    ).Scan(&r.Section, &r.Console, &r.File, &r.Rawurl)
+    if err == sql.ErrNoRows {
+        b.react(ctx, ev.RoomID, ev.ID, "❌️")
+        b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "verify_not_found"))
+        return
+    }
+    if err != nil {
+        b.searchFailed(ctx, ev.RoomID, ev.ID, err)
+        return
+    }
+    b.react(ctx, ev.RoomID, ev.ID, "✅️")
+    b.sendReply(ctx, ev.RoomID, ev.ID, b.msg(ev.RoomID, "verify_yes", r.Section, r.Console, r.File, r.Rawurl))
+}
+
+const (
+    pageSize = 20
+    pageTTL  = time.Hour
+    prevPage = "◀️"
+    nextPage = "▶️"
+)
+
+// pager tracks single-message result listings that can be paged through by
+// reacting to them. Entries are keyed by the bot's result message.
+type pager struct {
+    mu    sync.Mutex
+    pages map[id.EventID]*pagedResult
+}
+
+type pagedResult struct {
+    roomID  id.RoomID
+    owner   id.UserID
+    results []resultRow
+    opts    searchOptions
+    page    int
+    created time.Time
+}
+
+func newPager() *pager {
+    return &pager{pages: map[id.EventID]*pagedResult{}}
+}
+
+func (p *pagedResult) pageCount() int {
+    return (len(p.results) + pageSize - 1) / pageSize
+}
+
+// render returns the plain and HTML content of the current page in lang
+func (p *pagedResult) render(lang string) (string, string) {
+    start := p.page * pageSize
+    end := start + pageSize
+    if end > len(p.results) {
+        end = len(p.results)
+    }
+    plain, html, fit := renderFitting(p.results[start:end], start+1, p.opts, lang)
+    footer := translate(lang, "page_footer", p.page+1, p.pageCount(), prevPage, nextPage)
+    // A page is a single message, so rows that don't fit are left out
+    if omitted := end - start - fit; omitted > 0 {
+        note := translate(lang, "rows_omitted", omitted)
+        plain += note + "\n"
+        html += "<i>" + note + "</i><br>"
+    }
+    return plain + footer, html + "<i>" + footer + "</i>"
+}
+
+// sendPaged posts the first page as a reply and seeds the paging reactions
+func (b *Bot) sendPaged(ctx context.Context, roomID id.RoomID, eventID id.EventID, owner id.UserID, results []resultRow, opts searchOptions) {
+    p := &pagedResult{roomID: roomID, owner: owner, results: results, opts: opts, created: time.Now()}
+    plain, html := p.render(b.config().language(p.roomID))
+    resp, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html,
+        "m.relates_to": map[string]interface{}{
+            "m.in_reply_to": map[string]interface{}{
+                "event_id": eventID,
+            },
+        },
+    })
+    if err != nil {
+        logFor(ctx).Error("Failed to send paged results", "err", err)
+        return
+    }
+    if p.pageCount() < 2 {
+        return
+    }
+
+    b.pages.mu.Lock()
+    for msgID, old := range b.pages.pages {
+        if time.Since(old.created) > pageTTL {
+            delete(b.pages.pages, msgID)
+        }
+    }
+    b.pages.pages[resp.EventID] = p
+    b.pages.mu.Unlock()
+
+    for _, key := range []string{prevPage, nextPage} {
+        if _, err := b.client.SendReaction(ctx, roomID, resp.EventID, key); err != nil {
+            logFor(ctx).Error("Failed to add paging reaction", "err", err)
+        }
+    }
+}
+
+// turnPage edits a paged result message in place when its owner reacts
+func (b *Bot) turnPage(ctx context.Context, sender id.UserID, msgID id.EventID, key string) {
+    if key != prevPage && key != nextPage {
+        return
+    }
+    b.pages.mu.Lock()
+    p, ok := b.pages.pages[msgID]
+    if !ok || p.owner != sender {
+        b.pages.mu.Unlock()
+        return
+    }
+    if key == nextPage && p.page+1 < p.pageCount() {
+        p.page++
+    } else if key == prevPage && p.page > 0 {
+        p.page--
+    } else {
+        b.pages.mu.Unlock()
+        return
+    }
+    plain, html := p.render(b.config().language(p.roomID))
+    roomID := p.roomID
+    b.pages.mu.Unlock()
+
+    newContent := map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           plain,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": html,
+    }
+    _, err := b.client.SendMessageEvent(ctx, roomID, event.EventMessage, map[string]interface{}{
+        "msgtype":        "m.text",
+        "body":           "* " + plain,
+        "format":         "org.matrix.custom.html",
+        "formatted_body": "* " + html,
+        "m.new_content":  newContent,
+        "m.relates_to": map[string]interface{}{
+            "rel_type": "m.replace",
+            "event_id": msgID,
+        },
+    })
+    if err != nil {
+        logFor(ctx).Error("Failed to edit paged results", "err", err)
+    }
+}
+
+// userError is an error meant for the user. Its text comes from the message
+// catalog so it can be shown in the room's language; Error() is English.
+type userError struct {
+    key  string
+    args []interface{}
+}
+
+func userErrorf(key string, args ...interface{}) error {
+    return &userError{key: key, args: args}
+}
+
+func (e *userError) Error() string {
+    return translate("en", e.key, e.args...)
+}
+
+// errorText returns err as shown to users in roomID
+func (b *Bot) errorText(roomID id.RoomID, err error) string {
+    var ue *userError
+    if errors.As(err, &ue) {
+        return b.msg(roomID, ue.key, ue.args...)
+    }
+    return err.Error()
+}
+
+// msg returns the catalog message key in roomID's language, with the
+// commands it mentions written with roomID's command prefix
+func (b *Bot) msg(roomID id.RoomID, key string, args ...interface{}) string {
+    cfg := b.config()
+    return translatePrefixed(cfg.language(roomID), cfg.prefix(roomID), key, args...)
+}
+
+// translate looks key up in lang, falling back to English for languages or
+// keys that have no translation, and fills in args
+func translate(lang, key string, args ...interface{}) string {
+    return translatePrefixed(lang, "!", key, args...)
+}
+
+// commandMention matches a command named in a catalog message, "!roms", or
+// its escaped forms "\!roms" and "!!roms"
+var commandMention = func() *regexp.Regexp {
+    names := make([]string, len(commandList))
+    for i, c := range commandList {
+        names[i] = strings.TrimPrefix(c.name, "!")
+    }
+    return regexp.MustCompile(`!!?(?:` + strings.Join(names, "|") + `)\b`)
+}()
+
+// translatePrefixed is translate for a room whose commands start with
+// prefix instead of "!". Only the catalog text is rewritten, not args.
+func translatePrefixed(lang, prefix, key string, args ...interface{}) string {
+    text, ok := messages[strings.ToLower(lang)][key]
+    if !ok {
+        text, ok = messages["en"][key]
+    }
+    if !ok {
+        slog.Warn("Missing message", "key", key, "lang", lang)
+        return key
+    }
+    if prefix != "!" {
+        text = commandMention.ReplaceAllStringFunc(text, func(m string) string {
+            name := strings.TrimLeft(m, "!")
+            return strings.Repeat(prefix, len(m)-len(name)) + name
+        })
+    }
+    if len(args) == 0 {
+        return text
+    }
+    return fmt.Sprintf(text, args...)
+}
+
+// messages holds the user-facing strings per language. English is the
+// reference, other languages may leave keys out.
+var messages = map[string]map[string]string{
+    "en": {
+        "help_syntax": `Quote a phrase to match it as whole words, e.g. !roms "mega man" -"x" leaves out Mega Man X but not Mega Man Xtreme
+Pipe results into more filters with |, e.g. !roms zelda | file:usa
+Use OR and parentheses for alternatives, e.g. !roms (mario OR zelda) -europe
+React or reply to a listing with a result number, e.g. 3️⃣, for its details
+Write \!roms or !!roms to mention a command without running it`,
+        "help_options": `sort:relevance  exact title matches first (default sort:name)
+sort:newest  latest dated files first (from dates in the file name)
+sort:region-priority  preferred regions first (USA, World, Europe, Japan by default)
+year:1998 or year:1995-2000  only files with a year in their name
+added:7d  only files added to the catalog in the last 7 days
+region:usa or region:usa,europe  only files tagged with one of these regions
+lang:fr  only files tagged with one of these languages, e.g. lang:en,de
+source:archive.org  only links from these mirrors, e.g. source:myrient,archive.org
+ext:chd  only these file types, e.g. ext:7z,zip
+group:region  group results under USA, Europe, Japan and Other
+section:x console:x file:x  match only that column, e.g. console:"Nintendo 64"
+-section:x -console:x -file:x  exclude only matches in that column, e.g. -file:demo
+countby:console or countby:section  only show how many matches each has
+bios:only or bios:exclude  only or no BIOS/system files
+format:table  show results as a table
+format:names  only list file names, without duplicates
+format:curl  wget commands to download the results
+merge:region  one line per title with a link for each region
+page:on  one message you page through with ◀️ ▶️ reactions
+verbose:on  show which fields each result matched
+badges:on  flags and languages in front of each file, e.g. 🇪🇺 [EN/FR]
+first:on  only the best match as one link (sorted by relevance unless sort: is given)
+1g1r:on  one file per game: final releases, best region (region_priority), latest revision
+new:only  only results you haven't been shown before`,
+        "help_examples": `!roms mario @nintendo -sports
+!roms "super mario 64" sort:relevance
+!roms zelda @"Nintendo 3DS" -digital`,
+        "no_jobs":                "No searches running.",
+        "usage_cancel":           "Usage: !cancel <job id>",
+        "no_such_job":            "No running search #%d",
+        "job_cancelled":          "Cancelled search #%d",
+        "usage_verify":           "Usage: !verify <url>",
+        "usage_queue":            "Usage: !queue title one, title two, ... (or one title per line)",
+        "too_many_titles":        "Too many titles: %d (max %d)",
+        "queue_error":            "Search error",
+        "queue_not_found":        "not found",
+        "queue_more":             "more matches, use !roms to see all",
+        "nothing_to_expand":      "Nothing to expand, your last search wasn't rejected.",
+        "no_results":             "No results",
+        "matches_per":            "Matches per %s",
+        "n_matches":              "(%d matches)",
+        "and_more":               "and %d more",
+        "quota_reached":          "You've reached today's limit of %d results, it resets at midnight UTC.",
+        "search_cancelled":       "Search cancelled.",
+        "showing_first":          "Showing first %d results",
+        "showing_first_of":       "Showing first %d of %d results",
+        "too_many_results":       "Too many results: %d\nSend !expand to list the first %d anyway",
+        "col_section":            "Section",
+        "col_console":            "Console",
+        "col_file":               "File",
+        "upstream_needs_console": "Upstream check needs an @console argument.",
+        "upstream_error":         "Upstream check error: %v",
+        "upstream_no_console":    "Upstream check: no known console matches @%s",
+        "upstream_not_found":     "Not found upstream either.",
+        "upstream_found":         "Not in the index, but found upstream (%d):",
+        "search_timed_out":       "Search timed out, please narrow it down.",
+        "search_error":           "Search error: %v",
+        "games_indexed":          "%d games indexed",
+        "updated":                "updated %s",
+        "usage_pref":             "Usage: !pref set <option> <value> | !pref show | !pref clear [option]",
+        "unknown_option":         "Unknown option %q",
+        "pref_save_failed":       "Could not save preference: %v",
+        "pref_saved":             "Saved %s:%s as your default",
+        "pref_load_failed":       "Could not load preferences: %v",
+        "no_prefs":               "No saved preferences",
+        "your_prefs":             "Your defaults: %s",
+        "pref_clear_failed":      "Could not clear preferences: %v",
+        "prefs_cleared":          "Preferences cleared",
+        "verify_no":              "No: %s",
+        "verify_not_found":       "No, that link isn't in the catalog.",
+        "verify_yes":             "Yes: %s | %s\n%s\n%s",
+        "page_footer":            "Page %d/%d · react %s %s to turn pages",
+        "matched":                "[matched: %s]",
+        "pasted":                 "%d results: %s",
+        "new_usage":              "use new:only",
+        "empty_stage":            "nothing to filter on around |, e.g. zelda | file:usa",
+        "result_stats":           "%d results across %d consoles, %d sections",
+        "rows_omitted":           "(%d rows omitted due to size limits)",
+        "usage_cache":            "Usage: !cache stats | !cache clear",
+        "too_broad_hint":         "Your last few searches were all too broad, I'll just react ❌ to the next ones for a while.\nNarrow them down with @console, -exclude or section:/console:/file:, or check how many match first with !count. See !help for all options.",
+        "cache_lookups":          "%s: %d entries, %d hits, %d misses",
+        "cache_entries":          "%s: %d entries",
+        "cache_cleared":          "Cleared %d cached entries",
+        "dump_failed":            "Dump failed: %v",
+        "dump_too_big":           "the catalog is over the dump limit of %d rows or %d MiB",
+        "no_history":             "You haven't searched anything yet",
+        "history_header":         "Your recent searches (!history <n> runs one again):",
+        "usage_history":          "Usage: !history to list your recent searches, !history <n> (1-%d) to run one again",
+        "new_needs_user":         "new:only only works in Matrix",
+        "usage_seen":             "Usage: !seen clear",
+        "seen_clear_failed":      "Could not clear seen results: %v",
+        "seen_cleared":           "Forgot %d seen results",
+        "verbose_usage":          "use verbose:on or verbose:off",
+        "regex_admin_only":       "re: is only available to admins",
+        "regex_needs_term":       "re: needs at least one normal search term as well",
+        "at_once":                "you can only use the @ argument once",
+        "unknown_sort":           "unknown sort %q, use sort:name, sort:relevance, sort:newest or sort:region-priority",
+        "needs_value":            "%s: needs a value, e.g. %s:\"Nintendo 64\"",
+        "invalid_regex":          "invalid regex %q: %v",
+        "unknown_bios":           "unknown bios filter %q, use bios:only or bios:exclude",
+        "unknown_format":         "unknown format %q, use format:list, format:table, format:names or format:curl",
+        "page_usage":             "use page:on or page:off",
+        "unknown_countby":        "unknown countby %q, use countby:console or countby:section",
+        "unknown_group":          "unknown grouping %q, use group:region",
+        "unknown_merge":          "unknown merge %q, use merge:region",
+        "invalid_year":           "invalid year %q, use year:1998 or year:1995-2000",
+        "year_span":              "year range too wide, at most %d years",
+        "too_many_terms":         "too many search terms, please simplify your query",
+        "not_a_url":              "that doesn't look like a URL",
+        "wrong_host":             "only %s links are in the catalog",
+        "not_a_file_link":        "not a file link",
+        "n_consoles":             "(%d consoles)",
+        "no_sections":            "No section matches %q",
+        "did_you_mean":           "Did you mean: %s?",
+        "usage_parse":            "Usage: !parse <query>, e.g. !parse zelda @n64 -beta",
+        "parse_none":             "(none)",
+        "parse_terms":            "Terms: %s",
+        "parse_excluded":         "Excluded: %s",
+        "parse_console":          "Console (@): %s",
+        "parse_scoped":           "Only in one column: %s",
+        "parse_options":          "Options: %s",
+        "badges_usage":           "use badges:on or badges:off",
+        "results_for":            "Results for %s's search: %s",
+        "results_posted":         "%d results posted in %s",
+        "first_usage":            "use first:on or first:off",
+        "first_others":           "%d other matches, search without first:on to see them",
+        "more_left":              "%d more results, send !more to see them",
+        "nothing_more":           "Nothing more to show, your last search here was listed in full.",
+        "invalid_added":          "invalid added filter %q, use e.g. added:7d",
+        "added_unknown":          "added: needs a links.db built by a newer build-db",
+        "hdr_commands":           "Commands",
+        "hdr_syntax":             "Search syntax",
+        "hdr_options":            "Options",
+        "hdr_limits":             "Limits",
+        "hdr_examples":           "Examples",
+        "admins_only":            "(admins)",
+        "cmd_roms":               "search the catalog",
+        "cmd_queue":              "search several titles at once (or one title per line)",
+        "cmd_expand":             "list the first page of your last \"too many results\" search",
+        "cmd_more":               "the next results of your last search, when it was cut short",
+        "cmd_consoles":           "which consoles have matches, and how many; without a query, every console",
+        "cmd_browse":             "list the sections and the consoles in each, with file counts",
+        "cmd_parse":              "show how a search is understood, without running it",
+        "cmd_verify":             "check whether a link is in the catalog",
+        "cmd_history":            "your recent searches, or run one again",
+        "cmd_seen":               "forget which results you have seen, for new:only",
+        "cmd_pref":               "your default search options",
+        "cmd_help":               "this message",
+        "cmd_jobs":               "list running searches",
+        "cmd_cancel":             "cancel a running search",
+        "cmd_cache":              "cache sizes and hit rates, or empty them",
+        "cmd_dump":               "upload the whole catalog as a gzipped CSV",
+        "limit_max_results":      "Searches with more than %d results are rejected, narrow them down or use !expand",
+        "limit_result_cap":       "At most %d results are posted per search",
+        "limit_more_after":       "After %d results the rest waits for !more",
+        "limit_quota":            "%d results per person per day",
+        "limit_cooldown":         "One command every %s per room",
+        "cmd_sections":           "list the sections with how many files and consoles each has",
+        "section_counts":         "%s: %d files in %d consoles",
+        "slow_down":              "Slow down, you can send another command in %s.",
+        "limit_user":             "%d commands in a row per person, then one every %s",
+        "cmd_random":             "one random file, from the matches of a query or the whole catalog",
+        "cmd_stats":              "catalog totals and when it was last updated",
+        "stat_files":             "Files",
+        "stat_sections":          "Sections",
+        "stat_consoles":          "Consoles",
+        "stat_size":              "Total size",
+        "stat_built":             "Updated",
+        "size_partial":           "(of %d files with a known size)",
+        "empty_filter":           "%s: needs a value, e.g. region:usa",
+        "region_unknown":         "region: and lang: need a links.db built by a newer build-db",
+        "1g1r_usage":             "use 1g1r:on or 1g1r:off",
+        "unbalanced_parens":      "unbalanced parentheses, every ( needs a )",
+        "empty_group":            "nothing to match next to OR or inside ( ), e.g. (mario OR zelda)",
+        "parse_group":            "Group: %s",
+        "cmd_get":                "download a file and post it here, by exact file name or its number in your last listing",
+        "usage_get":              "Usage: !get <exact file name> or !get <result number>",
+        "get_no_result":          "There is no result %d in your last listing here",
+        "get_not_found":          "No file named %q",
+        "get_too_big":            "%s is over the %s limit for !get",
+        "get_failed":             "Could not fetch the file: %v",
+        "col_size":               "Size",
+        "col_link":               "Link",
+        "col_dat":                "Listed in",
+        "col_game":               "Game",
+        "source_unknown":         "source: needs a links.db built by a newer build-db",
+        "col_source":             "Source",
+        "ext_unknown":            "ext: needs a links.db built by a newer build-db",
+        "usage_count":            "Usage: !count <query>, e.g. !count zelda @n64 -beta",
+        "cmd_count":              "how many results a search has, per console, without listing them",
+        "count_fits":             "!roms would list them all (up to %d).",
+        "count_too_many":         "Too many for !roms, which lists up to %d: narrow the search down first.",
+        "count_upper_bound":      "year: and regex: are checked on the rows themselves, so fewer may be listed.",
+        "count_capped":           "!roms would list the first %d.",
+        "parse_phrases":          "Whole words: %s",
+        "option_in_group":        "%s: applies to the whole search, put it outside the ( )",
+        "not_in_batch":           "This message has no result %d, only %d–%d: reply to it with one of those numbers.",
+        "too_many_to_sort":       "Too many results to sort this way (over %d), narrow the search.",
+    },
+    "pt": {
+        "no_jobs":                "Nenhuma pesquisa em curso.",
+        "usage_cancel":           "Uso: !cancel <id da pesquisa>",
+        "no_such_job":            "Nenhuma pesquisa #%d em curso",
+        "job_cancelled":          "Pesquisa #%d cancelada",
+        "usage_verify":           "Uso: !verify <url>",
+        "usage_queue":            "Uso: !queue título um, título dois, ... (ou um título por linha)",
+        "too_many_titles":        "Demasiados títulos: %d (máx. %d)",
+        "queue_error":            "Erro na pesquisa",
+        "queue_not_found":        "não encontrado",
+        "queue_more":             "há mais resultados, usa !roms para ver todos",
+        "nothing_to_expand":      "Nada para expandir, a tua última pesquisa não foi rejeitada.",
+        "no_results":             "Sem resultados",
+        "matches_per":            "Resultados por %s",
+        "n_matches":              "(%d resultados)",
+        "and_more":               "e mais %d",
+        "quota_reached":          "Atingiste o limite diário de %d resultados, que reinicia à meia-noite UTC.",
+        "search_cancelled":       "Pesquisa cancelada.",
+        "showing_first":          "A mostrar os primeiros %d resultados",
+        "showing_first_of":       "A mostrar os primeiros %d de %d resultados",
+        "too_many_results":       "Demasiados resultados: %d\nEnvia !expand para listar os primeiros %d mesmo assim",
+        "col_section":            "Secção",
+        "col_console":            "Consola",
+        "col_file":               "Ficheiro",
+        "upstream_needs_console": "A verificação upstream precisa de um argumento @consola.",
+        "upstream_error":         "Erro na verificação upstream: %v",
+        "upstream_no_console":    "Verificação upstream: nenhuma consola conhecida corresponde a @%s",
+        "upstream_not_found":     "Também não encontrado upstream.",
+        "upstream_found":         "Não está no índice, mas existe upstream (%d):",
+        "search_timed_out":       "A pesquisa demorou demasiado, tenta restringi-la.",
+        "search_error":           "Erro na pesquisa: %v",
+        "games_indexed":          "%d jogos indexados",
+        "updated":                "atualizado %s",
+        "usage_pref":             "Uso: !pref set <opção> <valor> | !pref show | !pref clear [opção]",
+        "unknown_option":         "Opção desconhecida %q",
+        "pref_save_failed":       "Não foi possível guardar a preferência: %v",
+        "pref_saved":             "%s:%s guardado como predefinição",
+        "pref_load_failed":       "Não foi possível carregar as preferências: %v",
+        "no_prefs":               "Sem preferências guardadas",
+        "your_prefs":             "As tuas predefinições: %s",
+        "pref_clear_failed":      "Não foi possível apagar as preferências: %v",
+        "prefs_cleared":          "Preferências apagadas",
+        "verify_no":              "Não: %s",
+        "verify_not_found":       "Não, esse link não está no catálogo.",
+        "verify_yes":             "Sim: %s | %s\n%s\n%s",
+        "page_footer":            "Página %d/%d · reage com %s %s para mudar de página",
+        "matched":                "[corresponde: %s]",
+        "pasted":                 "%d resultados: %s",
+        "usage_seen":             "Uso: !seen clear",
+        "empty_stage":            "nada para filtrar à volta de |, p.ex. zelda | file:usa",
+        "no_history":             "Ainda não pesquisaste nada",
+        "history_header":         "As tuas pesquisas recentes (!history <n> repete uma):",
+        "result_stats":           "%d resultados em %d consolas, %d secções",
+        "rows_omitted":           "(%d linhas omitidas por limites de tamanho)",
+        "too_broad_hint":         "As tuas últimas pesquisas foram todas demasiado amplas, durante algum tempo só vou reagir com ❌ às próximas.\nRestringe-as com @consola, -excluir ou section:/console:/file:, ou vê primeiro quantos resultados há com !count. Vê !help para todas as opções.",
+        "seen_clear_failed":      "Não foi possível apagar os resultados vistos: %v",
+        "seen_cleared":           "Esquecidos %d resultados vistos",
+        "regex_admin_only":       "re: só está disponível para administradores",
+        "regex_needs_term":       "re: precisa também de pelo menos um termo de pesquisa normal",
+        "at_once":                "só podes usar o argumento @ uma vez",
+        "too_many_terms":         "demasiados termos de pesquisa, simplifica a pesquisa",
+        "not_a_url":              "isso não parece um URL",
+        "wrong_host":             "só links de %s estão no catálogo",
+        "not_a_file_link":        "não é um link para um ficheiro",
+        "n_consoles":             "(%d consolas)",
+        "no_sections":            "Nenhuma secção corresponde a %q",
+        "did_you_mean":           "Querias dizer: %s?",
+        "usage_parse":            "Uso: !parse <pesquisa>, p.ex. !parse zelda @n64 -beta",
+        "parse_none":             "(nenhum)",
+        "parse_terms":            "Termos: %s",
+        "parse_excluded":         "Excluídos: %s",
+        "parse_console":          "Consola (@): %s",
+        "parse_scoped":           "Só numa coluna: %s",
+        "parse_options":          "Opções: %s",
+        "badges_usage":           "usa badges:on ou badges:off",
+        "results_for":            "Resultados da pesquisa de %s: %s",
+        "results_posted":         "%d resultados publicados em %s",
+        "first_usage":            "usa first:on ou first:off",
+        "first_others":           "mais %d resultados, pesquisa sem first:on para os ver",
+        "more_left":              "mais %d resultados, envia !more para os ver",
+        "nothing_more":           "Não há mais nada para mostrar, a tua última pesquisa aqui já foi listada toda.",
+        "invalid_added":          "filtro added inválido %q, usa p.ex. added:7d",
+        "added_unknown":          "added: precisa de um links.db criado por um build-db mais recente",
+        "hdr_commands":           "Comandos",
+        "hdr_syntax":             "Sintaxe de pesquisa",
+        "hdr_options":            "Opções",
+        "hdr_limits":             "Limites",
+        "hdr_examples":           "Exemplos",
+        "admins_only":            "(administradores)",
+        "cmd_roms":               "pesquisar no catálogo",
+        "cmd_queue":              "pesquisar vários títulos de uma vez (ou um título por linha)",
+        "cmd_expand":             "mostrar a primeira página da tua última pesquisa com \"demasiados resultados\"",
+        "cmd_more":               "os resultados seguintes da tua última pesquisa, quando foi interrompida",
+        "cmd_consoles":           "que consolas têm resultados, e quantos; sem pesquisa, todas as consolas",
+        "cmd_browse":             "listar as secções e as consolas de cada uma, com o número de ficheiros",
+        "cmd_parse":              "mostrar como uma pesquisa é interpretada, sem a executar",
+        "cmd_verify":             "verificar se um link está no catálogo",
+        "cmd_history":            "as tuas pesquisas recentes, ou repetir uma",
+        "cmd_seen":               "esquecer os resultados que já viste, para new:only",
+        "cmd_pref":               "as tuas opções de pesquisa por omissão",
+        "cmd_help":               "esta mensagem",
+        "cmd_jobs":               "listar as pesquisas a decorrer",
+        "cmd_cancel":             "cancelar uma pesquisa a decorrer",
+        "cmd_cache":              "tamanho e taxa de acerto das caches, ou esvaziá-las",
+        "cmd_dump":               "enviar o catálogo inteiro como CSV comprimido",
+        "limit_max_results":      "Pesquisas com mais de %d resultados são rejeitadas, refina-as ou usa !expand",
+        "limit_result_cap":       "No máximo %d resultados são publicados por pesquisa",
+        "limit_more_after":       "Depois de %d resultados o resto espera por !more",
+        "limit_quota":            "%d resultados por pessoa por dia",
+        "limit_cooldown":         "Um comando a cada %s por sala",
+        "cmd_sections":           "listar as secções com quantos ficheiros e consolas tem cada uma",
+        "section_counts":         "%s: %d ficheiros em %d consolas",
+        "slow_down":              "Mais devagar, podes enviar outro comando daqui a %s.",
+        "limit_user":             "%d comandos seguidos por pessoa, depois um a cada %s",
+        "cmd_random":             "um ficheiro ao acaso, dos resultados de uma pesquisa ou do catálogo inteiro",
+        "cmd_stats":              "totais do catálogo e quando foi atualizado",
+        "stat_files":             "Ficheiros",
+        "stat_sections":          "Secções",
+        "stat_consoles":          "Consolas",
+        "stat_size":              "Tamanho total",
+        "stat_built":             "Atualizado",
+        "size_partial":           "(de %d ficheiros com tamanho conhecido)",
+        "empty_filter":           "%s: precisa de um valor, p.ex. region:usa",
+        "region_unknown":         "region: e lang: precisam de um links.db criado por um build-db mais recente",
+        "1g1r_usage":             "usa 1g1r:on ou 1g1r:off",
+        "unbalanced_parens":      "parênteses desequilibrados, cada ( precisa de um )",
+        "empty_group":            "nada para procurar junto a OR ou dentro de ( ), p.ex. (mario OR zelda)",
+        "parse_group":            "Grupo: %s",
+        "cmd_get":                "descarrega um ficheiro e publica-o aqui, pelo nome exato ou pelo número na tua última lista",
+        "usage_get":              "Uso: !get <nome exato do ficheiro> ou !get <número do resultado>",
+        "get_no_result":          "Não há resultado %d na tua última lista aqui",
+        "get_not_found":          "Nenhum ficheiro chamado %q",
+        "get_too_big":            "%s passa o limite de %s do !get",
+        "get_failed":             "Não foi possível obter o ficheiro: %v",
+        "col_size":               "Tamanho",
+        "col_link":               "Link",
+        "col_dat":                "Listado em",
+        "col_game":               "Jogo",
+        "source_unknown":         "source: precisa de um links.db criado por um build-db mais recente",
+        "col_source":             "Fonte",
+        "ext_unknown":            "ext: precisa de um links.db criado por um build-db mais recente",
+        "usage_count":            "Uso: !count <pesquisa>, p.ex. !count zelda @n64 -beta",
+        "cmd_count":              "quantos resultados uma pesquisa tem, por consola, sem os listar",
+        "count_fits":             "O !roms listava-os todos (até %d).",
+        "count_too_many":         "Demasiados para o !roms, que lista até %d: restringe primeiro a pesquisa.",
+        "count_upper_bound":      "year: e regex: são verificados nas próprias linhas, por isso podem ser listados menos.",
+        "count_capped":           "O !roms listava os primeiros %d.",
+        "parse_phrases":          "Palavras inteiras: %s",
+        "option_in_group":        "%s: aplica-se à pesquisa toda, põe-no fora dos ( )",
+        "not_in_batch":           "Esta mensagem não tem o resultado %d, só %d–%d: responde-lhe com um desses números.",
+        "too_many_to_sort":       "Demasiados resultados para ordenar assim (mais de %d), restringe a pesquisa.",
+    },
+    "de": {
+        "no_jobs":                "Keine laufenden Suchen.",
+        "usage_cancel":           "Verwendung: !cancel <Such-ID>",
+        "no_such_job":            "Keine laufende Suche #%d",
+        "job_cancelled":          "Suche #%d abgebrochen",
+        "usage_verify":           "Verwendung: !verify <url>",
+        "usage_queue":            "Verwendung: !queue Titel eins, Titel zwei, ... (oder ein Titel pro Zeile)",
+        "too_many_titles":        "Zu viele Titel: %d (max. %d)",
+        "queue_error":            "Suchfehler",
+        "queue_not_found":        "nicht gefunden",
+        "queue_more":             "weitere Treffer, !roms zeigt alle",
+        "nothing_to_expand":      "Nichts zu erweitern, deine letzte Suche wurde nicht abgelehnt.",
+        "no_results":             "Keine Ergebnisse",
+        "matches_per":            "Treffer pro %s",
+        "n_matches":              "(%d Treffer)",
+        "and_more":               "und %d weitere",
+        "quota_reached":          "Du hast das Tageslimit von %d Ergebnissen erreicht, es wird um Mitternacht UTC zurückgesetzt.",
+        "search_cancelled":       "Suche abgebrochen.",
+        "showing_first":          "Zeige die ersten %d Ergebnisse",
+        "showing_first_of":       "Zeige die ersten %d von %d Ergebnissen",
+        "too_many_results":       "Zu viele Ergebnisse: %d\nSende !expand, um trotzdem die ersten %d aufzulisten",
+        "col_section":            "Bereich",
+        "col_console":            "Konsole",
+        "col_file":               "Datei",
+        "upstream_needs_console": "Die Upstream-Prüfung braucht ein @Konsole-Argument.",
+        "upstream_error":         "Fehler bei der Upstream-Prüfung: %v",
+        "upstream_no_console":    "Upstream-Prüfung: keine bekannte Konsole passt zu @%s",
+        "upstream_not_found":     "Auch upstream nicht gefunden.",
+        "upstream_found":         "Nicht im Index, aber upstream vorhanden (%d):",
+        "search_timed_out":       "Zeitüberschreitung bei der Suche, bitte schränke sie ein.",
+        "search_error":           "Suchfehler: %v",
+        "games_indexed":          "%d Spiele indexiert",
+        "updated":                "aktualisiert %s",
+        "usage_pref":             "Verwendung: !pref set <Option> <Wert> | !pref show | !pref clear [Option]",
+        "unknown_option":         "Unbekannte Option %q",
+        "pref_save_failed":       "Einstellung konnte nicht gespeichert werden: %v",
+        "pref_saved":             "%s:%s als Standard gespeichert",
+        "pref_load_failed":       "Einstellungen konnten nicht geladen werden: %v",
+        "no_prefs":               "Keine gespeicherten Einstellungen",
+        "your_prefs":             "Deine Standards: %s",
+        "pref_clear_failed":      "Einstellungen konnten nicht gelöscht werden: %v",
+        "prefs_cleared":          "Einstellungen gelöscht",
+        "verify_no":              "Nein: %s",
+        "verify_not_found":       "Nein, dieser Link ist nicht im Katalog.",
+        "verify_yes":             "Ja: %s | %s\n%s\n%s",
+        "page_footer":            "Seite %d/%d · reagiere mit %s %s zum Blättern",
+        "matched":                "[Treffer in: %s]",
+        "pasted":                 "%d Ergebnisse: %s",
+        "usage_seen":             "Verwendung: !seen clear",
+        "empty_stage":            "nichts zu filtern vor oder nach |, z.B. zelda | file:usa",
+        "no_history":             "Du hast noch nichts gesucht",
+        "history_header":         "Deine letzten Suchen (!history <n> wiederholt eine):",
+        "result_stats":           "%d Ergebnisse in %d Konsolen, %d Bereichen",
+        "rows_omitted":           "(%d Zeilen wegen Größenbeschränkung ausgelassen)",
+        "too_broad_hint":         "Deine letzten Suchen waren alle zu breit, auf die nächsten reagiere ich eine Weile nur mit ❌.\nSchränke sie mit @Konsole, -ausschließen oder section:/console:/file: ein, oder prüfe mit !count zuerst, wie viele Treffer es gibt. !help zeigt alle Optionen.",
+        "seen_clear_failed":      "Gesehene Ergebnisse konnten nicht gelöscht werden: %v",
+        "seen_cleared":           "%d gesehene Ergebnisse vergessen",
+        "regex_admin_only":       "re: ist nur für Admins verfügbar",
+        "regex_needs_term":       "re: braucht zusätzlich mindestens einen normalen Suchbegriff",
+        "at_once":                "das @-Argument darf nur einmal vorkommen",
+        "too_many_terms":         "zu viele Suchbegriffe, bitte vereinfache die Suche",
+        "not_a_url":              "das sieht nicht wie eine URL aus",
+        "wrong_host":             "nur Links von %s sind im Katalog",
+        "not_a_file_link":        "kein Link auf eine Datei",
+        "n_consoles":             "(%d Konsolen)",
+        "no_sections":            "Kein Bereich passt zu %q",
+        "did_you_mean":           "Meintest du: %s?",
+        "usage_parse":            "Verwendung: !parse <Suche>, z.B. !parse zelda @n64 -beta",
+        "parse_none":             "(keine)",
+        "parse_terms":            "Begriffe: %s",
+        "parse_excluded":         "Ausgeschlossen: %s",
+        "parse_console":          "Konsole (@): %s",
+        "parse_scoped":           "Nur in einer Spalte: %s",
+        "parse_options":          "Optionen: %s",
+        "badges_usage":           "verwende badges:on oder badges:off",
+        "results_for":            "Ergebnisse der Suche von %s: %s",
+        "results_posted":         "%d Ergebnisse gepostet in %s",
+        "first_usage":            "verwende first:on oder first:off",
+        "first_others":           "%d weitere Treffer, suche ohne first:on, um sie zu sehen",
+        "more_left":              "%d weitere Ergebnisse, sende !more, um sie zu sehen",
+        "nothing_more":           "Nichts mehr zu zeigen, deine letzte Suche hier wurde vollständig aufgelistet.",
+        "invalid_added":          "ungültiger added-Filter %q, verwende z.B. added:7d",
+        "added_unknown":          "added: braucht eine links.db von einem neueren build-db",
+        "hdr_commands":           "Befehle",
+        "hdr_syntax":             "Suchsyntax",
+        "hdr_options":            "Optionen",
+        "hdr_limits":             "Grenzen",
+        "hdr_examples":           "Beispiele",
+        "admins_only":            "(Admins)",
+        "cmd_roms":               "den Katalog durchsuchen",
+        "cmd_queue":              "mehrere Titel auf einmal suchen (oder ein Titel pro Zeile)",
+        "cmd_expand":             "die erste Seite deiner letzten Suche mit \"zu vielen Ergebnissen\" zeigen",
+        "cmd_more":               "die nächsten Ergebnisse deiner letzten Suche, wenn sie gekürzt wurde",
+        "cmd_consoles":           "welche Konsolen Treffer haben, und wie viele; ohne Suche alle Konsolen",
+        "cmd_browse":             "die Bereiche und ihre Konsolen mit Dateianzahl auflisten",
+        "cmd_parse":              "zeigen, wie eine Suche verstanden wird, ohne sie auszuführen",
+        "cmd_verify":             "prüfen, ob ein Link im Katalog ist",
+        "cmd_history":            "deine letzten Suchen, oder eine wiederholen",
+        "cmd_seen":               "vergessen, welche Ergebnisse du gesehen hast, für new:only",
+        "cmd_pref":               "deine Standard-Suchoptionen",
+        "cmd_help":               "diese Nachricht",
+        "cmd_jobs":               "laufende Suchen auflisten",
+        "cmd_cancel":             "eine laufende Suche abbrechen",
+        "cmd_cache":              "Cache-Größen und Trefferquoten, oder sie leeren",
+        "cmd_dump":               "den ganzen Katalog als gzip-CSV hochladen",
+        "limit_max_results":      "Suchen mit mehr als %d Ergebnissen werden abgelehnt, grenze sie ein oder nutze !expand",
+        "limit_result_cap":       "Höchstens %d Ergebnisse werden pro Suche gesendet",
+        "limit_more_after":       "Nach %d Ergebnissen wartet der Rest auf !more",
+        "limit_quota":            "%d Ergebnisse pro Person und Tag",
+        "limit_cooldown":         "Ein Befehl alle %s pro Raum",
+        "cmd_sections":           "die Bereiche mit ihrer Anzahl an Dateien und Konsolen auflisten",
+        "section_counts":         "%s: %d Dateien in %d Konsolen",
+        "slow_down":              "Langsamer, du kannst in %s den nächsten Befehl senden.",
+        "limit_user":             "%d Befehle am Stück pro Person, dann einer alle %s",
+        "cmd_random":             "eine zufällige Datei, aus den Treffern einer Suche oder dem ganzen Katalog",
+        "cmd_stats":              "Katalogsummen und wann er zuletzt aktualisiert wurde",
+        "stat_files":             "Dateien",
+        "stat_sections":          "Bereiche",
+        "stat_consoles":          "Konsolen",
+        "stat_size":              "Gesamtgröße",
+        "stat_built":             "Aktualisiert",
+        "size_partial":           "(von %d Dateien mit bekannter Größe)",
+        "empty_filter":           "%s: braucht einen Wert, z.B. region:usa",
+        "region_unknown":         "region: und lang: brauchen eine links.db von einem neueren build-db",
+        "1g1r_usage":             "verwende 1g1r:on oder 1g1r:off",
+        "unbalanced_parens":      "Klammern passen nicht zusammen, jede ( braucht eine )",
+        "empty_group":            "nichts zu suchen neben OR oder in ( ), z.B. (mario OR zelda)",
+        "parse_group":            "Gruppe: %s",
+        "cmd_get":                "lädt eine Datei herunter und postet sie hier, per genauem Dateinamen oder ihrer Nummer in deiner letzten Liste",
+        "usage_get":              "Verwendung: !get <genauer Dateiname> oder !get <Ergebnisnummer>",
+        "get_no_result":          "Es gibt kein Ergebnis %d in deiner letzten Liste hier",
+        "get_not_found":          "Keine Datei namens %q",
+        "get_too_big":            "%s ist größer als das Limit von %s für !get",
+        "get_failed":             "Datei konnte nicht geholt werden: %v",
+        "col_size":               "Größe",
+        "col_link":               "Link",
+        "col_dat":                "Gelistet in",
+        "col_game":               "Spiel",
+        "source_unknown":         "source: braucht eine links.db von einem neueren build-db",
+        "col_source":             "Quelle",
+        "ext_unknown":            "ext: braucht eine links.db von einem neueren build-db",
+        "usage_count":            "Verwendung: !count <Suche>, z.B. !count zelda @n64 -beta",
+        "cmd_count":              "wie viele Treffer eine Suche hat, pro Konsole, ohne sie aufzulisten",
+        "count_fits":             "!roms würde sie alle auflisten (bis zu %d).",
+        "count_too_many":         "Zu viele für !roms, das bis zu %d auflistet: schränke die Suche zuerst ein.",
+        "count_upper_bound":      "year: und regex: werden an den Zeilen selbst geprüft, daher werden evtl. weniger aufgelistet.",
+        "count_capped":           "!roms würde die ersten %d auflisten.",
+        "parse_phrases":          "Ganze Wörter: %s",
+        "option_in_group":        "%s: gilt für die ganze Suche, setze es außerhalb der ( )",
+        "not_in_batch":           "Diese Nachricht hat kein Ergebnis %d, nur %d–%d: antworte darauf mit einer dieser Nummern.",
+        "too_many_to_sort":       "Zu viele Ergebnisse, um so zu sortieren (über %d), grenze die Suche ein.",
+    },
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// The bot, build-db and test.go are separate programs in one directory, so
+// the tests are run with their program: go test main.go main_test.go
+
+func TestParseArgsScopedQuotes(t *testing.T) {
+    tests := []struct {
+        query     string
+        positives []string
+        negatives []string
+        phrases   []string
+    }{
+        {`zelda`, []string{"zelda"}, nil, nil},
+        {`console:"Nintendo 64"`, []string{"console:Nintendo 64"}, nil, nil},
+        {`mario console:'Nintendo 64' -beta`, []string{"mario", "console:Nintendo 64"}, []string{"beta"}, nil},
+        {`-file:"x y"`, nil, []string{"file:x y"}, nil},
+        {`zelda -file:"x y" console:"Nintendo 64"`, []string{"zelda", "console:Nintendo 64"}, []string{"file:x y"}, nil},
+        {`"mega man" -"x"`, []string{"mega man"}, []string{"x"}, []string{"mega man", "x"}},
+        {`zelda | file:usa`, []string{"zelda", "file:usa"}, nil, nil},
+    }
+    for _, tt := range tests {
+        positives, negatives, _, groups, phrases, err := parseArgs(tt.query)
+        if err != nil {
+            t.Errorf("parseArgs(%q): %v", tt.query, err)
+            continue
+        }
+        if len(groups) > 0 {
+            t.Errorf("parseArgs(%q) groups = %v, want none", tt.query, groups)
+        }
+        if !reflect.DeepEqual(positives, tt.positives) || !reflect.DeepEqual(negatives, tt.negatives) || !reflect.DeepEqual(phrases, tt.phrases) {
+            t.Errorf("parseArgs(%q) = %q, %q, phrases %q; want %q, %q, phrases %q",
+                tt.query, positives, negatives, phrases, tt.positives, tt.negatives, tt.phrases)
+        }
+    }
+}
+
+func TestParseArgsAt(t *testing.T) {
+    positives, _, atArg, _, _, err := parseArgs(`zelda @"Nintendo 3DS"`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if atArg == nil || *atArg != "Nintendo 3DS" || !reflect.DeepEqual(positives, []string{"zelda"}) {
+        t.Errorf("got %q, @%v; want [zelda], @Nintendo 3DS", positives, atArg)
+    }
+    if _, _, _, _, _, err := parseArgs("@snes @nes"); err == nil {
+        t.Error("two @console terms: want an error")
+    }
+}
+
+func TestParseOptionsScoped(t *testing.T) {
+    tests := []struct {
+        query    string
+        rest     []string
+        scoped   []scopedTerm
+        excluded []scopedTerm
+    }{
+        {`zelda console:"Nintendo 64"`, []string{"zelda"}, []scopedTerm{{"console", "Nintendo 64"}}, nil},
+        {`zelda -file:"x y"`, []string{"zelda"}, nil, []scopedTerm{{"file", "x y"}}},
+        {`Section:"No-Intro" -Console:"Game Boy" mario`, []string{"mario"}, []scopedTerm{{"section", "No-Intro"}}, []scopedTerm{{"console", "Game Boy"}}},
+    }
+    for _, tt := range tests {
+        positives, negatives, _, _, _, err := parseArgs(tt.query)
+        if err != nil {
+            t.Errorf("parseArgs(%q): %v", tt.query, err)
+            continue
+        }
+        rest, opts, err := parseOptions(positives)
+        if err != nil {
+            t.Errorf("parseOptions(%q): %v", positives, err)
+            continue
+        }
+        _, excluded, err := parseExcludedScopes(negatives)
+        if err != nil {
+            t.Errorf("parseExcludedScopes(%q): %v", negatives, err)
+            continue
+        }
+        if !reflect.DeepEqual(rest, tt.rest) || !reflect.DeepEqual(opts.Scoped, tt.scoped) || !reflect.DeepEqual(excluded, tt.excluded) {
+            t.Errorf("%q: rest %q, scoped %v, excluded %v; want %q, %v, %v",
+                tt.query, rest, opts.Scoped, excluded, tt.rest, tt.scoped, tt.excluded)
+        }
+    }
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+    for _, terms := range [][]string{
+        {"console:"},
+        {"sort:size"},
+        {"format:xml"},
+        {"re:("},
+    } {
+        if _, _, err := parseOptions(terms); err == nil {
+            t.Errorf("parseOptions(%q): want an error", terms)
+        }
+    }
+    if _, _, err := parseExcludedScopes([]string{"file:"}); err == nil {
+        t.Error(`parseExcludedScopes("file:"): want an error`)
+    }
+}
+
+// manyTerms returns n distinct search terms
+func manyTerms(prefix string, n int) []string {
+    terms := make([]string, n)
+    for i := range terms {
+        terms[i] = fmt.Sprintf("%s%d", prefix, i)
+    }
+    return terms
+}
+
+func TestBuildWhereClauseTermLimit(t *testing.T) {
+    for _, tt := range []struct {
+        name string
+        opts searchOptions
+    }{
+        {"positives", searchOptions{}},
+        {"negatives", searchOptions{}},
+        {"both", searchOptions{}},
+        {"alt titles", searchOptions{AltTitles: true}},
+        {"search_blob", searchOptions{SearchBlob: true}},
+    } {
+        for n := 1; n <= 1500; n += 13 {
+            var positives, negatives []string
+            switch tt.name {
+            case "negatives":
+                negatives = manyTerms("not", n)
+            case "both":
+                positives, negatives = manyTerms("yes", n), manyTerms("not", n)
+            default:
+                positives = manyTerms("yes", n)
+            }
+            where, args := buildWhereClause(positives, negatives, nil, tt.opts)
+            if strings.Count(where, "?") != len(args) {
+                t.Fatalf("%s, %d terms: %d placeholders for %d args", tt.name, n, strings.Count(where, "?"), len(args))
+            }
+            compact := strings.Contains(where, "char(31)") || strings.Contains(where, "search_blob")
+            if len(args) <= maxSQLVariables {
+                // Fitting in three variables per term means no need to compact
+                if !tt.opts.SearchBlob && compact && 4*(len(positives)+len(negatives))+3 <= maxSQLVariables {
+                    t.Errorf("%s, %d terms: compact mode with %d args", tt.name, n, len(args))
+                }
+                continue
+            }
+            // Over the limit even compacted: the query must be refused
+            // before it reaches the database
+            if !compact {
+                t.Errorf("%s, %d terms: %d args without compact mode", tt.name, n, len(args))
+            }
+            if _, err := (&Bot{}).count(context.Background(), positives, negatives, nil, tt.opts); !errors.Is(err, errTooManyTerms) {
+                t.Errorf("%s, %d terms: count = %v, want errTooManyTerms", tt.name, n, err)
+            }
+        }
+    }
+}
+
+func TestBuildWhereClauseCompactsBeforeLimit(t *testing.T) {
+    // Three variables per term would need 1200, compacted it's one each
+    positives := manyTerms("term", 400)
+    where, args := buildWhereClause(positives, nil, nil, searchOptions{})
+    if len(args) > maxSQLVariables {
+        t.Fatalf("400 terms: %d args, want compact mode under %d", len(args), maxSQLVariables)
+    }
+    if !strings.Contains(where, "char(31)") {
+        t.Errorf("400 terms: want the fields joined with char(31), got %.200s...", where)
+    }
+}
+
+func TestDateKey(t *testing.T) {
+    tests := []struct {
+        file string
+        want string
+    }{
+        {"Super Mario 64 (Japan) (Beta) (1996-02-19).z64", "1996-02-19"},
+        {"Sonic the Hedgehog (World) (Proto) (19910128).zip", "1991-01-28"},
+        {"Wii U System Update (World) (v5.5.5) (2021-01-12).zip", "2021-01-12"},
+        {"102 Dalmatians - Puppies to the Rescue (USA) (Demo) (2000-09).zip", "2000-00-00"},
+        {"FIFA Soccer 2005 (USA).zip", "2005-00-00"},
+        {"Tony Hawk's Pro Skater (USA) (2012-13-01).zip", "2012-00-00"},
+        {"Tetris (World) (Rev 1).zip", ""},
+        {"Gran Turismo 2 (USA) (SCUS-94455).chd", ""},
+        {"Grand Theft Auto - San Andreas (USA) (SLUS-20946).chd", ""},
+        {"Doom (USA) (Beta) (123456789).zip", ""},
+    }
+    for _, tt := range tests {
+        got, ok := dateKey(tt.file)
+        if got != tt.want || ok != (tt.want != "") {
+            t.Errorf("dateKey(%q) = %q, %v; want %q", tt.file, got, ok, tt.want)
+        }
+    }
+}
+
+func TestSortByNewest(t *testing.T) {
+    var results []resultRow
+    for _, f := range []string{
+        "Game (USA).zip",
+        "Game (USA) (1999).zip",
+        "Game (USA) (Beta) (1999-05-01).zip",
+        "Game (USA) (Beta) (2001-02-03).zip",
+        "Game (USA) (Rev 1) (1999).zip",
+    } {
+        results = append(results, resultRow{File: f})
+    }
+    sortByNewest(results)
+    want := []string{
+        "Game (USA) (Beta) (2001-02-03).zip",
+        "Game (USA) (Beta) (1999-05-01).zip",
+        "Game (USA) (Rev 1) (1999).zip",
+        "Game (USA) (1999).zip",
+        "Game (USA).zip",
+    }
+    for i, r := range results {
+        if r.File != want[i] {
+            t.Errorf("sortByNewest()[%d] = %q, want %q", i, r.File, want[i])
+        }
+    }
+}
+
+func TestRegionsOf(t *testing.T) {
+    tests := []struct {
+        file string
+        want []string
+    }{
+        {"Super Mario World (USA).sfc", []string{"USA"}},
+        {"Sonic the Hedgehog (USA, Europe) (Rev 1).zip", []string{"USA", "Europe"}},
+        {"Tetris (World) (Rev 1).zip", []string{"World"}},
+        {"Mother 3 (Japan) (En) (Translated).zip", []string{"Japan"}},
+        {"Pokemon Crystal (Hong Kong).zip", []string{"Hong Kong"}},
+        // The first tag with a region counts, not the version or languages
+        {"Game (v1.1) (Europe) (En,Fr,De).zip", []string{"Europe"}},
+        {"Game (Beta) (Japan, Korea).zip", []string{"Japan", "Korea"}},
+        {"Homebrew Game (PD).zip", nil},
+        {"Game [USA].zip", nil},
+    }
+    for _, tt := range tests {
+        if got := regionsOf(tt.file); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("regionsOf(%q) = %q, want %q", tt.file, got, tt.want)
+        }
+    }
+}
+
+func TestSortByRegionPriority(t *testing.T) {
+    var results []resultRow
+    for _, f := range []string{
+        "Game (Brazil).zip",
+        "Game (Europe).zip",
+        "Game (Japan).zip",
+        "Game (PD).zip",
+        "Game (Japan, USA).zip",
+        "Game (World).zip",
+        "Game (Australia).zip",
+    } {
+        results = append(results, resultRow{File: f})
+    }
+    sortByRegionPriority(results, defaultRegionPriority)
+    // Unlisted regions keep their order after the listed ones, files
+    // without a region go last
+    want := []string{
+        "Game (Japan, USA).zip",
+        "Game (World).zip",
+        "Game (Europe).zip",
+        "Game (Japan).zip",
+        "Game (Brazil).zip",
+        "Game (Australia).zip",
+        "Game (PD).zip",
+    }
+    for i, r := range results {
+        if r.File != want[i] {
+            t.Errorf("sortByRegionPriority()[%d] = %q, want %q", i, r.File, want[i])
+        }
+    }
+
+    // Priorities from the config match regardless of case
+    results = []resultRow{{File: "Game (USA).zip"}, {File: "Game (Europe).zip"}}
+    sortByRegionPriority(results, []string{"europe", "usa"})
+    if results[0].File != "Game (Europe).zip" {
+        t.Errorf("sortByRegionPriority(europe, usa) = %q first, want Game (Europe).zip", results[0].File)
+    }
+}
+
+// bigRows returns n rows whose names take up about size bytes each
+func bigRows(n, size int) []resultRow {
+    rows := make([]resultRow, n)
+    for i := range rows {
+        name := fmt.Sprintf("Game %d %s (USA).zip", i, strings.Repeat("x", size))
+        rows[i] = resultRow{Section: "No-Intro", Console: "Nintendo - Game Boy", File: name, Rawurl: "https://example.org/" + name}
+    }
+    return rows
+}
+
+func TestRenderFitting(t *testing.T) {
+    rows := bigRows(5, 100)
+    plain, html, fit := renderFitting(rows, 1, searchOptions{}, "en")
+    if fit != len(rows) {
+        t.Errorf("small batch: %d of %d rows fit", fit, len(rows))
+    }
+    if !strings.Contains(plain, rows[4].File) || !strings.Contains(html, "5.") {
+        t.Errorf("small batch: last row missing from\n%s", plain)
+    }
+
+    rows = bigRows(50, 5000)
+    plain, html, fit = renderFitting(rows, 1, searchOptions{}, "en")
+    if fit < 1 || fit >= len(rows) {
+        t.Fatalf("oversized batch: %d of %d rows fit", fit, len(rows))
+    }
+    if len(plain)+len(html) > maxMessageBytes {
+        t.Errorf("oversized batch: %d bytes, over %d", len(plain)+len(html), maxMessageBytes)
+    }
+    if strings.Contains(plain, rows[fit].File) {
+        t.Errorf("oversized batch: row %d rendered although only %d fit", fit+1, fit)
+    }
+
+    // A single row is sent even when it's too big on its own
+    if _, _, fit := renderFitting(bigRows(3, maxMessageBytes), 1, searchOptions{}, "en"); fit != 1 {
+        t.Errorf("huge row: %d rows fit, want 1", fit)
+    }
+}
+
+func TestPagedRenderOmittedRows(t *testing.T) {
+    p := &pagedResult{results: bigRows(pageSize+5, 5000)}
+    plain, html := p.render("en")
+    _, _, fit := renderFitting(p.results[:pageSize], 1, p.opts, "en")
+    if fit >= pageSize {
+        t.Fatalf("all %d rows of the oversized page fit", fit)
+    }
+    note := translate("en", "rows_omitted", pageSize-fit)
+    if !strings.Contains(plain, note) || !strings.Contains(html, "<i>"+note+"</i>") {
+        t.Errorf("page with %d of %d rows fitting lacks %q:\n%.300s", fit, pageSize, note, plain)
+    }
+
+    p = &pagedResult{results: bigRows(pageSize+5, 10)}
+    if plain, _ := p.render("en"); strings.Contains(plain, "omitted") {
+        t.Errorf("page that fits mentions omitted rows:\n%s", plain)
+    }
+}
+
+func TestBadges(t *testing.T) {
+    tests := []struct {
+        file string
+        want string
+    }{
+        {"Super Mario World (USA).sfc", "🇺🇸"},
+        {"Sonic the Hedgehog (USA, Europe).zip", "🇺🇸🇪🇺"},
+        {"Rayman (Europe) (En,Fr,De,Es,It,Nl).zip", "🇪🇺 [EN/FR/DE/ES/IT/NL]"},
+        {"Mother 3 (Japan) (En).zip", "🇯🇵 [EN]"},
+        {"Chrono Trigger (World) (Zh-Hant).zip", "🌐 [ZH-HANT]"},
+        {"Game (Scandinavia) (Sv,No,Da) (Rev 1).zip", "🇸🇪🇳🇴🇩🇰 [SV/NO/DA]"},
+        // Languages without a region, and a region after other tags
+        {"Homebrew Game (En,Fr).zip", "[EN/FR]"},
+        {"Game (Beta) (Japan).zip", "🇯🇵"},
+        {"Homebrew Game (PD).zip", ""},
+        {"Game.zip", ""},
+    }
+    for _, tt := range tests {
+        if got := badges(tt.file); got != tt.want {
+            t.Errorf("badges(%q) = %q, want %q", tt.file, got, tt.want)
+        }
+    }
+}
+
+func TestBuildWhereClauseAltTitles(t *testing.T) {
+    opts := searchOptions{AltTitles: true}
+    for _, tt := range []struct {
+        name      string
+        positives []string
+        negatives []string
+        opts      searchOptions
+    }{
+        {"per field", []string{"zelda"}, []string{"beta"}, opts},
+        {"compact", manyTerms("term", 300), []string{"beta"}, opts},
+        {"search_blob", []string{"zelda"}, []string{"beta"}, searchOptions{AltTitles: true, SearchBlob: true}},
+    } {
+        where, args := buildWhereClause(tt.positives, tt.negatives, nil, tt.opts)
+        if got, want := strings.Count(where, "alt_titles.title"), len(tt.positives)+len(tt.negatives); got != want {
+            t.Errorf("%s: %d alternate title lookups, want one per term (%d)", tt.name, got, want)
+        }
+        if !strings.Contains(where, "AND NOT EXISTS (SELECT 1 FROM alt_titles") {
+            t.Errorf("%s: negative doesn't exclude alternate titles: %.300s", tt.name, where)
+        }
+        if strings.Count(where, "?") != len(args) {
+            t.Errorf("%s: %d placeholders for %d args", tt.name, strings.Count(where, "?"), len(args))
+        }
+    }
+
+    where, _ := buildWhereClause([]string{"zelda"}, nil, nil, searchOptions{AltTitles: true, Excluded: []scopedTerm{{"file", "beta"}, {"console", "gba"}}})
+    if strings.Count(where, "NOT EXISTS (SELECT 1 FROM alt_titles") != 1 {
+        t.Errorf("-file: should exclude alternate titles, -console: not: %s", where)
+    }
+}